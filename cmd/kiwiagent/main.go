@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/kiwih/kiwiland/kiwiagent"
+)
+
+func main() {
+	//Enable logger
+	logFileName := os.Getenv("LOG_FILE_NAME")
+	if len(logFileName) == 0 {
+		logFileName = "kiwiagent.log"
+	}
+
+	f, err := os.OpenFile(logFileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		panic("Can't open log file: " + err.Error())
+	}
+	log.SetOutput(io.MultiWriter(f, os.Stdout))
+
+	serverAddress := ":" + os.Getenv("HTTP_PORT")
+	if serverAddress == ":" {
+		log.Println("$HTTP_PORT was not set, defaulting to 3001")
+		serverAddress = ":3001"
+	}
+
+	sleepOnLANAddress := ":" + os.Getenv("SLEEP_ON_LAN_PORT")
+	if sleepOnLANAddress == ":" {
+		log.Println("$SLEEP_ON_LAN_PORT was not set, defaulting to 9009")
+		sleepOnLANAddress = ":9009"
+	}
+
+	//in sleep-on-lan mode there is no http api, only the udp listener
+	if os.Getenv("AGENT_MODE") == "sleeponlan" {
+		serverAddress = ""
+	}
+
+	kiwiagent.StartAgent(serverAddress, sleepOnLANAddress)
+}
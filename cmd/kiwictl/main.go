@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/kiwih/kiwiland/kiwictl"
+)
+
+func main() {
+	os.Exit(kiwictl.Main(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
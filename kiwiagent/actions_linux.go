@@ -0,0 +1,85 @@
+package kiwiagent
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Sleep suspends the machine via systemd
+func Sleep() error {
+	return exec.Command("systemctl", "suspend").Run()
+}
+
+//Shutdown powers the machine off via systemd
+func Shutdown() error {
+	return exec.Command("systemctl", "poweroff").Run()
+}
+
+//Lock locks all desktop sessions via logind
+func Lock() error {
+	return exec.Command("loginctl", "lock-sessions").Run()
+}
+
+//Volume changes the default pulseaudio sink's volume. The direction is one of up, down or mute
+func Volume(direction string) error {
+	switch direction {
+	case "up":
+		return exec.Command("pactl", "set-sink-volume", "@DEFAULT_SINK@", "+5%").Run()
+	case "down":
+		return exec.Command("pactl", "set-sink-volume", "@DEFAULT_SINK@", "-5%").Run()
+	default:
+		return exec.Command("pactl", "set-sink-mute", "@DEFAULT_SINK@", "toggle").Run()
+	}
+}
+
+//Launch starts a command without waiting for it to finish
+func Launch(command []string) error {
+	cmd := exec.Command(command[0], command[1:]...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+//Running returns the sorted, de-duplicated names of the running processes from /proc
+func Running() ([]string, error) {
+	comms, err := filepath.Glob("/proc/[0-9]*/comm")
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, comm := range comms {
+		b, err := ioutil.ReadFile(comm)
+		if err != nil {
+			continue //the process exited while we were looking
+		}
+		name := strings.TrimSpace(string(b))
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+//IdleTime asks xprintidle how long it has been since the last keyboard or mouse input.
+//The agent must be running in the desktop session (with $DISPLAY set) for this to work
+func IdleTime() (time.Duration, error) {
+	out, err := exec.Command("xprintidle").Output()
+	if err != nil {
+		return 0, err
+	}
+	ms, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
@@ -0,0 +1,45 @@
+//go:build !linux && !windows
+
+package kiwiagent
+
+import (
+	"errors"
+	"time"
+)
+
+var errUnsupported = errors.New("Not supported on this platform")
+
+//Sleep is not supported on this platform
+func Sleep() error {
+	return errUnsupported
+}
+
+//Shutdown is not supported on this platform
+func Shutdown() error {
+	return errUnsupported
+}
+
+//Lock is not supported on this platform
+func Lock() error {
+	return errUnsupported
+}
+
+//Volume is not supported on this platform
+func Volume(direction string) error {
+	return errUnsupported
+}
+
+//Launch is not supported on this platform
+func Launch(command []string) error {
+	return errUnsupported
+}
+
+//Running is not supported on this platform
+func Running() ([]string, error) {
+	return nil, errUnsupported
+}
+
+//IdleTime is not supported on this platform
+func IdleTime() (time.Duration, error) {
+	return 0, errUnsupported
+}
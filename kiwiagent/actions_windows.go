@@ -0,0 +1,96 @@
+package kiwiagent
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os/exec"
+	"sort"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+//Sleep suspends the machine
+func Sleep() error {
+	return exec.Command("rundll32.exe", "powrprof.dll,SetSuspendState", "0,1,0").Run()
+}
+
+//Shutdown powers the machine off
+func Shutdown() error {
+	return exec.Command("shutdown", "/s", "/t", "0").Run()
+}
+
+//Lock locks the workstation
+func Lock() error {
+	return exec.Command("rundll32.exe", "user32.dll,LockWorkStation").Run()
+}
+
+//Volume presses the media volume keys. The direction is one of up, down or mute
+func Volume(direction string) error {
+	key := "173" //VK_VOLUME_MUTE
+	switch direction {
+	case "up":
+		key = "175"
+	case "down":
+		key = "174"
+	}
+	return exec.Command("powershell", "-NoProfile", "-Command", "(New-Object -ComObject WScript.Shell).SendKeys([char]"+key+")").Run()
+}
+
+//Launch starts a command without waiting for it to finish
+func Launch(command []string) error {
+	cmd := exec.Command(command[0], command[1:]...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+//Running returns the sorted, de-duplicated image names from tasklist
+func Running() ([]string, error) {
+	var out bytes.Buffer
+	cmd := exec.Command("tasklist", "/fo", "csv", "/nh")
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, r := range records {
+		if len(r) > 0 && !seen[r[0]] {
+			seen[r[0]] = true
+			names = append(names, r[0])
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+var (
+	user32           = syscall.NewLazyDLL("user32.dll")
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	getLastInputInfo = user32.NewProc("GetLastInputInfo")
+	getTickCount     = kernel32.NewProc("GetTickCount")
+)
+
+//lastInputInfo is the LASTINPUTINFO struct
+type lastInputInfo struct {
+	cbSize uint32
+	dwTime uint32
+}
+
+//IdleTime asks windows how long it has been since the last keyboard or mouse input.
+//The agent must be running in the user's session (not as a service) for this to work
+func IdleTime() (time.Duration, error) {
+	info := lastInputInfo{cbSize: uint32(unsafe.Sizeof(lastInputInfo{}))}
+	if r, _, err := getLastInputInfo.Call(uintptr(unsafe.Pointer(&info))); r == 0 {
+		return 0, err
+	}
+	tick, _, _ := getTickCount.Call()
+	return time.Duration(uint32(tick)-info.dwTime) * time.Millisecond, nil
+}
@@ -0,0 +1,198 @@
+package kiwiagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gocraft/web"
+)
+
+//XxxxRoute are the routes served by the agent
+const (
+	SleepRoute    = "/sleep"
+	ShutdownRoute = "/shutdown"
+	LockRoute     = "/lock"
+	VolumeRoute   = "/volume/:direction"
+	LaunchRoute   = "/launch/:application"
+	RunningRoute  = "/running"
+	WakeRoute     = "/wake/:mac"
+	IdleRoute     = "/idle"
+)
+
+//MakeRoute fills in the single parameter of a route, eg MakeRoute(VolumeRoute, "up") is "/volume/up"
+func MakeRoute(route string, param string) string {
+	if i := strings.Index(route, ":"); i >= 0 {
+		return route[:i] + param
+	}
+	return route
+}
+
+//Response is the JSON body returned by every agent route
+type Response struct {
+	Message     string
+	Processes   []string
+	IdleSeconds int
+	Error       string
+}
+
+var (
+	config AgentConfig
+	guard  ReplayGuard
+)
+
+//Context is used in all requests to the agent
+type Context struct {
+	Body []byte
+}
+
+//StartAgent will start a kiwiagent listening for sleep-on-lan packets at the given udp address
+//and for kiwiland's requests at the given http address. Either address may be empty to turn that part off
+func StartAgent(serverAddress string, sleepOnLANAddress string) {
+	LoadConfig()
+
+	if serverAddress == "" {
+		ListenSleepOnLAN(sleepOnLANAddress)
+		return
+	}
+	if sleepOnLANAddress != "" {
+		go ListenSleepOnLAN(sleepOnLANAddress)
+	}
+
+	router := web.New(Context{})
+	router.Middleware(web.LoggerMiddleware)
+	router.Middleware((*Context).RequireSignatureMiddleware)
+
+	router.Post(SleepRoute, (*Context).PostSleepHandler)
+	router.Post(ShutdownRoute, (*Context).PostShutdownHandler)
+	router.Post(LockRoute, (*Context).PostLockHandler)
+	router.Post(VolumeRoute, (*Context).PostVolumeHandler)
+	router.Post(LaunchRoute, (*Context).PostLaunchHandler)
+	router.Get(RunningRoute, (*Context).GetRunningHandler)
+	router.Post(WakeRoute, (*Context).PostWakeHandler)
+	router.Get(IdleRoute, (*Context).GetIdleHandler)
+
+	log.Println("Agent running at " + serverAddress)
+	if err := http.ListenAndServe(serverAddress, router); err != nil {
+		log.Println("Error:", err.Error())
+	}
+}
+
+//writeResponse sends a Response as JSON, using the error (if any) to set the status code
+func writeResponse(rw web.ResponseWriter, resp Response, err error) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		resp.Error = err.Error()
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(rw).Encode(resp)
+}
+
+//RequireSignatureMiddleware refuses any request that isn't signed with the shared secret
+func (c *Context) RequireSignatureMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, 1<<20))
+	if err != nil {
+		http.Error(rw, "400: Could not read body", http.StatusBadRequest)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	c.Body = body
+
+	timestamp := req.Header.Get(TimestampHeader)
+	signature := req.Header.Get(SignatureHeader)
+	if err := VerifyRequest(config.Secret, req.Method, req.URL.Path, body, timestamp, signature); err != nil {
+		log.Printf("Refused request from %s: %s", req.RemoteAddr, err.Error())
+		http.Error(rw, "401: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := guard.Check(signature); err != nil {
+		log.Printf("Refused request from %s: %s", req.RemoteAddr, err.Error())
+		http.Error(rw, "401: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	next(rw, req)
+}
+
+//PostSleepHandler suspends the machine
+func (c *Context) PostSleepHandler(rw web.ResponseWriter, req *web.Request) {
+	//reply before suspending, otherwise kiwiland won't hear back until we wake up again
+	writeResponse(rw, Response{Message: "Going to sleep"}, nil)
+	rw.Flush()
+	go func() {
+		if err := Sleep(); err != nil {
+			log.Println("Sleep failed:", err.Error())
+		}
+	}()
+}
+
+//PostShutdownHandler powers the machine off
+func (c *Context) PostShutdownHandler(rw web.ResponseWriter, req *web.Request) {
+	writeResponse(rw, Response{Message: "Shutting down"}, nil)
+	rw.Flush()
+	go func() {
+		if err := Shutdown(); err != nil {
+			log.Println("Shutdown failed:", err.Error())
+		}
+	}()
+}
+
+//PostLockHandler locks the desktop session
+func (c *Context) PostLockHandler(rw web.ResponseWriter, req *web.Request) {
+	err := Lock()
+	writeResponse(rw, Response{Message: "Locked"}, err)
+}
+
+//PostVolumeHandler changes the volume. The direction is one of up, down or mute
+func (c *Context) PostVolumeHandler(rw web.ResponseWriter, req *web.Request) {
+	direction := req.PathParams["direction"]
+	switch direction {
+	case "up", "down", "mute":
+	default:
+		http.Error(rw, "400: Bad volume direction: "+direction, http.StatusBadRequest)
+		return
+	}
+
+	err := Volume(direction)
+	writeResponse(rw, Response{Message: "Volume " + direction}, err)
+}
+
+//PostLaunchHandler starts one of the applications listed in the agent config
+func (c *Context) PostLaunchHandler(rw web.ResponseWriter, req *web.Request) {
+	application := req.PathParams["application"]
+	command, ok := config.Applications[application]
+	if !ok || len(command) == 0 {
+		http.Error(rw, "404: Unknown application: "+application, http.StatusNotFound)
+		return
+	}
+
+	err := Launch(command)
+	writeResponse(rw, Response{Message: "Launched " + application}, err)
+}
+
+//GetRunningHandler lists the names of the running processes
+func (c *Context) GetRunningHandler(rw web.ResponseWriter, req *web.Request) {
+	processes, err := Running()
+	writeResponse(rw, Response{Processes: processes}, err)
+}
+
+//PostWakeHandler relays a wake-on-lan packet onto the agent's own network segment
+func (c *Context) PostWakeHandler(rw web.ResponseWriter, req *web.Request) {
+	mac := req.PathParams["mac"]
+	if _, err := net.ParseMAC(mac); err != nil {
+		http.Error(rw, "400: Bad MAC address: "+mac, http.StatusBadRequest)
+		return
+	}
+
+	err := SendMagicPacket(mac, DefaultWakeAddress)
+	writeResponse(rw, Response{Message: "Sent wake packet to " + mac}, err)
+}
+
+//GetIdleHandler says how long it has been since someone used the keyboard or mouse
+func (c *Context) GetIdleHandler(rw web.ResponseWriter, req *web.Request) {
+	idle, err := IdleTime()
+	writeResponse(rw, Response{IdleSeconds: int(idle.Seconds())}, err)
+}
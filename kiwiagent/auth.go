@@ -0,0 +1,101 @@
+package kiwiagent
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//TimestampHeader carries the unix time the request was signed at
+	TimestampHeader = "X-Kiwiagent-Timestamp"
+	//SignatureHeader carries the hex HMAC-SHA256 of the request
+	SignatureHeader = "X-Kiwiagent-Signature"
+
+	//MaxClockSkew is how far apart the signer's and verifier's clocks may be before a signature is refused
+	MaxClockSkew = 30 * time.Second
+)
+
+//GenerateSecret will generate a random shared secret suitable for pairing kiwiland with an agent
+func GenerateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+//Sign returns the hex HMAC-SHA256 of the given parts, separated by newlines, keyed with the shared secret
+func Sign(secret string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for i, p := range parts {
+		if i > 0 {
+			mac.Write([]byte("\n"))
+		}
+		mac.Write([]byte(p))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//SignRequest returns the timestamp and signature headers for a request to an agent
+func SignRequest(secret string, method string, path string, body []byte) (string, string) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	return timestamp, Sign(secret, method, path, timestamp, string(body))
+}
+
+//VerifyTimestamp returns an error if a signed unix timestamp is malformed or too far from now
+func VerifyTimestamp(timestamp string) error {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("Bad timestamp")
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > MaxClockSkew || skew < -MaxClockSkew {
+		return errors.New("Timestamp is too old or in the future")
+	}
+	return nil
+}
+
+//VerifyRequest returns an error if the timestamp and signature do not match the request
+func VerifyRequest(secret string, method string, path string, body []byte, timestamp string, signature string) error {
+	if err := VerifyTimestamp(timestamp); err != nil {
+		return err
+	}
+	expected := Sign(secret, method, path, timestamp, string(body))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("Bad signature")
+	}
+	return nil
+}
+
+//A ReplayGuard remembers recently seen signatures so that a captured request can't be sent again while its timestamp is still valid
+type ReplayGuard struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+//Check returns an error if the signature has been seen within the last MaxClockSkew*2, otherwise it records it
+func (g *ReplayGuard) Check(signature string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	if g.seen == nil {
+		g.seen = make(map[string]time.Time)
+	}
+	for sig, expires := range g.seen {
+		if expires.Before(now) {
+			delete(g.seen, sig)
+		}
+	}
+	if _, ok := g.seen[signature]; ok {
+		return errors.New("Replayed signature")
+	}
+	g.seen[signature] = now.Add(2 * MaxClockSkew)
+	return nil
+}
@@ -0,0 +1,98 @@
+package kiwiagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+//A Client talks to a kiwiagent on behalf of kiwiland
+type Client struct {
+	Address string //host:port of the agent
+	Secret  string
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+//Do sends a signed request to the agent and decodes its Response
+func (cl Client) Do(method string, path string) (Response, error) {
+	var resp Response
+	if cl.Address == "" {
+		return resp, errors.New("No agent is paired")
+	}
+
+	req, err := http.NewRequest(method, "http://"+cl.Address+path, bytes.NewReader(nil))
+	if err != nil {
+		return resp, err
+	}
+	timestamp, signature := SignRequest(cl.Secret, method, path, nil)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, signature)
+
+	hresp, err := httpClient.Do(req)
+	if err != nil {
+		return resp, err
+	}
+	defer hresp.Body.Close()
+
+	if hresp.Header.Get("Content-Type") != "application/json" {
+		return resp, errors.New("Agent said " + hresp.Status)
+	}
+	if err := json.NewDecoder(hresp.Body).Decode(&resp); err != nil {
+		return resp, err
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+//Sleep asks the agent to suspend its machine
+func (cl Client) Sleep() (string, error) {
+	resp, err := cl.Do("POST", SleepRoute)
+	return resp.Message, err
+}
+
+//Shutdown asks the agent to power its machine off
+func (cl Client) Shutdown() (string, error) {
+	resp, err := cl.Do("POST", ShutdownRoute)
+	return resp.Message, err
+}
+
+//Lock asks the agent to lock its desktop
+func (cl Client) Lock() (string, error) {
+	resp, err := cl.Do("POST", LockRoute)
+	return resp.Message, err
+}
+
+//Volume asks the agent to change its volume (up, down or mute)
+func (cl Client) Volume(direction string) (string, error) {
+	resp, err := cl.Do("POST", MakeRoute(VolumeRoute, direction))
+	return resp.Message, err
+}
+
+//Launch asks the agent to start one of its configured applications
+func (cl Client) Launch(application string) (string, error) {
+	resp, err := cl.Do("POST", MakeRoute(LaunchRoute, application))
+	return resp.Message, err
+}
+
+//Running asks the agent for its running process names
+func (cl Client) Running() ([]string, error) {
+	resp, err := cl.Do("GET", RunningRoute)
+	return resp.Processes, err
+}
+
+//Wake asks the agent (or a kiwiland) to send a wake-on-lan packet on its own network segment
+func (cl Client) Wake(mac string) (string, error) {
+	resp, err := cl.Do("POST", MakeRoute(WakeRoute, mac))
+	return resp.Message, err
+}
+
+//Idle asks the agent how long it has been since someone used its keyboard or mouse
+func (cl Client) Idle() (time.Duration, error) {
+	resp, err := cl.Do("GET", IdleRoute)
+	return time.Duration(resp.IdleSeconds) * time.Second, err
+}
@@ -0,0 +1,41 @@
+package kiwiagent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+)
+
+//AgentConfig is the agent's settings, kept in a json file next to the binary
+type AgentConfig struct {
+	//Secret is shared with kiwiland and used to sign every request
+	Secret string
+	//Applications maps names kiwiland may launch to the command line to run, eg "kodi": ["kodi", "--standalone"]
+	Applications map[string][]string
+}
+
+const (
+	configFile = "kiwiagent.json"
+)
+
+//LoadConfig will load the agent config from its json file
+//or make a new one with a fresh secret if none exists
+func LoadConfig() {
+	configBytes, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		secret, err := GenerateSecret()
+		if err != nil {
+			log.Fatalf("Could not generate a secret: %s", err.Error())
+		}
+		config = AgentConfig{Secret: secret, Applications: map[string][]string{}}
+		configBytes, _ = json.MarshalIndent(config, "", "\t")
+		ioutil.WriteFile(configFile, configBytes, 0600)
+		//the secret stays in the config file, which only its owner can read, rather than going into the log
+		log.Printf("No config file provided. Made %s; copy the Secret in it into kiwiland's config", configFile)
+		return
+	}
+	err = json.Unmarshal(configBytes, &config)
+	if err != nil || config.Secret == "" {
+		log.Fatalf("Config file is broken. Delete it and restart program.")
+	}
+}
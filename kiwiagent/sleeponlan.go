@@ -0,0 +1,81 @@
+package kiwiagent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"strings"
+)
+
+//sleepMagic starts every sleep-on-lan packet
+const sleepMagic = "KIWISLEEP"
+
+//makeSleepPacket builds a signed sleep-on-lan packet. It looks like this:
+//KIWISLEEP <unix timestamp> <random nonce> <hex hmac of magic, nonce and timestamp>
+func makeSleepPacket(secret string) ([]byte, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	nonce := hex.EncodeToString(b)
+	timestamp, signature := SignRequest(secret, sleepMagic, nonce, nil)
+	return []byte(strings.Join([]string{sleepMagic, timestamp, nonce, signature}, " ")), nil
+}
+
+//checkSleepPacket returns an error if a packet isn't a genuine, fresh sleep-on-lan packet
+func checkSleepPacket(secret string, packet []byte) error {
+	fields := strings.Fields(string(packet))
+	if len(fields) != 4 || fields[0] != sleepMagic {
+		return errors.New("Not a sleep packet")
+	}
+	if err := VerifyRequest(secret, sleepMagic, fields[2], nil, fields[1], fields[3]); err != nil {
+		return err
+	}
+	return guard.Check(fields[3])
+}
+
+//SendSleepPacket sends a signed sleep-on-lan packet to the given udp address
+//(which may be a broadcast address, in the same way as a wake-on-lan packet)
+func SendSleepPacket(address string, secret string) error {
+	packet, err := makeSleepPacket(secret)
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(packet)
+	return err
+}
+
+//ListenSleepOnLAN listens for sleep-on-lan packets at the given udp address and suspends the machine when a genuine one arrives
+func ListenSleepOnLAN(address string) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		log.Println("Error:", err.Error())
+		return
+	}
+	defer conn.Close()
+	log.Println("Listening for sleep-on-lan packets at " + address)
+
+	buf := make([]byte, 512)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Println("Error:", err.Error())
+			return
+		}
+		if err := checkSleepPacket(config.Secret, buf[:n]); err != nil {
+			log.Printf("Refused sleep packet from %s: %s", from.String(), err.Error())
+			continue
+		}
+		log.Printf("Sleep packet from %s, going to sleep", from.String())
+		if err := Sleep(); err != nil {
+			log.Println("Sleep failed:", err.Error())
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package kiwiagent
+
+import (
+	"bytes"
+	"net"
+)
+
+//DefaultWakeAddress is where wake-on-lan packets go unless told otherwise
+const DefaultWakeAddress = "255.255.255.255:9"
+
+//SendMagicPacket sends a wake-on-lan magic packet (6 bytes of 0xFF then the MAC 16 times) to the given udp address
+func SendMagicPacket(mac string, address string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	packet := append(bytes.Repeat([]byte{0xFF}, 6), bytes.Repeat(hw, 16)...)
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(packet)
+	return err
+}
@@ -0,0 +1,42 @@
+package kiwiapi
+
+import (
+	"net/url"
+	"strings"
+)
+
+//XxxxRoute are the API's routes. kiwiland's APIXxxxURLs and AdminXxxxURLs are made from them, and kiwictl calls them, so
+//the two can't drift apart
+const (
+	DevicesRoute        = "/api/v1/devices"
+	DeviceRoute         = "/api/v1/devices/:device"
+	DeviceWakeRoute     = "/api/v1/devices/:device/wake"
+	StateRoute          = "/api/v1/state"
+	TVCommandRoute      = "/api/v1/tv/:command"
+	TVKeyRoute          = "/api/v1/tv/key/:key"
+	ToshibaCommandRoute = "/api/v1/toshiba/:command"
+	ToshibaLaunchRoute  = "/api/v1/toshiba/launch/:application"
+	RestoreRoute        = "/api/v1/restore/:device"
+	ScenesRoute         = "/api/v1/scenes"
+	SceneRoute          = "/api/v1/scenes/:scene"
+	SceneRunRoute       = "/api/v1/scenes/:scene/run"
+
+	AdminUsersRoute        = "/api/v1/admin/users"
+	AdminUserPasswordRoute = "/api/v1/admin/users/:user/password"
+	AdminUserRemoveRoute   = "/api/v1/admin/users/:user/remove"
+	AdminReloadRoute       = "/api/v1/admin/reload"
+)
+
+//MakeRoute fills in the single parameter of a route, eg MakeRoute(SceneRunRoute, "movie") is "/api/v1/scenes/movie/run".
+//The parameter is escaped, so a name with a space or a slash in it stays one path segment
+func MakeRoute(route string, param string) string {
+	i := strings.Index(route, ":")
+	if i < 0 {
+		return route
+	}
+	rest := ""
+	if j := strings.Index(route[i:], "/"); j >= 0 {
+		rest = route[i+j:]
+	}
+	return route[:i] + url.PathEscape(param) + rest
+}
@@ -0,0 +1,24 @@
+package kiwiapi
+
+import "testing"
+
+func TestMakeRoute(t *testing.T) {
+	tests := []struct {
+		route string
+		param string
+		path  string
+	}{
+		{SceneRunRoute, "movie", "/api/v1/scenes/movie/run"},
+		{SceneRunRoute, "movie night", "/api/v1/scenes/movie%20night/run"},
+		{SceneRoute, "a/b", "/api/v1/scenes/a%2Fb"},
+		{DeviceWakeRoute, "../admin", "/api/v1/devices/..%2Fadmin/wake"},
+		{TVKeyRoute, "up", "/api/v1/tv/key/up"},
+		{AdminUserPasswordRoute, "bob?x=1", "/api/v1/admin/users/bob%3Fx=1/password"},
+		{DevicesRoute, "ignored", "/api/v1/devices"},
+	}
+	for _, test := range tests {
+		if got := MakeRoute(test.route, test.param); got != test.path {
+			t.Errorf("MakeRoute(%q, %q) is %q, want %q", test.route, test.param, got, test.path)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package kiwictl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kiwih/kiwiland/kiwiapi"
+)
+
+//A Client talks to kiwiland's JSON API, over the network with an API token or through its local socket
+type Client struct {
+	Server string //eg "http://kiwi.land" or "http://localhost:3000"
+	Token  string //an API token from the Settings page
+	Socket string //the path of kiwiland's unix socket. If set, Server and Token are not used
+
+	http *http.Client
+}
+
+//An APIError is an error the API answered with, eg {"Error": {"Status": 404, "Message": "Device not found"}}
+type APIError struct {
+	Status  int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+//A Result is what the API answers for an action. If the action ran but failed Error is set
+type Result struct {
+	Action string
+	Output string
+	Error  *APIError `json:",omitempty"`
+}
+
+//A Device is a device and everything the API can do to it
+type Device struct {
+	Name    string
+	MAC     string `json:",omitempty"`
+	IP      string `json:",omitempty"`
+	State   map[string]string
+	Actions []string
+}
+
+//A Scene is a named list of actions
+type Scene struct {
+	Name  string
+	Steps []json.RawMessage
+}
+
+//A StepResult is what happened when one step of a scene ran
+type StepResult struct {
+	Step     struct{ Action string }
+	Output   string
+	Error    string
+	Duration time.Duration
+	Skipped  bool
+}
+
+//A SceneRun is the progress and outcome of running a scene
+type SceneRun struct {
+	Scene    string
+	Started  time.Time
+	Finished time.Time
+	Running  bool
+	Steps    []StepResult
+	Error    string
+}
+
+//client makes the http.Client, which dials the socket rather than the network if there is one
+func (cl *Client) client() *http.Client {
+	if cl.http != nil {
+		return cl.http
+	}
+	cl.http = &http.Client{Timeout: 30 * time.Second}
+	if cl.Socket != "" {
+		cl.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", cl.Socket)
+			},
+		}
+	}
+	return cl.http
+}
+
+//Do sends a request to the API, with form as its body if it isn't nil, and returns the body of its answer, which is
+//JSON. An answer with an error status is returned as an *APIError along with the body, since an action that ran but
+//failed still says what happened
+func (cl *Client) Do(method string, path string, form url.Values) ([]byte, error) {
+	address := strings.TrimSuffix(cl.Server, "/") + path
+	if cl.Socket != "" {
+		address = "http://kiwiland" + path
+	}
+	req, err := http.NewRequest(method, address, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("Accept", "application/json")
+	if cl.Token != "" && cl.Socket == "" {
+		req.Header.Set("Authorization", "Bearer "+cl.Token)
+	}
+
+	resp, err := cl.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return nil, errors.New("kiwiland said " + resp.Status + ", is that the right address?")
+	}
+	if resp.StatusCode >= 300 {
+		var answer struct{ Error *APIError }
+		if err := json.Unmarshal(body, &answer); err == nil && answer.Error != nil {
+			return body, answer.Error
+		}
+		return body, errors.New("kiwiland said " + resp.Status)
+	}
+	return body, nil
+}
+
+//get fetches path and decodes it into v
+func (cl *Client) get(path string, v interface{}) ([]byte, error) {
+	body, err := cl.Do("GET", path, nil)
+	if err != nil {
+		return body, err
+	}
+	return body, json.Unmarshal(body, v)
+}
+
+//Action runs an action, eg "tv/poweron", through its API path, eg "/api/v1/tv/poweron"
+func (cl *Client) Action(path string) (Result, []byte, error) {
+	var result Result
+	body, err := cl.Do("POST", path, nil)
+	if body != nil {
+		json.Unmarshal(body, &result)
+	}
+	return result, body, err
+}
+
+//Devices lists the TV, the toshiba and the devicelist
+func (cl *Client) Devices() ([]Device, []byte, error) {
+	var list []Device
+	body, err := cl.get(kiwiapi.DevicesRoute, &list)
+	return list, body, err
+}
+
+//Device gets one device
+func (cl *Client) Device(name string) (Device, []byte, error) {
+	var d Device
+	body, err := cl.get(kiwiapi.MakeRoute(kiwiapi.DeviceRoute, name), &d)
+	return d, body, err
+}
+
+//State gets everything kiwiland knows, by device then key, eg {"tv": {"power": "on"}}
+func (cl *Client) State() (map[string]map[string]string, []byte, error) {
+	var state map[string]map[string]string
+	body, err := cl.get(kiwiapi.StateRoute, &state)
+	return state, body, err
+}
+
+//Scenes lists the scenes
+func (cl *Client) Scenes() ([]Scene, []byte, error) {
+	var list []Scene
+	body, err := cl.get(kiwiapi.ScenesRoute, &list)
+	return list, body, err
+}
+
+//Scene gets the latest run of a scene
+func (cl *Client) Scene(name string) (SceneRun, []byte, error) {
+	var run SceneRun
+	body, err := cl.get(kiwiapi.MakeRoute(kiwiapi.SceneRoute, name), &run)
+	return run, body, err
+}
+
+//RunScene starts a scene, which keeps running on the server after this returns
+func (cl *Client) RunScene(name string) (SceneRun, []byte, error) {
+	var run SceneRun
+	body, err := cl.Do("POST", kiwiapi.MakeRoute(kiwiapi.SceneRunRoute, name), nil)
+	if err != nil {
+		return run, body, err
+	}
+	return run, body, json.Unmarshal(body, &run)
+}
+
+//A User is a user of the website, as the admin socket shows them
+type User struct {
+	Username string
+	SignedIn bool
+	Tokens   int
+}
+
+//Users lists the users. It only works through the admin socket
+func (cl *Client) Users() ([]User, []byte, error) {
+	var list []User
+	body, err := cl.get(kiwiapi.AdminUsersRoute, &list)
+	return list, body, err
+}
+
+//AddUser adds a user. It only works through the admin socket
+func (cl *Client) AddUser(username string, password string) ([]byte, error) {
+	return cl.Do("POST", kiwiapi.AdminUsersRoute, url.Values{"Username": {username}, "Password": {password}})
+}
+
+//SetPassword changes a user's password, signing them out. It only works through the admin socket
+func (cl *Client) SetPassword(username string, password string) ([]byte, error) {
+	return cl.Do("POST", kiwiapi.MakeRoute(kiwiapi.AdminUserPasswordRoute, username), url.Values{"Password": {password}})
+}
+
+//RemoveUser deletes a user. It only works through the admin socket
+func (cl *Client) RemoveUser(username string) ([]byte, error) {
+	return cl.Do("POST", kiwiapi.MakeRoute(kiwiapi.AdminUserRemoveRoute, username), nil)
+}
+
+//Reload asks kiwiland to read its config.json again. It only works through the admin socket
+func (cl *Client) Reload() (Result, []byte, error) {
+	return cl.Action(kiwiapi.AdminReloadRoute)
+}
@@ -0,0 +1,533 @@
+package kiwictl
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kiwih/kiwiland/kiwiapi"
+	"golang.org/x/term"
+)
+
+//usage is printed before the flags for -h or a bad command
+const usage = `usage: kiwictl [flags] <command>
+
+commands:
+  tv on | off | status
+  tv input <input>              eg hdmi1, or toshiba for hdmi4
+  tv volume up | down
+  tv key <key>                  press a remote button, eg up, select or back
+  tv <command>                  any tv command, eg powerstatus
+  toshiba <command>             eg sleep, lock, running
+  toshiba launch <application>
+  wake <device> [-wait]         wake a device, and with -wait wait until it answers pings
+  restore <device>              put a device back how it was before the last change
+  scene list
+  scene run <scene> [-wait]     start a scene, and with -wait wait until it finishes
+  scene show <scene>            the scene's latest run
+  devices
+  state
+
+commands for the admin socket (-socket):
+  users
+  user add <username>           asks for the new user's password, or reads it from stdin
+  user password <username>      asks for the new password, or reads it from stdin
+  user remove <username>
+  reload                        read config.json again
+
+flags (which can go anywhere):
+`
+
+//pollEvery is how often -wait asks kiwiland how things are going
+const pollEvery = 2 * time.Second
+
+//tvCommands are the friendlier names for some tv commands
+var tvCommands = map[string]string{
+	"on":     "poweron",
+	"off":    "poweroff",
+	"status": "powerstatus",
+}
+
+//tvInputs are the names of the TV's inputs, besides their commands like hdmi1
+var tvInputs = map[string]string{
+	"toshiba": "hdmi4",
+}
+
+//errUsage is returned for commands kiwictl doesn't understand; the usage has already been printed
+var errUsage = errors.New("usage")
+
+//ctl runs one command
+type ctl struct {
+	client  *Client
+	json    bool
+	verbose bool
+	wait    bool
+	timeout time.Duration
+	in      io.Reader
+	out     io.Writer
+	errOut  io.Writer
+	flags   *flag.FlagSet
+}
+
+//Main runs kiwictl with the given arguments (without the program name) and returns its exit code: 0 if everything
+//worked, 1 if something failed and 2 if the command was wrong. Passwords are read from in
+func Main(args []string, in io.Reader, out io.Writer, errOut io.Writer) int {
+	c := &ctl{client: &Client{}, in: in, out: out, errOut: errOut}
+
+	server := os.Getenv("KIWILAND_URL")
+	if server == "" {
+		server = "http://localhost:3000"
+	}
+	c.flags = flag.NewFlagSet("kiwictl", flag.ContinueOnError)
+	c.flags.SetOutput(errOut)
+	c.flags.Usage = func() {
+		fmt.Fprint(errOut, usage)
+		c.flags.PrintDefaults()
+	}
+	c.flags.StringVar(&c.client.Server, "server", server, "kiwiland's address (or set $KIWILAND_URL)")
+	c.flags.StringVar(&c.client.Token, "token", "", "an API token from the Settings page (better set as $KIWILAND_TOKEN)")
+	c.flags.StringVar(&c.client.Socket, "socket", os.Getenv("KIWILAND_SOCKET"), "talk to kiwiland through its unix socket instead (or set $KIWILAND_SOCKET)")
+	c.flags.BoolVar(&c.json, "json", false, "print kiwiland's JSON answer instead")
+	c.flags.BoolVar(&c.verbose, "v", false, "print what the devices answered")
+	c.flags.BoolVar(&c.wait, "wait", false, "for wake and scene run, wait until it's done")
+	c.flags.DurationVar(&c.timeout, "timeout", 3*time.Minute, "how long -wait waits")
+
+	//flags are allowed after the command too, eg "kiwictl wake toshiba -wait"
+	var words []string
+	for {
+		if err := c.flags.Parse(args); err != nil {
+			if err == flag.ErrHelp {
+				return 0
+			}
+			return 2
+		}
+		if c.flags.NArg() == 0 {
+			break
+		}
+		words = append(words, c.flags.Arg(0))
+		args = c.flags.Args()[1:]
+	}
+
+	//the token isn't the flag's default so that usage doesn't print it
+	if c.client.Token == "" {
+		c.client.Token = os.Getenv("KIWILAND_TOKEN")
+	}
+
+	err := c.run(words)
+	if err == errUsage {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(errOut, "kiwictl: "+err.Error())
+		return 1
+	}
+	return 0
+}
+
+//run picks the command to run
+func (c *ctl) run(words []string) error {
+	if len(words) == 0 {
+		return c.usage()
+	}
+	switch words[0] {
+	case "tv":
+		return c.tv(words[1:])
+	case "toshiba":
+		return c.toshiba(words[1:])
+	case "wake":
+		if len(words) != 2 {
+			return c.usage()
+		}
+		return c.wake(words[1])
+	case "restore":
+		if len(words) != 2 {
+			return c.usage()
+		}
+		return c.action(kiwiapi.MakeRoute(kiwiapi.RestoreRoute, words[1]))
+	case "scene", "scenes":
+		return c.scene(words[1:])
+	case "devices":
+		if len(words) != 1 {
+			return c.usage()
+		}
+		return c.devices()
+	case "state":
+		if len(words) != 1 {
+			return c.usage()
+		}
+		return c.state()
+	case "users":
+		if len(words) != 1 {
+			return c.usage()
+		}
+		return c.users()
+	case "user":
+		return c.user(words[1:])
+	case "reload":
+		if len(words) != 1 {
+			return c.usage()
+		}
+		return c.action(kiwiapi.AdminReloadRoute)
+	}
+	return c.usage()
+}
+
+//usage prints how to use kiwictl and returns errUsage
+func (c *ctl) usage() error {
+	c.flags.Usage()
+	return errUsage
+}
+
+//tv runs a tv command, eg "on" or "input toshiba"
+func (c *ctl) tv(words []string) error {
+	var command string
+	switch {
+	case len(words) == 2 && words[0] == "key":
+		return c.action(kiwiapi.MakeRoute(kiwiapi.TVKeyRoute, words[1]))
+	case len(words) == 2 && words[0] == "input":
+		command = words[1]
+		if input, ok := tvInputs[command]; ok {
+			command = input
+		}
+		if !strings.HasPrefix(command, "hdmi") {
+			return errors.New("Unknown input " + words[1] + ", try eg hdmi1 or toshiba")
+		}
+	case len(words) == 2 && words[0] == "volume" && (words[1] == "up" || words[1] == "down"):
+		command = "volume" + words[1]
+	case len(words) == 1:
+		command = words[0]
+		if name, ok := tvCommands[command]; ok {
+			command = name
+		}
+	default:
+		return c.usage()
+	}
+
+	if command != "powerstatus" || c.json {
+		return c.action(kiwiapi.MakeRoute(kiwiapi.TVCommandRoute, command))
+	}
+	//for status, say what the TV answered rather than that asking worked
+	if _, _, err := c.client.Action(kiwiapi.MakeRoute(kiwiapi.TVCommandRoute, command)); err != nil {
+		return err
+	}
+	d, _, err := c.client.Device("tv")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, describeState(d.State))
+	return nil
+}
+
+//toshiba runs a toshiba command, eg "sleep" or "launch kodi"
+func (c *ctl) toshiba(words []string) error {
+	switch {
+	case len(words) == 2 && words[0] == "launch":
+		return c.action(kiwiapi.MakeRoute(kiwiapi.ToshibaLaunchRoute, words[1]))
+	case len(words) == 1:
+		if words[0] == "running" {
+			c.verbose = true
+		}
+		return c.action(kiwiapi.MakeRoute(kiwiapi.ToshibaCommandRoute, words[0]))
+	}
+	return c.usage()
+}
+
+//writeJSON prints kiwiland's answer as it was, for -json, and says whether it did
+func (c *ctl) writeJSON(body []byte) bool {
+	if !c.json || body == nil {
+		return false
+	}
+	c.out.Write(body)
+	return true
+}
+
+//action runs an action and says how it went
+func (c *ctl) action(path string) error {
+	result, body, err := c.client.Action(path)
+	if c.writeJSON(body) {
+		return err
+	}
+	output := strings.TrimSpace(result.Output)
+	if err != nil {
+		if output != "" {
+			fmt.Fprintln(c.errOut, output)
+		}
+		if result.Action != "" {
+			return errors.New(result.Action + " failed: " + err.Error())
+		}
+		return err
+	}
+	fmt.Fprintln(c.out, result.Action+": ok")
+	if c.verbose && output != "" {
+		fmt.Fprintln(c.out, output)
+	}
+	return nil
+}
+
+//wake wakes a device and, with -wait, waits for kiwiland to see it online
+func (c *ctl) wake(device string) error {
+	//the toshiba has its own wake-on-lan, which uses the devicelist's settings if it is listed there
+	path := kiwiapi.MakeRoute(kiwiapi.DeviceWakeRoute, device)
+	if device == "toshiba" {
+		path = kiwiapi.MakeRoute(kiwiapi.ToshibaCommandRoute, "wol")
+	}
+	if !c.wait {
+		return c.action(path)
+	}
+
+	//kiwiland only pings devices with an IP, so without one it would never see this one online
+	d, _, err := c.client.Device(device)
+	if err != nil {
+		return err
+	}
+	if d.IP == "" {
+		return errors.New(device + " has no IP in kiwiland's devices, so -wait can't tell when it is online")
+	}
+
+	result, body, err := c.client.Action(path)
+	if err != nil {
+		c.writeJSON(body)
+		return err
+	}
+	if !c.json {
+		fmt.Fprintln(c.out, result.Action+": ok, waiting for "+device+" to answer pings")
+	}
+	start := time.Now()
+	for {
+		d, body, err := c.client.Device(device)
+		if err != nil {
+			return err
+		}
+		if d.State["online"] == "online" {
+			if !c.writeJSON(body) {
+				fmt.Fprintf(c.out, "%s: online after %s\n", device, time.Since(start).Round(time.Second))
+			}
+			return nil
+		}
+		if time.Since(start) > c.timeout {
+			return fmt.Errorf("%s did not come online within %s", device, c.timeout)
+		}
+		time.Sleep(pollEvery)
+	}
+}
+
+//scene lists, runs or shows scenes
+func (c *ctl) scene(words []string) error {
+	switch {
+	case len(words) == 1 && words[0] == "list":
+		list, body, err := c.client.Scenes()
+		if c.writeJSON(body) || err != nil {
+			return err
+		}
+		for _, s := range list {
+			fmt.Fprintf(c.out, "%s\t%d steps\n", s.Name, len(s.Steps))
+		}
+		return nil
+	case len(words) == 2 && words[0] == "show":
+		run, body, err := c.client.Scene(words[1])
+		if c.writeJSON(body) || err != nil {
+			return err
+		}
+		c.printRun(run, 0)
+		return runError(run)
+	case len(words) == 2 && words[0] == "run":
+		return c.runScene(words[1])
+	}
+	return c.usage()
+}
+
+//runScene starts a scene and, with -wait, follows it until it finishes
+func (c *ctl) runScene(name string) error {
+	run, body, err := c.client.RunScene(name)
+	if err != nil {
+		c.writeJSON(body)
+		return err
+	}
+	if !c.wait {
+		if !c.writeJSON(body) {
+			fmt.Fprintln(c.out, name+": started")
+		}
+		return nil
+	}
+
+	start := time.Now()
+	printed := 0
+	for run.Running {
+		if time.Since(start) > c.timeout {
+			return fmt.Errorf("%s is still running after %s", name, c.timeout)
+		}
+		time.Sleep(pollEvery)
+		if run, body, err = c.client.Scene(name); err != nil {
+			c.writeJSON(body)
+			return err
+		}
+		if !c.json {
+			printed = c.printSteps(run, printed)
+		}
+	}
+	if !c.writeJSON(body) {
+		c.printRun(run, printed)
+	}
+	return runError(run)
+}
+
+//printRun prints a scene run's steps after the first printed, and how it ended
+func (c *ctl) printRun(run SceneRun, printed int) {
+	c.printSteps(run, printed)
+	switch {
+	case run.Running:
+		fmt.Fprintln(c.out, run.Scene+": running")
+	case run.Started.IsZero():
+		fmt.Fprintln(c.out, run.Scene+": never run")
+	case run.Error == "":
+		fmt.Fprintf(c.out, "%s: ok, took %s\n", run.Scene, run.Finished.Sub(run.Started).Round(time.Second))
+	}
+}
+
+//printSteps prints a scene run's steps after the first printed, returning how many have been printed now
+func (c *ctl) printSteps(run SceneRun, printed int) int {
+	for i := printed; i < len(run.Steps); i++ {
+		step := run.Steps[i]
+		status := "ok"
+		switch {
+		case step.Skipped:
+			status = "skipped"
+		case step.Error != "":
+			status = step.Error
+		}
+		fmt.Fprintf(c.out, "  %d. %s: %s (%s)\n", i+1, step.Step.Action, status, step.Duration.Round(100*time.Millisecond))
+	}
+	return len(run.Steps)
+}
+
+//runError is the error a finished scene run ended with, if any
+func runError(run SceneRun) error {
+	if !run.Running && run.Error != "" {
+		return errors.New(run.Scene + ": " + run.Error)
+	}
+	return nil
+}
+
+//devices lists the devices and what kiwiland knows about them
+func (c *ctl) devices() error {
+	list, body, err := c.client.Devices()
+	if c.writeJSON(body) || err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	for _, d := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", d.Name, d.IP, describeState(d.State))
+	}
+	return w.Flush()
+}
+
+//state prints everything kiwiland knows, one device per line
+func (c *ctl) state() error {
+	state, body, err := c.client.State()
+	if c.writeJSON(body) || err != nil {
+		return err
+	}
+	var names []string
+	for name := range state {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\n", name, describeState(state[name]))
+	}
+	return w.Flush()
+}
+
+//describeState puts a device's state on one line, eg "input=hdmi4 power=on"
+func describeState(state map[string]string) string {
+	if len(state) == 0 {
+		return "unknown"
+	}
+	var parts []string
+	for key, value := range state {
+		parts = append(parts, key+"="+value)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+//users lists the users of the website
+func (c *ctl) users() error {
+	list, body, err := c.client.Users()
+	if c.writeJSON(body) || err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	for _, u := range list {
+		signedIn := ""
+		if u.SignedIn {
+			signedIn = "signed in"
+		}
+		fmt.Fprintf(w, "%s\t%d tokens\t%s\n", u.Username, u.Tokens, signedIn)
+	}
+	return w.Flush()
+}
+
+//user adds or removes a user, or changes their password
+func (c *ctl) user(words []string) error {
+	if len(words) != 2 {
+		return c.usage()
+	}
+	username := words[1]
+	var body []byte
+	var err error
+	done := map[string]string{"add": "added ", "password": "changed the password of ", "remove": "removed "}[words[0]]
+	switch words[0] {
+	case "add", "password":
+		password, perr := c.password(username)
+		if perr != nil {
+			return perr
+		}
+		if words[0] == "add" {
+			body, err = c.client.AddUser(username, password)
+		} else {
+			body, err = c.client.SetPassword(username, password)
+		}
+	case "remove":
+		body, err = c.client.RemoveUser(username)
+	default:
+		return c.usage()
+	}
+	if c.writeJSON(body) || err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, done+username)
+	return nil
+}
+
+//password reads a password from stdin. Typed at a terminal it isn't echoed; piped in, it is the first line
+func (c *ctl) password(username string) (string, error) {
+	var password string
+	if f, ok := c.in.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(c.errOut, "Password for "+username+": ")
+		typed, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(c.errOut)
+		if err != nil {
+			return "", err
+		}
+		password = string(typed)
+	} else {
+		line, err := bufio.NewReader(c.in).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if password == "" {
+		return "", errors.New("No password given")
+	}
+	return password, nil
+}
@@ -0,0 +1,176 @@
+package kiwictl
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//A fakeKiwiland answers the API like kiwiland does, recording the requests it gets
+type fakeKiwiland struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []string //eg "POST /api/v1/tv/poweron"
+	auth     string
+	form     map[string]string
+}
+
+//newFakeKiwiland starts a fakeKiwiland. Actions work, except for "nope" which isn't known, and devices are nas, without
+//an IP, and pi, with one
+func newFakeKiwiland(t *testing.T) *fakeKiwiland {
+	k := &fakeKiwiland{}
+	k.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		k.mu.Lock()
+		k.requests = append(k.requests, req.Method+" "+req.URL.EscapedPath())
+		k.auth = req.Header.Get("Authorization")
+		k.form = make(map[string]string)
+		for key := range req.PostForm {
+			k.form[key] = req.PostForm.Get(key)
+		}
+		k.mu.Unlock()
+
+		rw.Header().Set("Content-Type", "application/json")
+		action := strings.TrimPrefix(req.URL.Path, "/api/v1/")
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/nope"):
+			rw.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(rw).Encode(map[string]interface{}{"Error": map[string]interface{}{"Status": 404, "Message": "Bad tv command: nope"}})
+		case req.Method == "GET" && req.URL.Path == "/api/v1/devices/nas":
+			json.NewEncoder(rw).Encode(Device{Name: "nas", State: map[string]string{}})
+		case req.Method == "GET" && req.URL.Path == "/api/v1/devices/pi":
+			json.NewEncoder(rw).Encode(Device{Name: "pi", IP: "192.168.2.20", State: map[string]string{"online": "online"}})
+		case req.URL.Path == "/api/v1/admin/users":
+			json.NewEncoder(rw).Encode([]User{})
+		default:
+			json.NewEncoder(rw).Encode(Result{Action: action, Output: "done"})
+		}
+	}))
+	t.Cleanup(k.Close)
+	t.Setenv("KIWILAND_URL", k.URL)
+	t.Setenv("KIWILAND_TOKEN", "")
+	t.Setenv("KIWILAND_SOCKET", "")
+	return k
+}
+
+//run runs kiwictl, returning its exit code, what it printed, and the requests kiwiland got
+func (k *fakeKiwiland) run(in string, args ...string) (int, string, []string) {
+	k.mu.Lock()
+	k.requests = nil
+	k.mu.Unlock()
+	var out, errOut bytes.Buffer
+	code := Main(args, strings.NewReader(in), &out, &errOut)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return code, out.String() + errOut.String(), k.requests
+}
+
+func TestCommands(t *testing.T) {
+	k := newFakeKiwiland(t)
+	tests := []struct {
+		args     []string
+		code     int
+		requests []string
+	}{
+		{[]string{"tv", "on"}, 0, []string{"POST /api/v1/tv/poweron"}},
+		{[]string{"tv", "input", "toshiba"}, 0, []string{"POST /api/v1/tv/hdmi4"}},
+		{[]string{"tv", "input", "hdmi2"}, 0, []string{"POST /api/v1/tv/hdmi2"}},
+		{[]string{"tv", "volume", "down"}, 0, []string{"POST /api/v1/tv/volumedown"}},
+		{[]string{"tv", "key", "select"}, 0, []string{"POST /api/v1/tv/key/select"}},
+		{[]string{"tv", "nope"}, 1, []string{"POST /api/v1/tv/nope"}},
+		{[]string{"toshiba", "launch", "kodi"}, 0, []string{"POST /api/v1/toshiba/launch/kodi"}},
+		{[]string{"wake", "toshiba"}, 0, []string{"POST /api/v1/toshiba/wol"}},
+		{[]string{"wake", "nas"}, 0, []string{"POST /api/v1/devices/nas/wake"}},
+		{[]string{"restore", "tv"}, 0, []string{"POST /api/v1/restore/tv"}},
+		{[]string{"reload"}, 0, []string{"POST /api/v1/admin/reload"}},
+		{[]string{"user", "remove", "bob"}, 0, []string{"POST /api/v1/admin/users/bob/remove"}},
+
+		//flags can go before or after the command
+		{[]string{"-v", "restore", "tv"}, 0, []string{"POST /api/v1/restore/tv"}},
+		{[]string{"restore", "tv", "-v"}, 0, []string{"POST /api/v1/restore/tv"}},
+
+		//names are escaped, so they stay one path segment
+		{[]string{"scene", "run", "movie night"}, 0, []string{"POST /api/v1/scenes/movie%20night/run"}},
+		{[]string{"wake", "a/b"}, 0, []string{"POST /api/v1/devices/a%2Fb/wake"}},
+
+		//commands kiwictl doesn't understand don't reach kiwiland
+		{[]string{}, 2, nil},
+		{[]string{"frobnicate"}, 2, nil},
+		{[]string{"tv", "volume", "sideways"}, 2, nil},
+		{[]string{"wake"}, 2, nil},
+		{[]string{"tv", "input", "vga"}, 1, nil},
+		{[]string{"-nosuchflag", "tv", "on"}, 2, nil},
+	}
+	for _, test := range tests {
+		code, printed, requests := k.run("", test.args...)
+		if code != test.code || strings.Join(requests, ", ") != strings.Join(test.requests, ", ") {
+			t.Errorf("%q exited %d after %v, want %d after %v\n%s", test.args, code, requests, test.code, test.requests, printed)
+		}
+	}
+}
+
+func TestCommandOutput(t *testing.T) {
+	k := newFakeKiwiland(t)
+	if _, printed, _ := k.run("", "tv", "on"); printed != "tv/poweron: ok\n" {
+		t.Errorf("tv on printed %q", printed)
+	}
+
+	//-json prints kiwiland's answer as it was
+	code, printed, _ := k.run("", "-json", "tv", "on")
+	var result Result
+	if err := json.Unmarshal([]byte(printed), &result); code != 0 || err != nil || result.Action != "tv/poweron" || result.Output != "done" {
+		t.Errorf("tv on -json exited %d and printed %q", code, printed)
+	}
+	code, printed, _ = k.run("", "tv", "nope", "-json")
+	if code != 1 || !strings.HasPrefix(printed, `{"Error":{"Message":"Bad tv command: nope","Status":404}}`) {
+		t.Errorf("a failed action with -json exited %d and printed %q", code, printed)
+	}
+}
+
+func TestToken(t *testing.T) {
+	k := newFakeKiwiland(t)
+	t.Setenv("KIWILAND_TOKEN", "kiwi_fromenv")
+	k.run("", "tv", "on")
+	if k.auth != "Bearer kiwi_fromenv" {
+		t.Errorf("sent %q with the token in the environment", k.auth)
+	}
+	k.run("", "-token", "kiwi_fromflag", "tv", "on")
+	if k.auth != "Bearer kiwi_fromflag" {
+		t.Errorf("sent %q with the token as a flag", k.auth)
+	}
+}
+
+func TestWakeWait(t *testing.T) {
+	k := newFakeKiwiland(t)
+
+	//kiwiland can't see a device without an IP come online, so there's no point waiting
+	code, printed, requests := k.run("", "wake", "nas", "-wait")
+	if code != 1 || strings.Join(requests, ", ") != "GET /api/v1/devices/nas" || !strings.Contains(printed, "no IP") {
+		t.Errorf("wake -wait for a device without an IP exited %d after %v: %q", code, requests, printed)
+	}
+
+	code, printed, requests = k.run("", "wake", "pi", "-wait")
+	if code != 0 || len(requests) != 3 || requests[1] != "POST /api/v1/devices/pi/wake" || !strings.Contains(printed, "pi: online") {
+		t.Errorf("wake -wait for a device with an IP exited %d after %v: %q", code, requests, printed)
+	}
+}
+
+func TestUserPassword(t *testing.T) {
+	k := newFakeKiwiland(t)
+	code, printed, requests := k.run("hunter2\n", "user", "add", "bob")
+	if code != 0 || strings.Join(requests, ", ") != "POST /api/v1/admin/users" || k.form["Username"] != "bob" || k.form["Password"] != "hunter2" {
+		t.Errorf("user add exited %d after %v with %v: %q", code, requests, k.form, printed)
+	}
+	if strings.Contains(printed, "hunter2") {
+		t.Errorf("user add printed the password: %q", printed)
+	}
+
+	if code, _, requests := k.run("", "user", "password", "bob"); code != 1 || requests != nil {
+		t.Errorf("user password without a password exited %d after %v", code, requests)
+	}
+}
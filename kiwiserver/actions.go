@@ -0,0 +1,168 @@
+package kiwiserver
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+//A Command is anything kiwiland can do which reports back with some output
+type Command func() (string, error)
+
+//TVCommands are the commands that can be sent to the TV, by name
+var TVCommands = map[string]Command{
+	"powerstatus": TVGetStatus,
+	"poweron":     TVTurnOn,
+	"poweroff":    TVTurnOff,
+	"hdmi4":       TVSelectHDMI4,
+	"hdmi2":       TVSelectHDMI2,
+	"hdmi1":       TVSelectHDMI1,
+	"volumeup":    TVVolumeUp,
+	"volumedown":  TVVolumeDown,
+}
+
+//ToshibaCommands are the commands that can be sent to the toshiba laptop, by name
+var ToshibaCommands = map[string]Command{
+	"wol":        ToshibaWOL,
+	"sleeponlan": ToshibaSleepOnLAN,
+	"sleep":      ToshibaSleep,
+	"shutdown":   ToshibaShutdown,
+	"lock":       ToshibaLock,
+	"volumeup":   ToshibaVolumeUp,
+	"volumedown": ToshibaVolumeDown,
+	"mute":       ToshibaMute,
+	"running":    ToshibaRunning,
+}
+
+//ErrUnknownAction is returned by RunAction for actions it doesn't recognise
+var ErrUnknownAction = errors.New("Unknown action")
+
+//lookupAction finds the Command for an action named the same way as the URL that performs it from the home page, without the leading slash.
+//For example "tv/poweron", "tv/key/up", "toshiba/wol", "toshiba/launch/kodi", "devices/nas/wake", "scenes/movie/run", "states/movie/apply" or "restore/tv"
+func lookupAction(action string) (Command, error) {
+	parts := strings.Split(action, "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "tv":
+		if command, ok := TVCommands[parts[1]]; ok {
+			return command, nil
+		}
+	case len(parts) == 3 && parts[0] == "tv" && parts[1] == "key":
+		if _, ok := TVRemoteKeys[parts[2]]; ok {
+			return func() (string, error) { return TVRemoteKey(parts[2]) }, nil
+		}
+	case len(parts) == 2 && parts[0] == "toshiba":
+		if command, ok := ToshibaCommands[parts[1]]; ok {
+			return command, nil
+		}
+	case len(parts) == 3 && parts[0] == "toshiba" && parts[1] == "launch":
+		for _, application := range AgentApplications() {
+			if application == parts[2] {
+				return func() (string, error) { return ToshibaLaunch(parts[2]) }, nil
+			}
+		}
+		return nil, errors.New("Unknown application: " + parts[2])
+	case len(parts) == 3 && parts[0] == "devices" && parts[2] == "wake":
+		if _, err := devices.LoadDevice(parts[1]); err != nil {
+			return nil, err
+		}
+		return func() (string, error) { return WakeDevice(parts[1]) }, nil
+	case len(parts) == 3 && parts[0] == "scenes" && parts[2] == "run":
+		if _, err := LoadScene(parts[1]); err != nil {
+			return nil, err
+		}
+		return func() (string, error) {
+			run, err := RunScene(parts[1])
+			return run.Summary(), err
+		}, nil
+	case len(parts) == 2 && parts[0] == "restore":
+		if parts[1] != "tv" && parts[1] != "toshiba" {
+			if _, err := devices.LoadDevice(parts[1]); err != nil {
+				return nil, err
+			}
+		}
+		return func() (string, error) { return RestoreDevice(parts[1]) }, nil
+	case len(parts) == 3 && parts[0] == "states" && parts[2] == "apply":
+		if _, err := LoadDesiredState(parts[1]); err != nil {
+			return nil, err
+		}
+		return func() (string, error) {
+			r, err := ApplyDesiredState(parts[1])
+			return r.Summary(), err
+		}, nil
+	}
+	return nil, ErrUnknownAction
+}
+
+//CheckAction returns an error if RunAction wouldn't recognise an action
+func CheckAction(action string) error {
+	_, err := lookupAction(action)
+	return err
+}
+
+//RunAction runs an action, see lookupAction for how they are named, and publishes an action event for it.
+//The state it is about to change is snapshotted so that it can be restored
+func RunAction(action string) (string, error) {
+	return runAction(action, true)
+}
+
+//runAction runs an action, snapshotting first if asked. Restoring doesn't snapshot, so it doesn't add to the stack it is undoing
+func runAction(action string, snapshot bool) (string, error) {
+	command, err := lookupAction(action)
+	if err != nil {
+		return "", err
+	}
+	Publish(Event{Type: EventAction, Device: "kiwiland", Value: action})
+	keepSnapshot := func() {}
+	if snapshot {
+		keepSnapshot = takeSnapshot(action)
+	}
+	start := time.Now()
+	output, err := command()
+	countAction(action, err, time.Since(start))
+	if err == nil {
+		keepSnapshot()
+	}
+	return output, err
+}
+
+//AllActions lists every action RunAction currently accepts, for filling in forms
+func AllActions() []string {
+	cfg := currentConfig()
+	var actions []string
+	for name := range TVCommands {
+		actions = append(actions, "tv/"+name)
+	}
+	for key := range TVRemoteKeys {
+		actions = append(actions, "tv/key/"+key)
+	}
+	for name := range ToshibaCommands {
+		actions = append(actions, "toshiba/"+name)
+	}
+	for _, application := range cfg.Agent.Applications {
+		actions = append(actions, "toshiba/launch/"+application)
+	}
+	for _, d := range devices.List() {
+		actions = append(actions, "devices/"+d.Name+"/wake")
+		if d.Name != "toshiba" {
+			actions = append(actions, "restore/"+d.Name)
+		}
+	}
+	actions = append(actions, "restore/tv", "restore/toshiba")
+	for _, s := range cfg.Scenes {
+		actions = append(actions, "scenes/"+s.Name+"/run")
+	}
+	for _, s := range cfg.States {
+		actions = append(actions, "states/"+s.Name+"/apply")
+	}
+	sort.Strings(actions)
+
+	//a device in the devicelist can have the same name as the TV, so drop repeats
+	unique := actions[:0]
+	for i, action := range actions {
+		if i == 0 || action != actions[i-1] {
+			unique = append(unique, action)
+		}
+	}
+	return unique
+}
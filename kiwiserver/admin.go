@@ -0,0 +1,171 @@
+package kiwiserver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gocraft/web"
+)
+
+//The admin socket is a unix socket which serves the same routes as the website, signed in without a password, for
+//scripts and systemd units on the Pi. Only the user kiwiland runs as (and root) can connect to it.
+
+//socketUser is who requests through the admin socket are signed in as, and are recorded as in the history
+const socketUser = "local"
+
+//adminSocketKey marks requests that came through the admin socket in their context
+type adminSocketKey struct{}
+
+//fromAdminSocket says whether a request came through the admin socket
+func fromAdminSocket(req *web.Request) bool {
+	local, _ := req.Context().Value(adminSocketKey{}).(bool)
+	return local
+}
+
+//listenAdminSocket makes the unix socket at path, readable and writable only by its owner. The socket is made in a
+//private directory and moved into place, so there is no moment when anyone else could connect to it
+func listenAdminSocket(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New(path + " already exists and isn't a socket")
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.New("Another kiwiland is already listening at " + path)
+		}
+		//left behind by a kiwiland that didn't shut down cleanly
+		os.Remove(path)
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".kiwiland")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	temp := filepath.Join(dir, "admin.sock")
+	l, err := net.Listen("unix", temp)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(temp, 0600); err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+//RunAdminSocket serves handler on the admin socket at path, forever
+func RunAdminSocket(path string, handler http.Handler) {
+	l, err := listenAdminSocket(path)
+	if err != nil {
+		log.Println("Admin socket error:", err.Error())
+		return
+	}
+	log.Println("Admin socket listening at " + path)
+	err = http.Serve(l, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.RemoteAddr = "socket" //unix sockets have no address, so this is what the history shows
+		handler.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), adminSocketKey{}, true)))
+	}))
+	log.Println("Admin socket error:", err.Error())
+}
+
+//AdminContext is used for the /api/v1/admin handlers, which can only be reached through the admin socket
+type AdminContext struct {
+	*Context
+}
+
+//An AdminUser is a user as the admin API shows them, without their password or tokens
+type AdminUser struct {
+	Username string
+	SignedIn bool //whether they have a session that hasn't expired
+	Tokens   int
+}
+
+//adminUsers lists the users, by username
+func adminUsers() []AdminUser {
+	list := []AdminUser{}
+	for _, u := range users.List() {
+		list = append(list, AdminUser{Username: u.Username, SignedIn: u.SessionID != "" && u.SessionExpires.After(time.Now()), Tokens: len(u.Tokens)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+//audit records something done through the admin socket in the audit log
+func (c *AdminContext) audit(req *web.Request, action string, output string, err error) {
+	Audit(c.actor(), requestIP(req.Request), action, output, err, 0)
+}
+
+//answer writes the users after a change to them, or the error if it didn't work
+func (c *AdminContext) answer(rw web.ResponseWriter, err error) {
+	if err != nil {
+		writeAPIError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(rw, http.StatusOK, adminUsers())
+}
+
+//MIDDLEWARE
+
+//RequireAdminSocketMiddleware refuses requests that didn't come through the admin socket, even from signed in users
+func (c *AdminContext) RequireAdminSocketMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if !fromAdminSocket(req) {
+		writeAPIError(rw, http.StatusForbidden, "This can only be done through the admin socket")
+		return
+	}
+	next(rw, req)
+}
+
+//HANDLERS
+
+//GetAdminUsersHandler lists the users
+func (c *AdminContext) GetAdminUsersHandler(rw web.ResponseWriter, req *web.Request) {
+	writeJSON(rw, http.StatusOK, adminUsers())
+}
+
+//PostAdminUsersHandler adds a user, from the form fields Username and Password
+func (c *AdminContext) PostAdminUsersHandler(rw web.ResponseWriter, req *web.Request) {
+	username := req.FormValue("Username")
+	err := users.AddUser(username, req.FormValue("Password"))
+	c.audit(req, "users/add", username, err)
+	c.answer(rw, err)
+}
+
+//PostAdminUserPasswordHandler changes a user's password, from the form field Password
+func (c *AdminContext) PostAdminUserPasswordHandler(rw web.ResponseWriter, req *web.Request) {
+	username := req.PathParams["user"]
+	err := users.SetPassword(username, req.FormValue("Password"))
+	c.audit(req, "users/"+username+"/password", "", err)
+	c.answer(rw, err)
+}
+
+//PostAdminUserRemoveHandler deletes a user
+func (c *AdminContext) PostAdminUserRemoveHandler(rw web.ResponseWriter, req *web.Request) {
+	username := req.PathParams["user"]
+	err := users.RemoveUser(username)
+	c.audit(req, "users/"+username+"/remove", "", err)
+	c.answer(rw, err)
+}
+
+//PostAdminReloadHandler reads config.json again
+func (c *AdminContext) PostAdminReloadHandler(rw web.ResponseWriter, req *web.Request) {
+	err := ReloadConfig()
+	c.audit(req, "config/reload", "", err)
+	if err != nil {
+		writeAPIError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(rw, http.StatusOK, APIResult{Action: "config/reload", Output: "Reloaded " + configFile})
+}
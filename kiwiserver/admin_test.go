@@ -0,0 +1,205 @@
+package kiwiserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/gorilla/sessions"
+)
+
+//webRecorder is an httptest.ResponseRecorder which can stand in for gocraft/web's ResponseWriter
+type webRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r webRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("can't hijack a recorder")
+}
+func (r webRecorder) CloseNotify() <-chan bool { return make(chan bool) }
+func (r webRecorder) StatusCode() int          { return r.Code }
+func (r webRecorder) Written() bool            { return r.Body.Len() > 0 }
+func (r webRecorder) Size() int                { return r.Body.Len() }
+
+//testRequest makes a request as it arrives over the network, or through the admin socket
+func testRequest(method string, path string, socket bool) *web.Request {
+	r := httptest.NewRequest(method, path, nil)
+	if socket {
+		r = r.WithContext(context.WithValue(r.Context(), adminSocketKey{}, true))
+	}
+	return &web.Request{Request: r, PathParams: map[string]string{}}
+}
+
+//testContext makes a context as the middleware leaves it, before it signs anyone in
+func testContext() *Context {
+	return &Context{Storage: &users, Store: sessions.NewCookieStore([]byte("test"))}
+}
+
+//setupUsers starts with a single user, alice, with an API token
+func setupUsers(t *testing.T) string {
+	inTempDir(t)
+	users.Users = []User{{Username: "alice"}}
+	token, err := users.AddToken("alice", "script", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		users.mu.Lock()
+		if users.lastUsedSave != nil {
+			users.lastUsedSave.Stop()
+			users.lastUsedSave = nil
+		}
+		users.Users = nil
+		users.mu.Unlock()
+	})
+	return token
+}
+
+func TestLoadUserMiddleware(t *testing.T) {
+	token := setupUsers(t)
+	tests := []struct {
+		name     string
+		req      *web.Request
+		username string
+	}{
+		{"socket", testRequest("GET", "/", true), socketUser},
+		{"network", testRequest("GET", "/", false), ""},
+		{"token", testRequest("GET", "/", false), "alice"},
+		{"bad token", testRequest("GET", "/", false), ""},
+	}
+	tests[2].req.Header.Set("Authorization", "Bearer "+token)
+	tests[3].req.Header.Set("Authorization", "Bearer "+token+"x")
+	tests[1].req.RemoteAddr = "socket" //looking like the socket in the history doesn't sign anyone in
+	for _, test := range tests {
+		c := testContext()
+		ran := false
+		c.LoadUserMiddleware(webRecorder{httptest.NewRecorder()}, test.req, func(web.ResponseWriter, *web.Request) { ran = true })
+		if !ran || c.Username != test.username {
+			t.Errorf("%s request was signed in as %q, want %q", test.name, c.Username, test.username)
+		}
+	}
+}
+
+func TestRequireAdminSocketMiddleware(t *testing.T) {
+	token := setupUsers(t)
+	signedIn := testRequest("GET", "/api/v1/admin/users", false)
+	signedIn.Header.Set("Authorization", "Bearer "+token)
+	tests := []struct {
+		name string
+		req  *web.Request
+		code int
+	}{
+		{"socket", testRequest("GET", "/api/v1/admin/users", true), http.StatusOK},
+		{"network", testRequest("GET", "/api/v1/admin/users", false), http.StatusForbidden},
+		{"signed in", signedIn, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		c := &AdminContext{testContext()}
+		rec := webRecorder{httptest.NewRecorder()}
+		c.LoadUserMiddleware(rec, test.req, func(rw web.ResponseWriter, req *web.Request) {
+			c.RequireAdminSocketMiddleware(rw, req, c.GetAdminUsersHandler)
+		})
+		if rec.Code != test.code {
+			t.Errorf("%s request answered %d, want %d: %s", test.name, rec.Code, test.code, rec.Body.String())
+		}
+	}
+}
+
+func TestSocketHasNoSettings(t *testing.T) {
+	setupUsers(t)
+	c := &LoggedInContext{testContext()}
+	req := testRequest("GET", "/settings", true)
+	rec := webRecorder{httptest.NewRecorder()}
+	c.LoadUserMiddleware(rec, req, c.GetSettingsHandler)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("settings through the socket answered %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestListenAdminSocket(t *testing.T) {
+	inTempDir(t)
+	path := "admin.sock"
+
+	if err := ioutil.WriteFile(path, []byte("not a socket"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := listenAdminSocket(path); err == nil {
+		l.Close()
+		t.Fatal("listened over a file that isn't a socket")
+	}
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "not a socket" {
+		t.Fatal("the file that isn't a socket was changed")
+	}
+	os.Remove(path)
+
+	l, err := listenAdminSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("socket was made with mode %v, want a socket with 0600", info.Mode())
+	}
+	if others, _ := filepath.Glob(".kiwiland*"); len(others) != 0 {
+		t.Errorf("left behind %v", others)
+	}
+	if _, err := listenAdminSocket(path); err == nil {
+		t.Error("listened on a socket another kiwiland is listening on")
+	}
+
+	//a socket left behind by a kiwiland that stopped is replaced
+	l.Close()
+	l, err = listenAdminSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
+
+func TestRemoveUser(t *testing.T) {
+	setupUsers(t)
+	if err := users.RemoveUser("alice"); err == nil {
+		t.Fatal("removed the only user")
+	}
+	if err := users.RemoveUser("nobody"); err == nil {
+		t.Error("removed a user who doesn't exist")
+	}
+	if err := users.AddUser("bob", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.RemoveUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if list := users.List(); len(list) != 1 || list[0].Username != "bob" {
+		t.Errorf("users are %v, want just bob", list)
+	}
+	if err := users.RemoveUser("bob"); err == nil {
+		t.Error("removed the last user")
+	}
+
+	//the user file is replaced whole
+	b, err := ioutil.ReadFile(userFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(userFile + ".tmp"); !os.IsNotExist(err) {
+		t.Error("the temporary user file was left behind")
+	}
+	var saved Userlist
+	if err := json.Unmarshal(b, &saved); err != nil || len(saved.Users) != 1 || saved.Users[0].Username != "bob" {
+		t.Errorf("saved users are %s", b)
+	}
+}
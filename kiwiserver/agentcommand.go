@@ -0,0 +1,92 @@
+package kiwiserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/kiwih/kiwiland/kiwiagent"
+)
+
+//agent returns a client for the kiwiagent on the toshiba laptop
+func agent() kiwiagent.Client {
+	cfg := currentConfig()
+	return kiwiagent.Client{Address: cfg.Agent.Address, Secret: cfg.Agent.Secret}
+}
+
+//AgentEnabled reports if a kiwiagent has been paired in the config
+func AgentEnabled() bool {
+	return currentConfig().Agent.Address != ""
+}
+
+//AgentApplications returns the application names that can be launched through the kiwiagent
+func AgentApplications() []string {
+	return currentConfig().Agent.Applications
+}
+
+//ToshibaSleep asks the kiwiagent to suspend the toshiba laptop
+func ToshibaSleep() (string, error) {
+	return agent().Sleep()
+}
+
+//ToshibaShutdown asks the kiwiagent to turn the toshiba laptop off
+func ToshibaShutdown() (string, error) {
+	return agent().Shutdown()
+}
+
+//ToshibaLock asks the kiwiagent to lock the toshiba laptop's desktop
+func ToshibaLock() (string, error) {
+	return agent().Lock()
+}
+
+//ToshibaVolumeUp asks the kiwiagent to turn the toshiba laptop's volume up
+func ToshibaVolumeUp() (string, error) {
+	return agent().Volume("up")
+}
+
+//ToshibaVolumeDown asks the kiwiagent to turn the toshiba laptop's volume down
+func ToshibaVolumeDown() (string, error) {
+	return agent().Volume("down")
+}
+
+//ToshibaMute asks the kiwiagent to toggle mute on the toshiba laptop
+func ToshibaMute() (string, error) {
+	return agent().Volume("mute")
+}
+
+//ToshibaLaunch asks the kiwiagent to start one of its configured applications
+func ToshibaLaunch(application string) (string, error) {
+	return agent().Launch(application)
+}
+
+//runningShown is how many process names ToshibaRunning lists. The answer is shown in a flash message, which is kept in a
+//cookie, and a whole Windows process list doesn't fit in one
+const runningShown = 30
+
+//ToshibaRunning asks the kiwiagent what processes are running on the toshiba laptop
+func ToshibaRunning() (string, error) {
+	processes, err := agent().Running()
+	if err != nil {
+		return "", err
+	}
+	return describeRunning(processes), nil
+}
+
+//describeRunning says how many processes are running and lists the first runningShown of them
+func describeRunning(processes []string) string {
+	if len(processes) <= runningShown {
+		return fmt.Sprintf("Running %d: %s", len(processes), strings.Join(processes, ", "))
+	}
+	return fmt.Sprintf("Running %d: %s and %d more", len(processes), strings.Join(processes[:runningShown], ", "), len(processes)-runningShown)
+}
+
+//SuspendToshiba sleeps the toshiba laptop whichever way is set up: through the kiwiagent, or with a sleep-on-lan packet
+func SuspendToshiba() (string, error) {
+	if AgentEnabled() {
+		return ToshibaSleep()
+	}
+	if SleepOnLANEnabled() {
+		return ToshibaSleepOnLAN()
+	}
+	return "", errors.New("Neither a kiwiagent nor sleep-on-lan is set up for the toshiba")
+}
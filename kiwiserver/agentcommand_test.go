@@ -0,0 +1,26 @@
+package kiwiserver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDescribeRunning(t *testing.T) {
+	if got := describeRunning([]string{"explorer.exe", "kodi.exe"}); got != "Running 2: explorer.exe, kodi.exe" {
+		t.Errorf("a short list was described as %q", got)
+	}
+
+	//a whole Windows process list has to fit in a flash message's cookie, with room to spare
+	var processes []string
+	for i := 0; i < 400; i++ {
+		processes = append(processes, fmt.Sprintf("SomeLongWindowsService%03d.exe", i))
+	}
+	got := describeRunning(processes)
+	if !strings.HasPrefix(got, "Running 400: SomeLongWindowsService000.exe, ") || !strings.HasSuffix(got, "SomeLongWindowsService029.exe and 370 more") {
+		t.Errorf("a long list was described as %q", got)
+	}
+	if len(got) > 1500 {
+		t.Errorf("a long list was described in %d bytes", len(got))
+	}
+}
@@ -0,0 +1,241 @@
+package kiwiserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/gocraft/web"
+)
+
+//APIContext is used for the /api/v1 handlers, which talk JSON instead of HTML and redirects
+type APIContext struct {
+	*Context
+}
+
+//An APIError is what the API returns when something goes wrong, as {"Error": {...}}
+type APIError struct {
+	Status  int //the same as the HTTP status code
+	Message string
+}
+
+//An APIResult is what the API returns for an action, eg {"Action": "tv/poweron", "Output": "..."}. If the action failed
+//the status code is 502 and Error is set
+type APIResult struct {
+	Action string
+	Output string
+	Error  *APIError `json:",omitempty"`
+}
+
+//An APIDevice is a device and everything the API can do to it
+type APIDevice struct {
+	Name    string
+	MAC     string            `json:",omitempty"`
+	IP      string            `json:",omitempty"`
+	State   map[string]string //what kiwiland last knew, eg {"power": "on", "input": "hdmi4"}
+	Actions []string          //the actions for the device, to POST to /api/v1/<action>
+}
+
+//writeJSON writes a JSON response with the given status code
+func writeJSON(rw web.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+//writeAPIError writes an APIError response
+func writeAPIError(rw web.ResponseWriter, status int, message string) {
+	writeJSON(rw, status, struct{ Error APIError }{APIError{Status: status, Message: message}})
+}
+
+//apiDevices lists the TV, the toshiba and everything in the devicelist
+func apiDevices() []APIDevice {
+	state := StateSnapshot()
+
+	tv := APIDevice{Name: "tv", State: state["tv"]}
+	for name := range TVCommands {
+		tv.Actions = append(tv.Actions, "tv/"+name)
+	}
+	for key := range TVRemoteKeys {
+		tv.Actions = append(tv.Actions, "tv/key/"+key)
+	}
+	tv.Actions = append(tv.Actions, "restore/tv")
+
+	toshiba := APIDevice{Name: "toshiba", State: state["toshiba"]}
+	for name := range ToshibaCommands {
+		toshiba.Actions = append(toshiba.Actions, "toshiba/"+name)
+	}
+	for _, application := range currentConfig().Agent.Applications {
+		toshiba.Actions = append(toshiba.Actions, "toshiba/launch/"+application)
+	}
+	toshiba.Actions = append(toshiba.Actions, "restore/toshiba")
+
+	list := []APIDevice{tv, toshiba}
+	for _, d := range devices.List() {
+		if d.Name == "toshiba" {
+			list[1].MAC, list[1].IP = d.MAC, d.IP
+			list[1].Actions = append(list[1].Actions, "devices/toshiba/wake")
+			continue
+		}
+		list = append(list, APIDevice{Name: d.Name, MAC: d.MAC, IP: d.IP, State: state[d.Name], Actions: []string{"devices/" + d.Name + "/wake", "restore/" + d.Name}})
+	}
+	for i := range list {
+		if list[i].State == nil {
+			list[i].State = make(map[string]string)
+		}
+		sort.Strings(list[i].Actions)
+	}
+	return list
+}
+
+//apiAction runs an action for the signed in user and writes its result. An action that isn't known, eg launching an
+//application that isn't listed, is a 404, and only a device that failed is a 502
+func (c *APIContext) apiAction(rw web.ResponseWriter, req *web.Request, action string) {
+	output, err := c.perform(req, action)
+	switch {
+	case err == nil:
+		writeJSON(rw, http.StatusOK, APIResult{Action: action, Output: output})
+	case err == ErrNotAllowed:
+		writeAPIError(rw, http.StatusForbidden, err.Error())
+	case err == ErrNothingToRestore:
+		writeAPIError(rw, http.StatusConflict, err.Error())
+	case CheckAction(action) != nil:
+		writeAPIError(rw, http.StatusNotFound, err.Error())
+	default:
+		writeJSON(rw, http.StatusBadGateway, APIResult{Action: action, Output: output, Error: &APIError{Status: http.StatusBadGateway, Message: err.Error()}})
+	}
+}
+
+//MIDDLEWARE
+
+//RequireAPIAccountMiddleware requires a user to be signed in, with a session cookie or an API token, answering with a
+//JSON error rather than a redirect if not
+func (c *APIContext) RequireAPIAccountMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if c.Username == "" {
+		writeAPIError(rw, http.StatusUnauthorized, "You need to sign in to use the API")
+		return
+	}
+	next(rw, req)
+}
+
+//HANDLERS
+
+//GetAPIDevicesHandler lists the devices
+func (c *APIContext) GetAPIDevicesHandler(rw web.ResponseWriter, req *web.Request) {
+	writeJSON(rw, http.StatusOK, apiDevices())
+}
+
+//GetAPIDeviceHandler shows one device
+func (c *APIContext) GetAPIDeviceHandler(rw web.ResponseWriter, req *web.Request) {
+	for _, d := range apiDevices() {
+		if d.Name == req.PathParams["device"] {
+			writeJSON(rw, http.StatusOK, d)
+			return
+		}
+	}
+	writeAPIError(rw, http.StatusNotFound, "Device not found")
+}
+
+//GetAPIStateHandler shows everything kiwiland knows about its devices, eg {"tv": {"power": "on"}}
+func (c *APIContext) GetAPIStateHandler(rw web.ResponseWriter, req *web.Request) {
+	writeJSON(rw, http.StatusOK, StateSnapshot())
+}
+
+//PostAPITVCommandHandler calls a command on the TV
+func (c *APIContext) PostAPITVCommandHandler(rw web.ResponseWriter, req *web.Request) {
+	command := req.PathParams["command"]
+	if _, ok := TVCommands[command]; !ok {
+		writeAPIError(rw, http.StatusNotFound, "Bad tv command: "+command)
+		return
+	}
+	c.apiAction(rw, req, "tv/"+command)
+}
+
+//PostAPITVKeyHandler presses a button on the TV's remote
+func (c *APIContext) PostAPITVKeyHandler(rw web.ResponseWriter, req *web.Request) {
+	key := req.PathParams["key"]
+	if _, ok := TVRemoteKeys[key]; !ok {
+		writeAPIError(rw, http.StatusNotFound, "Bad tv key: "+key)
+		return
+	}
+	c.apiAction(rw, req, "tv/key/"+key)
+}
+
+//PostAPIToshibaCommandHandler calls a command on the toshiba laptop
+func (c *APIContext) PostAPIToshibaCommandHandler(rw web.ResponseWriter, req *web.Request) {
+	command := req.PathParams["command"]
+	if _, ok := ToshibaCommands[command]; !ok {
+		writeAPIError(rw, http.StatusNotFound, "Bad toshiba command: "+command)
+		return
+	}
+	c.apiAction(rw, req, "toshiba/"+command)
+}
+
+//PostAPIToshibaLaunchHandler asks the kiwiagent on the toshiba laptop to start an application
+func (c *APIContext) PostAPIToshibaLaunchHandler(rw web.ResponseWriter, req *web.Request) {
+	c.apiAction(rw, req, "toshiba/launch/"+req.PathParams["application"])
+}
+
+//PostAPIDeviceWakeHandler wakes a device from the devicelist
+func (c *APIContext) PostAPIDeviceWakeHandler(rw web.ResponseWriter, req *web.Request) {
+	name := req.PathParams["device"]
+	if _, err := devices.LoadDevice(name); err != nil {
+		writeAPIError(rw, http.StatusNotFound, err.Error())
+		return
+	}
+	c.apiAction(rw, req, "devices/"+name+"/wake")
+}
+
+//PostAPIRestoreHandler puts a device back how it was before the last action that changed it
+func (c *APIContext) PostAPIRestoreHandler(rw web.ResponseWriter, req *web.Request) {
+	c.apiAction(rw, req, "restore/"+req.PathParams["device"])
+}
+
+//GetAPIScenesHandler lists the scenes
+func (c *APIContext) GetAPIScenesHandler(rw web.ResponseWriter, req *web.Request) {
+	list := Scenes()
+	if list == nil {
+		list = []Scene{}
+	}
+	writeJSON(rw, http.StatusOK, list)
+}
+
+//GetAPISceneHandler shows the latest run of a scene
+func (c *APIContext) GetAPISceneHandler(rw web.ResponseWriter, req *web.Request) {
+	name := req.PathParams["scene"]
+	if _, err := LoadScene(name); err != nil {
+		writeAPIError(rw, http.StatusNotFound, err.Error())
+		return
+	}
+	run, ok := LastSceneRun(name)
+	if !ok {
+		run.Scene = name
+	}
+	writeJSON(rw, http.StatusOK, run)
+}
+
+//PostAPISceneRunHandler starts a scene. Scenes can take minutes, so this answers straight away with 202; the run's
+//progress is at GET /api/v1/scenes/<scene>
+func (c *APIContext) PostAPISceneRunHandler(rw web.ResponseWriter, req *web.Request) {
+	name := req.PathParams["scene"]
+	if _, err := LoadScene(name); err != nil {
+		writeAPIError(rw, http.StatusNotFound, err.Error())
+		return
+	}
+	if err := c.allowed("scenes/" + name + "/run"); err != nil {
+		Audit(c.actor(), requestIP(req.Request), "scenes/"+name+"/run", "", err, 0)
+		writeAPIError(rw, http.StatusForbidden, err.Error())
+		return
+	}
+	err := StartScene(name)
+	Audit(c.actor(), requestIP(req.Request), "scenes/"+name+"/run", "started", err, 0)
+	if err != nil {
+		writeAPIError(rw, http.StatusConflict, err.Error())
+		return
+	}
+	run, _ := LastSceneRun(name)
+	rw.Header().Set("Location", APISceneURL.Make("scene", name))
+	writeJSON(rw, http.StatusAccepted, run)
+}
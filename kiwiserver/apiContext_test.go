@@ -0,0 +1,51 @@
+package kiwiserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//apiRoutes are the API's routes that run actions
+var apiRoutes = []URL{APIDeviceWakeURL, APITVCommandURL, APITVKeyURL, APIToshibaCommandURL, APIToshibaLaunchURL, APIRestoreURL, APISceneRunURL}
+
+//routeMatches checks whether a path fits a route, segment by segment
+func routeMatches(route URL, path string) bool {
+	want, got := strings.Split(route.String(), "/"), strings.Split(path, "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if !strings.HasPrefix(want[i], ":") && want[i] != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAPIDeviceActionsHaveRoutes(t *testing.T) {
+	inTempDir(t)
+	for _, d := range apiDevices() {
+		for _, action := range d.Actions {
+			found := false
+			for _, route := range apiRoutes {
+				found = found || routeMatches(route, "/api/v1/"+action)
+			}
+			if !found {
+				t.Errorf("%s can do %s, but nothing serves /api/v1/%s", d.Name, action, action)
+			}
+		}
+	}
+}
+
+func TestAPITVKeyUnknown(t *testing.T) {
+	c := &APIContext{testContext()}
+	req := testRequest("POST", "/api/v1/tv/key/launchmissiles", false)
+	req.PathParams["key"] = "launchmissiles"
+	rec := webRecorder{httptest.NewRecorder()}
+	c.PostAPITVKeyHandler(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("an unknown key answered %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,251 @@
+package kiwiserver
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//An AuditEntry records who did something with kiwiland, when, from where, and how it went
+type AuditEntry struct {
+	Time     time.Time
+	User     string //the username, or eg "schedule nightly" or "rule late" for things kiwiland did by itself
+	IP       string //empty for things kiwiland did by itself
+	Action   string //eg "tv/poweroff" or "sleeptimer/set"
+	Output   string
+	Error    string
+	Duration time.Duration
+}
+
+//An AuditFilter picks which audit entries to show. Empty fields match everything
+type AuditFilter struct {
+	User   string
+	Action string //matches any action containing this, eg "tv/" for everything done to the TV
+	From   time.Time
+	To     time.Time //entries before the end of this day
+	Failed bool      //only entries with errors
+}
+
+//ParseAuditFilter reads a filter from query parameters: user, action, from and to (dates like 2006-01-02), and failed
+func ParseAuditFilter(query url.Values) (AuditFilter, error) {
+	f := AuditFilter{User: query.Get("user"), Action: query.Get("action"), Failed: query.Get("failed") != ""}
+	var err error
+	if from := query.Get("from"); from != "" {
+		if f.From, err = time.ParseInLocation("2006-01-02", from, time.Local); err != nil {
+			return f, errors.New("Bad from date: " + from)
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		if f.To, err = time.ParseInLocation("2006-01-02", to, time.Local); err != nil {
+			return f, errors.New("Bad to date: " + to)
+		}
+	}
+	return f, nil
+}
+
+//Matches reports whether an entry passes the filter
+func (f AuditFilter) Matches(e AuditEntry) bool {
+	switch {
+	case f.User != "" && f.User != e.User:
+		return false
+	case f.Action != "" && !strings.Contains(e.Action, f.Action):
+		return false
+	case !f.From.IsZero() && e.Time.Before(f.From):
+		return false
+	case !f.To.IsZero() && !e.Time.Before(f.To.AddDate(0, 0, 1)):
+		return false
+	case f.Failed && e.Error == "":
+		return false
+	}
+	return true
+}
+
+var (
+	auditMutex sync.Mutex
+	auditLog   []AuditEntry
+)
+
+const (
+	auditFile = "audit.jsonl" //one json entry per line, so that recording an entry only appends to it
+
+	//auditMax is how many entries are kept, oldest dropped first
+	auditMax = 10000
+)
+
+//clientIP takes the address of the other end of a request, without the port
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+//matchIP reports whether an IP address is in a list of addresses and CIDR ranges, eg "192.168.2.5" or "10.0.0.0/8"
+func matchIP(ip net.IP, list []string) bool {
+	for _, allow := range list {
+		if _, network, err := net.ParseCIDR(allow); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if allowIP := net.ParseIP(allow); allowIP != nil && allowIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//trustedProxy reports whether an address is one of the TrustedProxies
+func trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	return ip != nil && matchIP(ip, currentConfig().TrustedProxies)
+}
+
+//requestIP is the address of whoever made a request. Behind a reverse proxy every request comes from the proxy, so if
+//the other end is one of the TrustedProxies, the X-Real-IP or X-Forwarded-For header it added is believed instead
+func requestIP(req *http.Request) string {
+	ip := clientIP(req.RemoteAddr)
+	if !trustedProxy(ip) {
+		return ip
+	}
+	if real := strings.TrimSpace(req.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+	//each proxy adds the address it saw to the end, so the client is the last one that isn't a trusted proxy
+	forwarded := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(address) == nil {
+			break
+		}
+		if !trustedProxy(address) {
+			return address
+		}
+	}
+	return ip
+}
+
+//Audit records an entry in the audit log
+func Audit(user string, ip string, action string, output string, err error, duration time.Duration) {
+	e := AuditEntry{Time: time.Now(), User: user, IP: ip, Action: action, Output: output, Duration: duration}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	auditLog = append(auditLog, e)
+	if len(auditLog) > 2*auditMax {
+		//rewrite the file now and then rather than let it grow forever
+		auditLog = append([]AuditEntry(nil), auditLog[len(auditLog)-auditMax:]...)
+		saveAudit()
+		return
+	}
+	f, ferr := os.OpenFile(auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if ferr != nil {
+		log.Println("Could not write audit log:", ferr.Error())
+		return
+	}
+	entryBytes, _ := json.Marshal(e)
+	f.Write(append(entryBytes, '\n'))
+	f.Close()
+}
+
+//PerformAction runs an action on someone's behalf, records it in the audit log and tells open pages how it went
+func PerformAction(action string, user string, ip string) (string, error) {
+	start := time.Now()
+	output, err := RunAction(action)
+	Audit(user, ip, action, output, err, time.Since(start))
+	liveActionDone(action, user, err)
+	return output, err
+}
+
+//AuditLog returns the audit entries that pass a filter, newest first
+func AuditLog(f AuditFilter) []AuditEntry {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	var entries []AuditEntry
+	for i := len(auditLog) - 1; i >= 0; i-- {
+		if f.Matches(auditLog[i]) {
+			entries = append(entries, auditLog[i])
+		}
+	}
+	return entries
+}
+
+//AuditUsers lists everyone in the audit log, for filling in the filter form
+func AuditUsers() []string {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	seen := make(map[string]bool)
+	var names []string
+	for _, e := range auditLog {
+		if !seen[e.User] {
+			seen[e.User] = true
+			names = append(names, e.User)
+		}
+	}
+	return names
+}
+
+//WriteAuditCSV writes audit entries out as CSV with a header row
+func WriteAuditCSV(w io.Writer, entries []AuditEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"Time", "User", "IP", "Action", "Output", "Error", "Milliseconds"})
+	for _, e := range entries {
+		cw.Write([]string{e.Time.Format(time.RFC3339), e.User, e.IP, e.Action, e.Output, e.Error, strconv.FormatInt(int64(e.Duration/time.Millisecond), 10)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+//LoadAudit will load the audit log from its file
+func LoadAudit() {
+	f, err := os.Open(auditFile)
+	if err != nil {
+		return //nothing has been done yet
+	}
+	defer f.Close()
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue //eg a line cut short by a crash
+		}
+		auditLog = append(auditLog, e)
+	}
+	if len(auditLog) > auditMax {
+		auditLog = auditLog[len(auditLog)-auditMax:]
+	}
+}
+
+//saveAudit will rewrite the audit log file from memory. The mutex must be held
+func saveAudit() {
+	f, err := os.Create(auditFile)
+	if err != nil {
+		log.Println("Could not write audit log:", err.Error())
+		return
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, e := range auditLog {
+		entryBytes, _ := json.Marshal(e)
+		w.Write(append(entryBytes, '\n'))
+	}
+	w.Flush()
+}
@@ -0,0 +1,65 @@
+package kiwiserver
+
+import (
+	"bufio"
+	"log"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//cecWatchRestarts counts how many times the long-running cec-client had to be restarted
+var cecWatchRestarts int64
+
+//CECWatchRestarts returns how many times the long-running cec-client had to be restarted
+func CECWatchRestarts() int64 {
+	return atomic.LoadInt64(&cecWatchRestarts)
+}
+
+//parseRemoteKey finds the key code in a cec-client traffic line for a "user control pressed" message
+//lines look like this: TRAFFIC: [          1234]	>> 04:44:01
+func parseRemoteKey(line string) (string, bool) {
+	i := strings.Index(line, ">> ")
+	if i < 0 {
+		return "", false
+	}
+	frame := strings.Split(strings.TrimSpace(line[i+3:]), ":")
+	if len(frame) < 3 || frame[1] != "44" {
+		return "", false
+	}
+	return strings.ToLower(frame[2]), true
+}
+
+//watchCECOnce runs cec-client in monitor mode until it exits, publishing a remotekey event for every key pressed
+func watchCECOnce() error {
+	cmd := exec.Command("cec-client", "-m", "-d", "8")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		if key, ok := parseRemoteKey(scanner.Text()); ok {
+			Publish(Event{Type: EventRemoteKey, Device: "tv", Value: key})
+		}
+	}
+	return cmd.Wait()
+}
+
+//WatchCECRemote keeps a monitor-mode cec-client running forever, restarting it if it dies
+func WatchCECRemote() {
+	for {
+		err := watchCECOnce()
+		if err != nil {
+			log.Println("CEC remote watcher stopped:", err.Error())
+		} else {
+			log.Println("CEC remote watcher stopped")
+		}
+		atomic.AddInt64(&cecWatchRestarts, 1)
+		time.Sleep(10 * time.Second) //don't spin if cec-client is missing
+	}
+}
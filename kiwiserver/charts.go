@@ -0,0 +1,124 @@
+package kiwiserver
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//chartColours are used for inputs in the order ScreenTimeReport.Inputs gives them
+var chartColours = []string{"#4e79a7", "#f28e2b", "#59a14f", "#e15759", "#76b7b2", "#edc948", "#b07aa1", "#9c755f"}
+
+const (
+	chartWidth  = 560
+	chartHeight = 180
+	chartLeft   = 40 //room for the axis labels
+	chartBottom = 20
+)
+
+//inputColours gives each input in a report a colour
+func inputColours(r ScreenTimeReport) map[string]string {
+	colours := make(map[string]string)
+	for i, input := range r.Inputs() {
+		colours[input] = chartColours[i%len(chartColours)]
+	}
+	return colours
+}
+
+//chartScale rounds a maximum up to whole hours so the axis is readable
+func chartScale(max time.Duration) time.Duration {
+	scale := max.Truncate(time.Hour)
+	if scale < max || scale == 0 {
+		scale += time.Hour
+	}
+	return scale
+}
+
+//startChart writes the svg header and a y axis labelled in hours, or in minutes for scales of an hour
+func startChart(b *strings.Builder, scale time.Duration) {
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="10">`, chartWidth, chartHeight)
+	plotHeight := chartHeight - chartBottom
+	fmt.Fprintf(b, `<line x1="%d" y1="0" x2="%d" y2="%d" stroke="#999"/>`, chartLeft, chartLeft, plotHeight)
+	fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#999"/>`, chartLeft, plotHeight, chartWidth, plotHeight)
+	label := strconv.Itoa(int(scale.Hours())) + "h"
+	if scale == time.Hour {
+		label = "60m"
+	}
+	fmt.Fprintf(b, `<text x="%d" y="10" text-anchor="end">%s</text>`, chartLeft-4, label)
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="end">0</text>`, chartLeft-4, plotHeight)
+}
+
+//barHeight scales a duration to the plot
+func barHeight(d time.Duration, scale time.Duration) int {
+	return int(float64(chartHeight-chartBottom) * float64(d) / float64(scale))
+}
+
+//HourlyChart draws an svg bar chart of how many minutes the TV was on in each hour of the report's first day
+func HourlyChart(r ScreenTimeReport) template.HTML {
+	if len(r.Days) == 0 {
+		return ""
+	}
+	day := r.Days[0]
+	var b strings.Builder
+	startChart(&b, time.Hour)
+	slot := (chartWidth - chartLeft) / 24
+	plotHeight := chartHeight - chartBottom
+	for h, on := range day.ByHour {
+		x := chartLeft + h*slot
+		height := barHeight(on, time.Hour)
+		colour := chartColours[0]
+		if h >= lateAfter || h < lateBefore {
+			colour = chartColours[3]
+		}
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"><title>%02d:00 %s</title></rect>`, x+1, plotHeight-height, slot-2, height, colour, h, FormatDuration(on))
+		if h%3 == 0 {
+			fmt.Fprintf(&b, `<text x="%d" y="%d">%02d</text>`, x, chartHeight-6, h)
+		}
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+//DailyChart draws an svg bar chart of how long the TV was on each day of the report, split up by input
+func DailyChart(r ScreenTimeReport) template.HTML {
+	if len(r.Days) == 0 {
+		return ""
+	}
+	var max time.Duration
+	for _, day := range r.Days {
+		if day.Total > max {
+			max = day.Total
+		}
+	}
+	scale := chartScale(max)
+	colours := inputColours(r)
+
+	var b strings.Builder
+	startChart(&b, scale)
+	slot := (chartWidth - chartLeft) / len(r.Days)
+	plotHeight := chartHeight - chartBottom
+	for i, day := range r.Days {
+		x := chartLeft + i*slot
+		y := plotHeight
+		for _, input := range r.Inputs() {
+			on := day.ByInput[input]
+			if on == 0 {
+				continue
+			}
+			height := barHeight(on, scale)
+			y -= height
+			fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"><title>%s %s</title></rect>`, x+2, y, slot-4, height, colours[input], html.EscapeString(input), FormatDuration(on))
+		}
+		fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`, x+2, chartHeight-6, day.Date.Format("Mon 2"))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+//InputColour is the colour an input has in a report's charts, for the legend
+func InputColour(r ScreenTimeReport, input string) template.CSS {
+	return template.CSS(inputColours(r)[input])
+}
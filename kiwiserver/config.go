@@ -0,0 +1,103 @@
+package kiwiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"sync"
+)
+
+//AgentConfig is how kiwiland reaches the kiwiagent running on the media PC
+type AgentConfig struct {
+	Address      string   //host:port of the agent, eg "192.168.2.20:3001". Leave empty if there is no agent.
+	Secret       string   //the secret the agent printed when it first ran
+	Applications []string //names of applications in the agent's config that kiwiland may launch, each gets a launch link
+
+	SleepOnLANAddress string //udp host:port the agent listens for sleep packets on, eg "192.168.2.255:9009". Leave empty to hide sleep-on-lan.
+}
+
+//RelayConfig is a kiwiagent, or another kiwiland, on a different network segment which can send wake packets there for us
+type RelayConfig struct {
+	Address string //host:port of the agent or kiwiland
+	Secret  string //the agent's secret, or the other kiwiland's RelaySecret
+}
+
+//Config holds the settings for this kiwiland which aren't secret enough for environment variables
+type Config struct {
+	Agent AgentConfig
+
+	Relays      map[string]RelayConfig //relays that devices with DeliveryRelay can name
+	RelaySecret string                 //if set, other kiwilands signing with this secret can ask this one to send wake packets
+
+	TrustedProxies []string //reverse proxies, eg nginx on "127.0.0.1", whose X-Real-IP or X-Forwarded-For header is believed
+
+	Scenes []Scene
+	States []DesiredState
+
+	Monitor MonitorConfig
+	Rules   []Rule
+
+	Idle IdleConfig
+
+	MQTT     MQTTConfig
+	Webhooks []Webhook
+	Metrics  MetricsConfig
+	Hue      HueConfig
+	HomeKit  HomeKitConfig
+}
+
+var (
+	configMutex sync.RWMutex
+	config      Config //read it with currentConfig, as ReloadConfig can replace it at any time
+)
+
+const (
+	configFile = "config.json"
+)
+
+//currentConfig returns the config as it is now. Something that reads several settings should take it once and read them
+//all from that, so that a reload part way through can't mix old and new settings. The config is replaced whole on a
+//reload, never changed, so it is safe to keep
+func currentConfig() Config {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config
+}
+
+//LoadConfig will load the config from its json file
+//or write out an empty one to be filled in if none exists
+func LoadConfig() {
+	configBytes, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		log.Printf("No config file provided. Writing a blank one to %s", configFile)
+		configBytes, _ = json.MarshalIndent(config, "", "\t")
+		ioutil.WriteFile(configFile, configBytes, 0600)
+		return
+	}
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	err = json.Unmarshal(configBytes, &config)
+	if err != nil {
+		log.Fatalf("Config file is broken. Fix or delete it and restart program.")
+	}
+}
+
+//ReloadConfig reads the config file again, keeping the old config if the file is missing or broken. Most settings are
+//read as they are needed so they change straight away, but MQTT, Hue and HomeKit are only started when kiwiland starts,
+//so turning them on or off or moving them to another address needs a restart
+func ReloadConfig() error {
+	configBytes, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	var fresh Config
+	if err := json.Unmarshal(configBytes, &fresh); err != nil {
+		return errors.New("Config file is broken: " + err.Error())
+	}
+	configMutex.Lock()
+	config = fresh
+	configMutex.Unlock()
+	log.Println("Reloaded config file")
+	return nil
+}
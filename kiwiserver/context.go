@@ -1,10 +1,16 @@
 package kiwiserver
 
 import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/gocraft/web"
 	"github.com/gorilla/sessions"
+	"github.com/kiwih/kiwiland/kiwiagent"
 )
 
 //UserStorer defines the interface something that can store and retrieve users must follow
@@ -13,6 +19,9 @@ type UserStorer interface {
 	LoadUsernameFromSessionID(sessionID string) (string, error)
 	Logout(username string) error
 	AttemptLogin(propUsername string, propPassword string, rememeber bool) (string, error)
+	LoadUsernameFromToken(token string) (string, APIToken, error)
+	AddToken(username string, name string, scopes []string, expires time.Time) (string, error)
+	RevokeToken(username string, id string) (APIToken, error)
 }
 
 //Context is used in all requests as the root object of all web requests
@@ -20,6 +29,7 @@ type Context struct {
 	ErrorMessages        []string
 	NotificationMessages []string
 	Username             string
+	Token                *APIToken //the API token the request was signed in with, or nil for a session
 	Data                 interface{}
 	Store                *sessions.CookieStore
 	Storage              UserStorer
@@ -27,6 +37,31 @@ type Context struct {
 
 //HELPER FUNCTIONS
 
+//actor is who to record in the audit log as doing things, eg "alice" or "alice (token phone)"
+func (c *Context) actor() string {
+	if c.Token != nil {
+		return c.Username + " (token " + c.Token.Name + ")"
+	}
+	return c.Username
+}
+
+//allowed returns ErrNotAllowed if the request was signed in with an API token whose scopes don't cover an action
+func (c *Context) allowed(action string) error {
+	if c.Token != nil && !c.Token.Allows(action) {
+		return ErrNotAllowed
+	}
+	return nil
+}
+
+//perform runs an action as the signed in user, checking first that their API token, if they used one, allows it
+func (c *Context) perform(req *web.Request, action string) (string, error) {
+	if err := c.allowed(action); err != nil {
+		Audit(c.actor(), requestIP(req.Request), action, "", err, 0)
+		return "", err
+	}
+	return PerformAction(action, c.actor(), requestIP(req.Request))
+}
+
 //SetErrorMessage allows for a handler to set an error message as a "Flash" message which can be shown to the user in a later request
 //(via a different handler) - it stores them in a session variable
 func (c *Context) SetErrorMessage(rw web.ResponseWriter, req *web.Request, err string) {
@@ -73,8 +108,28 @@ func (c *Context) AssignStorageMiddleware(rw web.ResponseWriter, req *web.Reques
 	next(rw, req)
 }
 
-//LoadUserMiddleware will load a user if possible from their session-security sessionID cookie
+//LoadUserMiddleware will load a user if possible from their API token or, failing that, their session-security sessionID cookie.
+//Requests through the admin socket are always signed in
 func (c *Context) LoadUserMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if fromAdminSocket(req) {
+		c.Username = socketUser
+		next(rw, req)
+		return
+	}
+
+	//Prometheus's bearer token is the metrics token, which the metrics handler checks itself
+	if token := bearerToken(req.Header.Get("Authorization")); token != "" && req.URL.Path != MetricsURL.String() {
+		username, t, err := c.Storage.LoadUsernameFromToken(token)
+		if err != nil {
+			log.Printf("Refused API token from %s: %s", requestIP(req.Request), err.Error())
+		} else {
+			c.Username = username
+			c.Token = &t
+		}
+		next(rw, req)
+		return
+	}
+
 	session, _ := c.Store.Get(req.Request, "session-security")
 
 	if session.Values["sessionID"] != nil {
@@ -125,11 +180,26 @@ func (c *Context) GetNotificationMessagesMiddleware(rw web.ResponseWriter, req *
 	next(rw, req)
 }
 
+//tokenRoutes are the logged in routes an API token limited by scopes may use. Everything else, such as changing
+//schedules or devices, needs a token without scopes
+var tokenRoutes = map[string]bool{
+	TVCommandURL.String():      true,
+	TVKeyURL.String():          true,
+	ToshibaCommandURL.String(): true,
+	ToshibaLaunchURL.String():  true,
+	DeviceWakeURL.String():     true,
+	SceneRunURL.String():       true,
+	StateApplyURL.String():     true,
+	RestoreURL.String():        true,
+}
+
 //RequireAccountMiddleware requires a user to be signed in
 func (c *Context) RequireAccountMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
 	if c.Username == "" {
 		c.SetErrorMessage(rw, req, "You need to sign in to view this page!")
 		http.Redirect(rw, req.Request, "/", http.StatusSeeOther)
+	} else if c.Token != nil && c.Token.Scoped() && !tokenRoutes[req.RoutePath()] {
+		http.Error(rw, "403: "+ErrNotAllowed.Error(), http.StatusForbidden)
 	} else {
 		next(rw, req)
 	}
@@ -167,6 +237,9 @@ func (c *Context) PostSignInRequestHandler(rw web.ResponseWriter, req *web.Reque
 	sessionID, err := c.Storage.AttemptLogin(prop.Username, prop.Password, prop.Remember)
 
 	if sessionID != "" && err == nil {
+		Publish(Event{Type: EventLogin, Device: "kiwiland", Value: prop.Username})
+		countLogin(true)
+		Audit(prop.Username, requestIP(req.Request), "signin", "", nil, 0)
 		//they have passed the login check. Save them to the session and redirect to management portal
 		session, _ := c.Store.Get(req.Request, "session-security")
 		session.Values["sessionID"] = sessionID
@@ -175,10 +248,54 @@ func (c *Context) PostSignInRequestHandler(rw web.ResponseWriter, req *web.Reque
 		http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusFound)
 		return
 	}
-	if err != nil {
-		c.SetErrorMessage(rw, req, err.Error())
-	} else {
-		c.SetErrorMessage(rw, req, "Logging in failed (unspecified error).")
+	Publish(Event{Type: EventLoginFailed, Device: "kiwiland", Value: prop.Username})
+	countLogin(false)
+	if err == nil {
+		err = errors.New("Logging in failed (unspecified error).")
 	}
+	Audit(prop.Username, requestIP(req.Request), "signin", "", err, 0)
+	c.SetErrorMessage(rw, req, err.Error())
 	http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusSeeOther)
 }
+
+//relayGuard stops signed relay requests being replayed
+var relayGuard kiwiagent.ReplayGuard
+
+//PostRelayWakeHandler lets another kiwiland, signing its request with our RelaySecret like it would for a kiwiagent,
+//ask us to send a wake packet on our network segment
+func (c *Context) PostRelayWakeHandler(rw web.ResponseWriter, req *web.Request) {
+	cfg := currentConfig()
+	if cfg.RelaySecret == "" {
+		http.Error(rw, "404: Relaying is not enabled", http.StatusNotFound)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, 1<<20))
+	signature := req.Header.Get(kiwiagent.SignatureHeader)
+	err := kiwiagent.VerifyRequest(cfg.RelaySecret, req.Method, req.URL.Path, body, req.Header.Get(kiwiagent.TimestampHeader), signature)
+	if err == nil {
+		err = relayGuard.Check(signature)
+	}
+	if err != nil {
+		log.Printf("Refused relay request from %s: %s", requestIP(req.Request), err.Error())
+		http.Error(rw, "401: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	mac, err := ParseMAC(req.PathParams["mac"])
+	if err != nil {
+		http.Error(rw, "400: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := kiwiagent.Response{}
+	start := time.Now()
+	resp.Message, err = WakeOnLAN(mac)
+	Audit("relay", requestIP(req.Request), "wake/"+mac, resp.Message, err, time.Since(start))
+	rw.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		resp.Error = err.Error()
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(rw).Encode(resp)
+}
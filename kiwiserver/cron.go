@@ -0,0 +1,189 @@
+package kiwiserver
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//A CronSpec is a parsed five field cron expression: minute hour day-of-month month day-of-week
+type CronSpec struct {
+	minute, hour, dom, month, dow uint64 //bit n is set if value n matches
+	domStar, dowStar              bool   //whether the day fields were *, which changes how they combine
+}
+
+//cronField describes the allowed values of one cron field
+type cronField struct {
+	min, max int
+	names    []string //names for values starting at min, eg jan is 1
+}
+
+var (
+	cronMinute = cronField{0, 59, nil}
+	cronHour   = cronField{0, 23, nil}
+	cronDom    = cronField{1, 31, nil}
+	cronMonth  = cronField{1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	cronDow    = cronField{0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+
+	cronMacros = map[string]string{
+		"@hourly":  "0 * * * *",
+		"@daily":   "0 0 * * *",
+		"@weekly":  "0 0 * * 0",
+		"@monthly": "0 0 1 * *",
+		"@yearly":  "0 0 1 1 *",
+	}
+)
+
+//parseCronValue reads a number or a name (eg "mon") for a field
+func (f cronField) parseCronValue(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return f.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, errors.New("Bad cron value: " + s)
+	}
+	return v, nil
+}
+
+//parse turns a field like "*/15", "1-5" or "0,30" into a bitset
+func (f cronField) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, errors.New("Bad cron step: " + part)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := f.min, f.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			ends := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = f.parseCronValue(ends[0]); err != nil {
+				return 0, err
+			}
+			if hi, err = f.parseCronValue(ends[1]); err != nil {
+				return 0, err
+			}
+			if hi < lo {
+				return 0, errors.New("Bad cron range: " + part)
+			}
+		default:
+			var err error
+			if lo, err = f.parseCronValue(part); err != nil {
+				return 0, err
+			}
+			if step == 1 {
+				hi = lo //a plain value, not "5/10" which means 5 to max every 10
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+//ParseCron parses a cron expression like "30 7 * * mon-fri", or one of @hourly, @daily, @weekly, @monthly and @yearly
+func ParseCron(spec string) (CronSpec, error) {
+	if macro, ok := cronMacros[strings.TrimSpace(spec)]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return CronSpec{}, errors.New("Cron expressions need five fields: minute hour day-of-month month day-of-week")
+	}
+
+	var c CronSpec
+	var err error
+	if c.minute, err = cronMinute.parse(fields[0]); err != nil {
+		return CronSpec{}, err
+	}
+	if c.hour, err = cronHour.parse(fields[1]); err != nil {
+		return CronSpec{}, err
+	}
+	if c.dom, err = cronDom.parse(fields[2]); err != nil {
+		return CronSpec{}, err
+	}
+	if c.month, err = cronMonth.parse(fields[3]); err != nil {
+		return CronSpec{}, err
+	}
+	if c.dow, err = cronDow.parse(fields[4]); err != nil {
+		return CronSpec{}, err
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 //7 is also sunday
+	}
+	c.domStar = strings.HasPrefix(fields[2], "*")
+	c.dowStar = strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+//dayMatches follows cron's rule that if both day fields are restricted, either may match
+func (c CronSpec) dayMatches(t time.Time) bool {
+	domOK := c.dom&(1<<uint(t.Day())) != 0
+	dowOK := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
+
+//Next returns the first time strictly after t that matches, or the zero time if there isn't one in the next five years
+func (c CronSpec) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			if c.skippedHour(t, next) {
+				return next
+			}
+			t = next
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			next := t.Add(time.Minute)
+			if c.skippedHour(t, next) {
+				return next
+			}
+			t = next
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+//skippedHour reports whether the clocks going forward between from and to, on the same day, skipped an hour that
+//matches. What would have run then runs as soon as they have gone forward, rather than not at all that day
+func (c CronSpec) skippedHour(from time.Time, to time.Time) bool {
+	if from.YearDay() != to.YearDay() {
+		return false
+	}
+	for h := from.Hour() + 1; h < to.Hour(); h++ {
+		if c.hour&(1<<uint(h)) != 0 {
+			return true
+		}
+	}
+	return false
+}
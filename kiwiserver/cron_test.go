@@ -0,0 +1,127 @@
+package kiwiserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronBad(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"* * * smarch *",
+		"@fortnightly",
+	} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Errorf("%q was accepted", spec)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	//2021-06-01 is a tuesday
+	at := func(month time.Month, day int, hour int, minute int) time.Time {
+		return time.Date(2021, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		spec  string
+		after time.Time
+		next  time.Time
+	}{
+		//plain values, and strictly after
+		{"0 1 * * *", at(6, 1, 0, 0), at(6, 1, 1, 0)},
+		{"0 1 * * *", at(6, 1, 1, 0), at(6, 2, 1, 0)},
+		{"0 1 * * *", at(6, 1, 0, 59).Add(30 * time.Second), at(6, 1, 1, 0)},
+		{"@hourly", at(6, 1, 10, 0), at(6, 1, 11, 0)},
+		{"@yearly", at(6, 1, 10, 0), time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+
+		//ranges and lists
+		{"30 7 * * mon-fri", at(6, 4, 7, 30), at(6, 7, 7, 30)}, //friday to monday
+		{"0 9-17 * * *", at(6, 1, 17, 0), at(6, 2, 9, 0)},
+		{"0,30 * * * *", at(6, 1, 10, 5), at(6, 1, 10, 30)},
+		{"0 0 * jun-aug *", at(8, 31, 0, 0), time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)},
+
+		//steps
+		{"*/15 * * * *", at(6, 1, 10, 50), at(6, 1, 11, 0)},
+		{"*/15 * * * *", at(6, 1, 10, 0), at(6, 1, 10, 15)},
+		{"5/20 * * * *", at(6, 1, 10, 6), at(6, 1, 10, 25)},
+		{"0 8-18/4 * * *", at(6, 1, 12, 0), at(6, 1, 16, 0)},
+		{"0 8-18/4 * * *", at(6, 1, 16, 0), at(6, 2, 8, 0)},
+
+		//days of the week, by number or name, with 0 and 7 both sunday
+		{"0 10 * * 0", at(6, 1, 0, 0), at(6, 6, 10, 0)},
+		{"0 10 * * 7", at(6, 1, 0, 0), at(6, 6, 10, 0)},
+		{"0 10 * * sat,sun", at(6, 1, 0, 0), at(6, 5, 10, 0)},
+
+		//when both day fields are restricted either matches, otherwise both must
+		{"0 0 13 * fri", at(6, 1, 0, 0), at(6, 4, 0, 0)},
+		{"0 0 13 * *", at(6, 1, 0, 0), at(6, 13, 0, 0)},
+		{"0 0 * * fri", at(6, 1, 0, 0), at(6, 4, 0, 0)},
+
+		//days that don't exist in every month
+		{"0 0 31 * *", at(6, 1, 0, 0), at(7, 31, 0, 0)},
+		{"0 0 29 2 *", at(6, 1, 0, 0), time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", at(6, 1, 0, 0), time.Time{}},
+	}
+	for _, test := range tests {
+		spec, err := ParseCron(test.spec)
+		if err != nil {
+			t.Errorf("%q: %s", test.spec, err.Error())
+			continue
+		}
+		if got := spec.Next(test.after); !got.Equal(test.next) {
+			t.Errorf("%q after %s is %s, want %s", test.spec, test.after, got, test.next)
+		}
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("no time zone database: " + err.Error())
+	}
+	at := func(month time.Month, day int, hour int, minute int, zone string) time.Time {
+		t := time.Date(2021, month, day, hour, minute, 0, 0, london)
+		if name, _ := t.Zone(); name != zone {
+			panic("the test's time " + t.String() + " isn't in " + zone)
+		}
+		return t
+	}
+	tests := []struct {
+		spec  string
+		after time.Time
+		next  time.Time
+	}{
+		//on 2021-03-28 the clocks go forward at 01:00 GMT to 02:00 BST
+		{"0 3 * * *", at(3, 27, 12, 0, "GMT"), at(3, 28, 3, 0, "BST")},
+		{"0 3 * * *", at(3, 28, 3, 0, "BST"), at(3, 29, 3, 0, "BST")},
+		{"30 1 * * *", at(3, 27, 12, 0, "GMT"), at(3, 28, 2, 0, "BST")}, //01:30 never happens, so it runs as the clocks change
+		{"30 1 * * *", at(3, 28, 2, 0, "BST"), at(3, 29, 1, 30, "BST")},
+		{"30 0-1 * * *", at(3, 28, 0, 30, "GMT"), at(3, 28, 2, 0, "BST")},
+		{"*/30 * * * *", at(3, 28, 0, 30, "GMT"), at(3, 28, 2, 0, "BST")},
+
+		//on 2021-10-31 they go back at 02:00 BST to 01:00 GMT, and 01:30 happens twice. It runs once
+		{"30 1 * * *", at(10, 30, 12, 0, "BST"), time.Date(2021, 10, 31, 1, 30, 0, 0, london)},
+		{"30 1 * * *", time.Date(2021, 10, 31, 1, 30, 0, 0, london), at(11, 1, 1, 30, "GMT")},
+		{"0 12 * * *", at(10, 30, 12, 0, "BST"), at(10, 31, 12, 0, "GMT")},
+	}
+	for _, test := range tests {
+		spec, err := ParseCron(test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := spec.Next(test.after); !got.Equal(test.next) {
+			t.Errorf("%q after %s is %s, want %s", test.spec, test.after, got, test.next)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package kiwiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"regexp"
+	"sync"
+)
+
+//A Device is a machine on the network that kiwiland knows how to wake
+type Device struct {
+	Name string
+	MAC  string
+	IP   string
+
+	Delivery         string //how wake packets reach the device, one of the DeliveryXxxx constants. Empty means DeliveryBroadcast
+	BroadcastAddress string //for DeliveryDirected, the broadcast address of the device's subnet, eg "192.168.3.255"
+	Interface        string //for DeliveryUnicast, the Pi's interface on the device's subnet, eg "eth0.3"
+	Relay            string //for DeliveryRelay, the name of one of the Relays in the config
+}
+
+//A Devicelist is a slice of devices, useful for the website to keep around. It is read by the monitor, rules, MQTT,
+//Hue and HomeKit while the website changes it, so everything goes through its methods, which hold the mutex
+type Devicelist struct {
+	Devices []Device
+
+	mu sync.Mutex
+}
+
+var deviceNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+//List returns a copy of the devices, which can be used without holding the mutex
+func (dl *Devicelist) List() []Device {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return append([]Device(nil), dl.Devices...)
+}
+
+//LoadDevice will load a device from the devicelist
+func (dl *Devicelist) LoadDevice(name string) (Device, error) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return dl.load(name)
+}
+
+//load finds a device. The mutex must be held
+func (dl *Devicelist) load(name string) (Device, error) {
+	for _, d := range dl.Devices {
+		if d.Name == name {
+			return d, nil
+		}
+	}
+	return Device{}, errors.New("Device not found")
+}
+
+//AddDevice checks a new device and adds it to the devicelist
+func (dl *Devicelist) AddDevice(d Device) error {
+	if !deviceNameRegexp.MatchString(d.Name) {
+		return errors.New("Device names may only contain letters, numbers, - and _")
+	}
+	mac, err := ParseMAC(d.MAC)
+	if err != nil {
+		return err
+	}
+	d.MAC = mac
+	if d.IP != "" && net.ParseIP(d.IP) == nil {
+		return errors.New("Bad IP address: " + d.IP)
+	}
+	if err := checkDelivery(d); err != nil {
+		return err
+	}
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if _, err := dl.load(d.Name); err == nil {
+		return errors.New("There is already a device called " + d.Name)
+	}
+	dl.Devices = append(dl.Devices, d)
+	saveDevices()
+	return nil
+}
+
+//RemoveDevice removes a device from the devicelist
+func (dl *Devicelist) RemoveDevice(name string) error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	for i := 0; i < len(dl.Devices); i++ {
+		if dl.Devices[i].Name == name {
+			dl.Devices = append(dl.Devices[:i], dl.Devices[i+1:]...)
+			saveDevices()
+			return nil
+		}
+	}
+	return errors.New("Device not found")
+}
+
+const (
+	deviceFile = "devices.json"
+)
+
+//LoadDevices will load the devices from a json file
+//or make a new file containing just the toshiba if none exists
+func LoadDevices() {
+	devices.mu.Lock()
+	defer devices.mu.Unlock()
+	deviceBytes, err := ioutil.ReadFile(deviceFile)
+	if err != nil {
+		log.Printf("No device file provided. Writing one with the toshiba to %s", deviceFile)
+		devices.Devices = []Device{Device{Name: "toshiba", MAC: toshibaMAC}}
+		saveDevices()
+		return
+	}
+	err = json.Unmarshal(deviceBytes, &devices)
+	if err != nil {
+		log.Fatalf("Device file is broken. Fix or delete it and restart program.")
+	}
+}
+
+//saveDevices will save the device file. The mutex must be held
+func saveDevices() {
+	deviceBytes, _ := json.MarshalIndent(&devices, "", "\t")
+	ioutil.WriteFile(deviceFile, deviceBytes, 0644)
+	log.Println("Saved device file")
+}
@@ -0,0 +1,181 @@
+package kiwiserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A DiscoveredHost is a machine found in the kernel's neighbour table
+type DiscoveredHost struct {
+	IP        string
+	MAC       string
+	Interface string
+	Hostname  string
+	Vendor    string
+	Known     string //name of the device with this MAC in the devicelist, if there is one
+
+	SuggestedName string //a device name made from the hostname
+}
+
+const (
+	arpTable = "/proc/net/arp"
+
+	//sweepMaxHosts stops us spraying packets across huge subnets
+	sweepMaxHosts = 1024
+	//sweepSettle is how long we give the kernel to collect arp replies after a sweep
+	sweepSettle = 2 * time.Second
+	//lookupTimeout bounds each reverse dns and mdns lookup
+	lookupTimeout = time.Second
+)
+
+//ReadNeighbours reads the complete entries from the kernel's arp table
+//the file looks like this:
+//IP address       HW type     Flags       HW address            Mask     Device
+//192.168.2.1      0x1         0x2         aa:bb:cc:dd:ee:ff     *        eth0
+func ReadNeighbours() ([]DiscoveredHost, error) {
+	f, err := os.Open(arpTable)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hosts []DiscoveredHost
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() //skip the header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[2] == "0x0" || fields[3] == "00:00:00:00:00:00" {
+			continue //incomplete entry
+		}
+		hosts = append(hosts, DiscoveredHost{IP: fields[0], MAC: fields[3], Interface: fields[5]})
+	}
+	return hosts, scanner.Err()
+}
+
+//SweepSubnets sends an empty udp packet to every address on our local ipv4 subnets.
+//We don't care if anything answers; the point is to make the kernel arp for each address
+func SweepSubnets() error {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil {
+				continue
+			}
+			ones, bits := ipnet.Mask.Size()
+			size := uint32(1) << uint(bits-ones)
+			if size > sweepMaxHosts || size < 4 {
+				continue
+			}
+			base := binary.BigEndian.Uint32(ipnet.IP.To4().Mask(ipnet.Mask))
+			for i := uint32(1); i < size-1; i++ {
+				ip := make(net.IP, 4)
+				binary.BigEndian.PutUint32(ip, base+i)
+				conn.WriteTo([]byte{}, &net.UDPAddr{IP: ip, Port: 9}) //discard port
+			}
+		}
+	}
+	time.Sleep(sweepSettle)
+	return nil
+}
+
+//LANIP is the first ipv4 address of our first LAN interface, for telling other things on the network where to find us
+func LANIP() string {
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				return ipnet.IP.String()
+			}
+		}
+	}
+	return "127.0.0.1"
+}
+
+//LookupHostname tries reverse dns, then mdns, to find a name for an ip address
+func LookupHostname(ip string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	if names, err := net.DefaultResolver.LookupAddr(ctx, ip); err == nil && len(names) > 0 {
+		return strings.TrimSuffix(names[0], ".")
+	}
+	if name, err := LookupMDNSAddr(ip, lookupTimeout); err == nil {
+		return name
+	}
+	return ""
+}
+
+//suggestDeviceName makes a valid device name from the first label of a hostname, eg "toshiba.local" is "toshiba"
+func suggestDeviceName(hostname string) string {
+	label := strings.SplitN(hostname, ".", 2)[0]
+	return strings.Map(func(r rune) rune {
+		if deviceNameRegexp.MatchString(string(r)) {
+			return r
+		}
+		return -1
+	}, label)
+}
+
+//DiscoverHosts reads the neighbour table (sweeping the local subnets first if asked)
+//and fills in hostnames, vendors and which hosts are already devices
+func DiscoverHosts(sweep bool) ([]DiscoveredHost, error) {
+	if sweep {
+		if err := SweepSubnets(); err != nil {
+			return nil, err
+		}
+	}
+	hosts, err := ReadNeighbours()
+	if err != nil {
+		return nil, err
+	}
+
+	known := devices.List()
+	var wg sync.WaitGroup
+	for i := range hosts {
+		hosts[i].Vendor = LookupVendor(hosts[i].MAC)
+		for _, d := range known {
+			if strings.EqualFold(d.MAC, hosts[i].MAC) {
+				hosts[i].Known = d.Name
+			}
+		}
+		wg.Add(1)
+		go func(h *DiscoveredHost) {
+			defer wg.Done()
+			h.Hostname = LookupHostname(h.IP)
+			h.SuggestedName = suggestDeviceName(h.Hostname)
+		}(&hosts[i])
+	}
+	wg.Wait()
+
+	sort.Slice(hosts, func(i, j int) bool {
+		return binary.BigEndian.Uint32(net.ParseIP(hosts[i].IP).To4()) < binary.BigEndian.Uint32(net.ParseIP(hosts[j].IP).To4())
+	})
+	return hosts, nil
+}
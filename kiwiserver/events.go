@@ -0,0 +1,77 @@
+package kiwiserver
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+//An Event is something that happened that other parts of kiwiland might want to react to
+type Event struct {
+	Time     time.Time
+	Type     string //one of the EventXxxx constants
+	Device   string //eg "tv", "toshiba", or a device from the devicelist
+	Value    string //eg "on", "hdmi4", "offline", or a username for logins
+	Previous string //for state changes, what the value was before
+	Source   string //for state changes, one of the SourceXxxx constants
+}
+
+//EventXxxx are the types of Event
+const (
+	EventPower       = "power"       //the TV's power changed. Values are "on" and "standby"
+	EventInput       = "input"       //the TV's input changed. Values are like "hdmi4"
+	EventOnline      = "online"      //a device started or stopped answering pings. Values are "online" and "offline"
+	EventTime        = "time"        //published at the start of every minute. Values are like "23:00"
+	EventLogin       = "login"       //somebody signed in. The value is their username
+	EventLoginFailed = "loginfailed" //somebody failed to sign in. The value is the username they tried
+	EventAction      = "action"      //kiwiland is running an action. The value is the action, eg "tv/poweron"
+	EventRemoteKey   = "remotekey"   //a key was pressed on the TV's remote. The value is the CEC key code, eg "44"
+	EventActivity    = "activity"    //someone is using a device, eg the kiwiagent saw keyboard or mouse input on the toshiba
+	EventScene       = "scene"       //a scene finished running. The value is the scene's name
+)
+
+//SourceXxxx say how kiwiland found out about a state change
+const (
+	SourceKiwiland = "kiwiland" //kiwiland made the change itself
+	SourceObserved = "observed" //kiwiland noticed the change, eg the TV was turned on with its remote
+)
+
+var (
+	subscribersMutex sync.Mutex
+	subscribers      = make(map[chan Event]bool)
+)
+
+//Subscribe returns a channel which receives every event published from now on. Unsubscribe it when done
+func Subscribe() chan Event {
+	ch := make(chan Event, 64)
+	subscribersMutex.Lock()
+	subscribers[ch] = true
+	subscribersMutex.Unlock()
+	return ch
+}
+
+//Unsubscribe stops and closes a channel from Subscribe
+func Unsubscribe(ch chan Event) {
+	subscribersMutex.Lock()
+	if subscribers[ch] {
+		delete(subscribers, ch)
+		close(ch)
+	}
+	subscribersMutex.Unlock()
+}
+
+//Publish sends an event to every subscriber. Slow subscribers miss events rather than hold everyone else up
+func Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+	for ch := range subscribers {
+		select {
+		case ch <- e:
+		default:
+			log.Printf("Dropped %s event for a slow subscriber", e.Type)
+		}
+	}
+}
@@ -0,0 +1,824 @@
+package kiwiserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+//This is the HomeKit Accessory Protocol over IP: pairing with SRP, verifying with curve25519, then HTTP/1.1 over
+//chacha20-poly1305. See homekit.go for what kiwiland shows through it
+
+//TLV types
+const (
+	tlvMethod        = 0
+	tlvIdentifier    = 1
+	tlvSalt          = 2
+	tlvPublicKey     = 3
+	tlvProof         = 4
+	tlvEncryptedData = 5
+	tlvState         = 6
+	tlvError         = 7
+	tlvSignature     = 10
+	tlvPermissions   = 11
+	tlvSeparator     = 0xff
+)
+
+//TLV error codes
+const (
+	tlvErrUnknown        = 1
+	tlvErrAuthentication = 2
+	tlvErrMaxTries       = 5
+	tlvErrUnavailable    = 6
+	tlvErrBusy           = 7
+)
+
+//Methods for /pairings
+const (
+	hapAddPairing    = 3
+	hapRemovePairing = 4
+	hapListPairings  = 5
+)
+
+//HAP status codes for characteristics
+const (
+	hapStatusOK           = 0
+	hapStatusNotAllowed   = -70401
+	hapStatusUnreachable  = -70402
+	hapStatusReadOnly     = -70404
+	hapStatusWriteOnly    = -70405
+	hapStatusNoEvents     = -70406
+	hapStatusNotFound     = -70409
+	hapStatusInvalidValue = -70410
+)
+
+//hapConnectionAuthRequired is the HTTP status for requests which need pair-verify first
+const hapConnectionAuthRequired = 470
+
+const (
+	//hapFrameMax is the most plaintext in one encrypted frame
+	hapFrameMax = 1024
+	//hapWriteTimeout is how long a controller gets to take a response or event before it is given up on
+	hapWriteTimeout = 10 * time.Second
+	//hapMaxSetupTries is how many wrong setup codes are allowed before pairing is refused until a restart
+	hapMaxSetupTries = 100
+)
+
+//srpN and srpG are the 3072-bit group from RFC 5054, which HomeKit uses for pair-setup
+var (
+	srpN, _ = new(big.Int).SetString(""+
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F"+
+		"83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B"+
+		"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA0510"+
+		"15728E5A8AAAC42DAD33170D04507A33A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7"+
+		"ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864D87602733EC86A64521F2B18177B200C"+
+		"BBE117577A615D6C770988C0BAD946E208E24FA074E5AB3143DB5BFCE0FD108E4B82D120A93AD2CAFFFFFFFFFFFFFFFF", 16)
+	srpG = big.NewInt(5)
+)
+
+//A tlvItem is one type and value in a TLV8 message
+type tlvItem struct {
+	Type  byte
+	Value []byte
+}
+
+//encodeTLV writes TLV8 items, splitting values over 255 bytes into fragments
+func encodeTLV(items ...tlvItem) []byte {
+	var b []byte
+	for _, item := range items {
+		value := item.Value
+		for {
+			n := len(value)
+			if n > 255 {
+				n = 255
+			}
+			b = append(b, item.Type, byte(n))
+			b = append(b, value[:n]...)
+			value = value[n:]
+			if len(value) == 0 {
+				break
+			}
+		}
+	}
+	return b
+}
+
+//decodeTLV reads a TLV8 message, joining fragments back together
+func decodeTLV(b []byte) (map[byte][]byte, error) {
+	m := make(map[byte][]byte)
+	var last byte
+	for i := 0; i < len(b); {
+		if i+2 > len(b) || i+2+int(b[i+1]) > len(b) {
+			return nil, errors.New("Truncated TLV")
+		}
+		t, value := b[i], b[i+2:i+2+int(b[i+1])]
+		if i > 0 && t == last {
+			m[t] = append(m[t], value...)
+		} else {
+			m[t] = append([]byte(nil), value...)
+		}
+		last = t
+		i += 2 + len(value)
+	}
+	return m, nil
+}
+
+//tlvByte makes a TLV item holding one byte, eg a state or error
+func tlvByte(t byte, value byte) tlvItem {
+	return tlvItem{Type: t, Value: []byte{value}}
+}
+
+//hashSHA512 hashes the parts one after another
+func hashSHA512(parts ...[]byte) []byte {
+	h := sha512.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+//srpPad pads a number to the length of srpN
+func srpPad(n *big.Int) []byte {
+	b := n.Bytes()
+	padded := make([]byte, len(srpN.Bytes()))
+	copy(padded[len(padded)-len(b):], b)
+	return padded
+}
+
+//An srpSession is the accessory's side of an SRP-6a exchange
+type srpSession struct {
+	username string
+	salt     []byte
+	v        *big.Int
+	b        *big.Int
+	B        []byte
+	K        []byte
+}
+
+//newSRPSession starts SRP for the HomeKit user "Pair-Setup" with the setup code as the password
+func newSRPSession(setupCode string) (*srpSession, error) {
+	salt := make([]byte, 16)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return startSRP("Pair-Setup", setupCode, salt, secret), nil
+}
+
+//startSRP starts SRP with a given salt and private key, which newSRPSession picks at random
+func startSRP(username string, password string, salt []byte, secret []byte) *srpSession {
+	s := &srpSession{username: username, salt: salt}
+	x := new(big.Int).SetBytes(hashSHA512(s.salt, hashSHA512([]byte(username+":"+password))))
+	s.v = new(big.Int).Exp(srpG, x, srpN)
+	s.b = new(big.Int).SetBytes(secret)
+
+	k := new(big.Int).SetBytes(hashSHA512(srpN.Bytes(), srpPad(srpG)))
+	B := new(big.Int).Mul(k, s.v)
+	B.Add(B, new(big.Int).Exp(srpG, s.b, srpN))
+	B.Mod(B, srpN)
+	s.B = srpPad(B)
+	return s
+}
+
+//verify checks the controller's proof, and returns the accessory's proof if it was right
+func (s *srpSession) verify(A []byte, proof []byte) ([]byte, error) {
+	a := new(big.Int).SetBytes(A)
+	if new(big.Int).Mod(a, srpN).Sign() == 0 {
+		return nil, errors.New("Bad SRP public key")
+	}
+	u := new(big.Int).SetBytes(hashSHA512(srpPad(a), s.B))
+	S := new(big.Int).Exp(s.v, u, srpN)
+	S.Mul(S, a)
+	S.Exp(S, s.b, srpN)
+	s.K = hashSHA512(srpPad(S))
+
+	hN, hG := hashSHA512(srpN.Bytes()), hashSHA512(srpG.Bytes())
+	for i := range hN {
+		hN[i] ^= hG[i]
+	}
+	expected := hashSHA512(hN, hashSHA512([]byte(s.username)), s.salt, A, s.B, s.K)
+	if subtle.ConstantTimeCompare(expected, proof) != 1 {
+		return nil, errors.New("Wrong setup code")
+	}
+	return hashSHA512(A, proof, s.K), nil
+}
+
+//hapKey derives a 32 byte key with HKDF-SHA512
+func hapKey(secret []byte, salt string, info string) []byte {
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha512.New, secret, []byte(salt), []byte(info)), key)
+	return key
+}
+
+//hapMessageNonce pads a pairing message's nonce, eg "PS-Msg05", to 12 bytes
+func hapMessageNonce(label string) []byte {
+	return append(make([]byte, 4), label...)
+}
+
+//hapFrameNonce makes the nonce for the nth frame of an encrypted session
+func hapFrameNonce(n uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.LittleEndian.PutUint64(nonce[4:], n)
+	return nonce
+}
+
+//sealTLV encrypts TLV items for a pairing message
+func sealTLV(key []byte, label string, items ...tlvItem) []byte {
+	aead, _ := chacha20poly1305.New(key)
+	return aead.Seal(nil, hapMessageNonce(label), encodeTLV(items...), nil)
+}
+
+//openTLV decrypts a pairing message's TLV items
+func openTLV(key []byte, label string, sealed []byte) (map[byte][]byte, error) {
+	aead, _ := chacha20poly1305.New(key)
+	plain, err := aead.Open(nil, hapMessageNonce(label), sealed, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeTLV(plain)
+}
+
+//A hapConn is a connection from a HomeKit controller. It is plain HTTP until pair-verify, then every frame is encrypted
+type hapConn struct {
+	net.Conn
+
+	readAEAD  cipher.AEAD
+	readCount uint64
+	readBuf   []byte
+
+	writeMutex sync.Mutex
+	writeAEAD  cipher.AEAD
+	writeCount uint64
+
+	setup      *srpSession
+	verify     *hapVerifySession
+	verified   []byte  //the shared secret from pair-verify, until the response saying it worked has been sent
+	disconnect *string //a controller to disconnect once the response has been sent, "" for everyone
+
+	mu         sync.Mutex
+	controller string                 //the pairing ID of the controller, once verified
+	events     map[[2]int]interface{} //characteristics the controller wants events for, and the value last sent
+}
+
+//A hapVerifySession is the accessory's side of pair-verify
+type hapVerifySession struct {
+	public           []byte
+	controllerPublic []byte
+	shared           []byte
+	key              []byte //encrypts the pair-verify messages
+}
+
+var (
+	hapConnsMutex sync.Mutex
+	hapConns      = make(map[*hapConn]bool)
+
+	hapSetupMutex sync.Mutex
+	hapSetupConn  *hapConn //the connection pairing, as only one may at a time
+	hapSetupFails int
+)
+
+//Read reads plain bytes, decrypting frames once the connection is verified
+func (c *hapConn) Read(b []byte) (int, error) {
+	if c.readAEAD == nil {
+		return c.Conn.Read(b)
+	}
+	if len(c.readBuf) == 0 {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+		length := int(binary.LittleEndian.Uint16(header))
+		if length > hapFrameMax {
+			return 0, errors.New("HAP frame too long")
+		}
+		sealed := make([]byte, length+chacha20poly1305.Overhead)
+		if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+			return 0, err
+		}
+		plain, err := c.readAEAD.Open(nil, hapFrameNonce(c.readCount), sealed, header)
+		if err != nil {
+			return 0, err
+		}
+		c.readCount++
+		c.readBuf = plain
+	}
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+//send writes a whole message, encrypting it once the connection is verified. It is safe to call from other goroutines
+func (c *hapConn) send(msg []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(hapWriteTimeout))
+	if c.writeAEAD == nil {
+		_, err := c.Conn.Write(msg)
+		return err
+	}
+	var out []byte
+	for len(msg) > 0 {
+		n := len(msg)
+		if n > hapFrameMax {
+			n = hapFrameMax
+		}
+		header := make([]byte, 2)
+		binary.LittleEndian.PutUint16(header, uint16(n))
+		out = append(out, header...)
+		out = c.writeAEAD.Seal(out, hapFrameNonce(c.writeCount), msg[:n], header)
+		c.writeCount++
+		msg = msg[n:]
+	}
+	_, err := c.Conn.Write(out)
+	return err
+}
+
+//Controller is the pairing ID of the verified controller, or "" if it hasn't verified
+func (c *hapConn) Controller() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.controller
+}
+
+//hapResponse formats an HTTP response, or an event when proto is "EVENT/1.0"
+func hapResponse(proto string, status int, contentType string, body []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %d %s\r\n", proto, status, http.StatusText(status))
+	if status == http.StatusNoContent {
+		b.WriteString("\r\n")
+		return b.Bytes()
+	}
+	if contentType != "" {
+		fmt.Fprintf(&b, "Content-Type: %s\r\n", contentType)
+	}
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", len(body))
+	b.Write(body)
+	return b.Bytes()
+}
+
+//hapJSON marshals a HAP JSON body
+func hapJSON(v interface{}) []byte {
+	body, _ := json.Marshal(v)
+	return body
+}
+
+//serveHAP answers a controller's requests until it disconnects
+func serveHAP(conn net.Conn) {
+	c := &hapConn{Conn: conn, events: make(map[[2]int]interface{})}
+	hapConnsMutex.Lock()
+	hapConns[c] = true
+	hapConnsMutex.Unlock()
+	defer func() {
+		hapConnsMutex.Lock()
+		delete(hapConns, c)
+		hapConnsMutex.Unlock()
+		hapSetupMutex.Lock()
+		if hapSetupConn == c {
+			hapSetupConn = nil
+		}
+		hapSetupMutex.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(c)
+	for {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return
+		}
+		status, contentType, resp := c.handle(req, body)
+		if err := c.send(hapResponse("HTTP/1.1", status, contentType, resp)); err != nil {
+			return
+		}
+		if c.verified != nil {
+			//pair-verify has just finished, and everything from now on is encrypted
+			c.readAEAD, _ = chacha20poly1305.New(hapKey(c.verified, "Control-Salt", "Control-Write-Encryption-Key"))
+			c.writeMutex.Lock()
+			c.writeAEAD, _ = chacha20poly1305.New(hapKey(c.verified, "Control-Salt", "Control-Read-Encryption-Key"))
+			c.writeMutex.Unlock()
+			c.verified = nil
+		}
+		if c.disconnect != nil {
+			hapDisconnect(*c.disconnect)
+			c.disconnect = nil
+		}
+	}
+}
+
+//handle answers one request, returning the status, content type and body
+func (c *hapConn) handle(req *http.Request, body []byte) (int, string, []byte) {
+	const tlv8 = "application/pairing+tlv8"
+	const hapjson = "application/hap+json"
+
+	switch {
+	case req.URL.Path == "/pair-setup" && req.Method == http.MethodPost:
+		return http.StatusOK, tlv8, c.pairSetup(body)
+	case req.URL.Path == "/pair-verify" && req.Method == http.MethodPost:
+		return http.StatusOK, tlv8, c.pairVerify(body)
+	case req.URL.Path == "/identify" && req.Method == http.MethodPost:
+		if homeKit.Paired() {
+			return http.StatusBadRequest, hapjson, hapJSON(map[string]int{"status": hapStatusNotAllowed})
+		}
+		homeKitIdentify(1)
+		return http.StatusNoContent, "", nil
+	}
+
+	if c.Controller() == "" {
+		return hapConnectionAuthRequired, hapjson, hapJSON(map[string]int{"status": hapStatusNotAllowed})
+	}
+	switch {
+	case req.URL.Path == "/accessories" && req.Method == http.MethodGet:
+		return http.StatusOK, hapjson, hapJSON(map[string]interface{}{"accessories": homeKitAccessoriesJSON(c)})
+	case req.URL.Path == "/characteristics" && req.Method == http.MethodGet:
+		status, resp := c.readCharacteristics(req.URL.Query().Get("id"), req.URL.Query().Get("ev") == "1")
+		return status, hapjson, resp
+	case req.URL.Path == "/characteristics" && req.Method == http.MethodPut:
+		status, resp := c.writeCharacteristics(body, clientIP(c.RemoteAddr().String()))
+		return status, hapjson, resp
+	case req.URL.Path == "/pairings" && req.Method == http.MethodPost:
+		return http.StatusOK, tlv8, c.pairings(body)
+	}
+	return http.StatusNotFound, hapjson, hapJSON(map[string]int{"status": hapStatusNotFound})
+}
+
+//pairSetup does a step of pair-setup, where a controller proves it knows the setup code and the two swap long term keys
+func (c *hapConn) pairSetup(body []byte) []byte {
+	m, err := decodeTLV(body)
+	if err != nil || len(m[tlvState]) != 1 {
+		return encodeTLV(tlvByte(tlvState, 2), tlvByte(tlvError, tlvErrUnknown))
+	}
+	state := m[tlvState][0]
+	fail := func(code byte) []byte {
+		c.setup = nil
+		return encodeTLV(tlvByte(tlvState, state+1), tlvByte(tlvError, code))
+	}
+
+	switch state {
+	case 1:
+		if homeKit.Paired() {
+			return fail(tlvErrUnavailable)
+		}
+		hapSetupMutex.Lock()
+		defer hapSetupMutex.Unlock()
+		if hapSetupFails >= hapMaxSetupTries {
+			return fail(tlvErrMaxTries)
+		}
+		if hapSetupConn != nil && hapSetupConn != c {
+			return fail(tlvErrBusy)
+		}
+		s, err := newSRPSession(homeKit.Code())
+		if err != nil {
+			return fail(tlvErrUnknown)
+		}
+		hapSetupConn, c.setup = c, s
+		return encodeTLV(tlvByte(tlvState, 2), tlvItem{tlvPublicKey, s.B}, tlvItem{tlvSalt, s.salt})
+
+	case 3:
+		if c.setup == nil {
+			return fail(tlvErrUnknown)
+		}
+		proof, err := c.setup.verify(m[tlvPublicKey], m[tlvProof])
+		if err != nil {
+			hapSetupMutex.Lock()
+			hapSetupFails++
+			hapSetupConn = nil
+			hapSetupMutex.Unlock()
+			log.Println("HomeKit pairing refused:", err.Error())
+			return fail(tlvErrAuthentication)
+		}
+		return encodeTLV(tlvByte(tlvState, 4), tlvItem{tlvProof, proof})
+
+	case 5:
+		if c.setup == nil || c.setup.K == nil {
+			return fail(tlvErrUnknown)
+		}
+		key := hapKey(c.setup.K, "Pair-Setup-Encrypt-Salt", "Pair-Setup-Encrypt-Info")
+		sub, err := openTLV(key, "PS-Msg05", m[tlvEncryptedData])
+		if err != nil {
+			return fail(tlvErrAuthentication)
+		}
+		controllerX := hapKey(c.setup.K, "Pair-Setup-Controller-Sign-Salt", "Pair-Setup-Controller-Sign-Info")
+		id, ltpk := sub[tlvIdentifier], sub[tlvPublicKey]
+		info := append(append(append([]byte(nil), controllerX...), id...), ltpk...)
+		if len(ltpk) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(ltpk), info, sub[tlvSignature]) {
+			return fail(tlvErrAuthentication)
+		}
+		if err := homeKit.AddPairing(string(id), ltpk, true); err != nil {
+			return fail(tlvErrUnknown)
+		}
+
+		accessoryX := hapKey(c.setup.K, "Pair-Setup-Accessory-Sign-Salt", "Pair-Setup-Accessory-Sign-Info")
+		pairingID, public, private := homeKit.Identity()
+		info = append(append(append([]byte(nil), accessoryX...), pairingID...), public...)
+		sealed := sealTLV(key, "PS-Msg06",
+			tlvItem{tlvIdentifier, []byte(pairingID)},
+			tlvItem{tlvPublicKey, public},
+			tlvItem{tlvSignature, ed25519.Sign(private, info)})
+
+		hapSetupMutex.Lock()
+		hapSetupConn, c.setup = nil, nil
+		hapSetupMutex.Unlock()
+		log.Println("HomeKit paired with", string(id))
+		return encodeTLV(tlvByte(tlvState, 6), tlvItem{tlvEncryptedData, sealed})
+	}
+	return fail(tlvErrUnknown)
+}
+
+//pairVerify does a step of pair-verify, where a paired controller and the accessory prove who they are to each other
+//and agree the keys for the rest of the connection
+func (c *hapConn) pairVerify(body []byte) []byte {
+	m, err := decodeTLV(body)
+	if err != nil || len(m[tlvState]) != 1 {
+		return encodeTLV(tlvByte(tlvState, 2), tlvByte(tlvError, tlvErrUnknown))
+	}
+	state := m[tlvState][0]
+	fail := func(code byte) []byte {
+		c.verify = nil
+		return encodeTLV(tlvByte(tlvState, state+1), tlvByte(tlvError, code))
+	}
+
+	switch state {
+	case 1:
+		controllerPublic := m[tlvPublicKey]
+		secret := make([]byte, curve25519.ScalarSize)
+		if _, err := rand.Read(secret); err != nil || len(controllerPublic) != curve25519.PointSize {
+			return fail(tlvErrUnknown)
+		}
+		public, _ := curve25519.X25519(secret, curve25519.Basepoint)
+		shared, err := curve25519.X25519(secret, controllerPublic)
+		if err != nil {
+			return fail(tlvErrAuthentication)
+		}
+		v := &hapVerifySession{public: public, controllerPublic: controllerPublic, shared: shared}
+		v.key = hapKey(shared, "Pair-Verify-Encrypt-Salt", "Pair-Verify-Encrypt-Info")
+
+		pairingID, _, private := homeKit.Identity()
+		info := append(append(append([]byte(nil), public...), pairingID...), controllerPublic...)
+		sealed := sealTLV(v.key, "PV-Msg02",
+			tlvItem{tlvIdentifier, []byte(pairingID)},
+			tlvItem{tlvSignature, ed25519.Sign(private, info)})
+		c.verify = v
+		return encodeTLV(tlvByte(tlvState, 2), tlvItem{tlvPublicKey, public}, tlvItem{tlvEncryptedData, sealed})
+
+	case 3:
+		v := c.verify
+		if v == nil || c.readAEAD != nil {
+			return fail(tlvErrUnknown)
+		}
+		sub, err := openTLV(v.key, "PV-Msg03", m[tlvEncryptedData])
+		if err != nil {
+			return fail(tlvErrAuthentication)
+		}
+		id := string(sub[tlvIdentifier])
+		pairing, ok := homeKit.LoadPairing(id)
+		info := append(append(append([]byte(nil), v.controllerPublic...), id...), v.public...)
+		if !ok || !ed25519.Verify(ed25519.PublicKey(pairing.PublicKey), info, sub[tlvSignature]) {
+			return fail(tlvErrAuthentication)
+		}
+		c.verify, c.verified = nil, v.shared //serveHAP switches to encryption once this is sent
+		c.mu.Lock()
+		c.controller = id
+		c.mu.Unlock()
+		return encodeTLV(tlvByte(tlvState, 4))
+	}
+	return fail(tlvErrUnknown)
+}
+
+//pairings adds, removes and lists pairings, for admin controllers, eg when someone is given access to the home
+func (c *hapConn) pairings(body []byte) []byte {
+	m, err := decodeTLV(body)
+	if err != nil || len(m[tlvMethod]) != 1 {
+		return encodeTLV(tlvByte(tlvState, 2), tlvByte(tlvError, tlvErrUnknown))
+	}
+	if p, ok := homeKit.LoadPairing(c.Controller()); !ok || !p.Admin {
+		return encodeTLV(tlvByte(tlvState, 2), tlvByte(tlvError, tlvErrAuthentication))
+	}
+
+	switch m[tlvMethod][0] {
+	case hapAddPairing:
+		admin := len(m[tlvPermissions]) == 1 && m[tlvPermissions][0] == 1
+		if err := homeKit.AddPairing(string(m[tlvIdentifier]), m[tlvPublicKey], admin); err != nil {
+			return encodeTLV(tlvByte(tlvState, 2), tlvByte(tlvError, tlvErrUnknown))
+		}
+		return encodeTLV(tlvByte(tlvState, 2))
+	case hapRemovePairing:
+		id := string(m[tlvIdentifier])
+		if homeKit.RemovePairing(id) {
+			id = "" //the last admin went, and took everyone with them
+		}
+		c.disconnect = &id
+		return encodeTLV(tlvByte(tlvState, 2))
+	case hapListPairings:
+		items := []tlvItem{tlvByte(tlvState, 2)}
+		for i, p := range homeKit.List() {
+			if i > 0 {
+				items = append(items, tlvItem{tlvSeparator, nil})
+			}
+			permissions := byte(0)
+			if p.Admin {
+				permissions = 1
+			}
+			items = append(items, tlvItem{tlvIdentifier, []byte(p.ID)}, tlvItem{tlvPublicKey, p.PublicKey}, tlvByte(tlvPermissions, permissions))
+		}
+		return encodeTLV(items...)
+	}
+	return encodeTLV(tlvByte(tlvState, 2), tlvByte(tlvError, tlvErrUnknown))
+}
+
+//A hapCharacteristicValue is one characteristic in a /characteristics request or response
+type hapCharacteristicValue struct {
+	AID    int         `json:"aid"`
+	IID    int         `json:"iid"`
+	Value  interface{} `json:"value,omitempty"`
+	Events *bool       `json:"ev,omitempty"`
+	Status *int        `json:"status,omitempty"`
+}
+
+//readCharacteristics answers a GET /characteristics?id=1.2,1.3
+func (c *hapConn) readCharacteristics(ids string, ev bool) (int, []byte) {
+	var values []hapCharacteristicValue
+	failed := false
+	for _, id := range strings.Split(ids, ",") {
+		parts := strings.SplitN(id, ".", 2)
+		if len(parts) != 2 {
+			return http.StatusBadRequest, hapJSON(map[string]int{"status": hapStatusInvalidValue})
+		}
+		aid, _ := strconv.Atoi(parts[0])
+		iid, _ := strconv.Atoi(parts[1])
+		v := hapCharacteristicValue{AID: aid, IID: iid}
+		status := hapStatusOK
+		if ch := homeKitCharacteristic(aid, iid); ch == nil {
+			status = hapStatusNotFound
+		} else if ch.read == nil {
+			status = hapStatusWriteOnly
+		} else {
+			v.Value = ch.read()
+		}
+		if ev {
+			c.mu.Lock()
+			_, subscribed := c.events[[2]int{aid, iid}]
+			c.mu.Unlock()
+			v.Events = &subscribed
+		}
+		if status != hapStatusOK {
+			failed = true
+		}
+		v.Status = &status
+		values = append(values, v)
+	}
+	if !failed {
+		for i := range values {
+			values[i].Status = nil
+		}
+		return http.StatusOK, hapJSON(map[string]interface{}{"characteristics": values})
+	}
+	return http.StatusMultiStatus, hapJSON(map[string]interface{}{"characteristics": values})
+}
+
+//writeCharacteristics answers a PUT /characteristics, which sets values and turns events on and off
+func (c *hapConn) writeCharacteristics(body []byte, ip string) (int, []byte) {
+	var req struct {
+		Characteristics []hapCharacteristicValue `json:"characteristics"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return http.StatusBadRequest, hapJSON(map[string]int{"status": hapStatusInvalidValue})
+	}
+
+	var results []hapCharacteristicValue
+	failed := false
+	for _, v := range req.Characteristics {
+		status := hapStatusOK
+		ch := homeKitCharacteristic(v.AID, v.IID)
+		switch {
+		case ch == nil:
+			status = hapStatusNotFound
+		case v.Events != nil && ch.events && ch.read != nil:
+			c.mu.Lock()
+			if *v.Events {
+				c.events[[2]int{v.AID, v.IID}] = ch.read()
+			} else {
+				delete(c.events, [2]int{v.AID, v.IID})
+			}
+			c.mu.Unlock()
+		case v.Events != nil:
+			status = hapStatusNoEvents
+		}
+		if ch != nil && v.Value != nil {
+			if ch.write == nil {
+				status = hapStatusReadOnly
+			} else if err := ch.write(v.Value, ip); err != nil {
+				log.Printf("HomeKit: setting %d.%d failed: %s", v.AID, v.IID, err.Error())
+				status = hapStatusUnreachable
+				if err == errHAPInvalidValue {
+					status = hapStatusInvalidValue
+				}
+			}
+		}
+		if status != hapStatusOK {
+			failed = true
+		}
+		s := status
+		results = append(results, hapCharacteristicValue{AID: v.AID, IID: v.IID, Status: &s})
+	}
+	if !failed {
+		return http.StatusNoContent, nil
+	}
+	return http.StatusMultiStatus, hapJSON(map[string]interface{}{"characteristics": results})
+}
+
+//sendEvents tells the controller about characteristics it wants events for whose values have changed
+func (c *hapConn) sendEvents() {
+	var changed []hapCharacteristicValue
+	c.mu.Lock()
+	for key, last := range c.events {
+		ch := homeKitCharacteristic(key[0], key[1])
+		if ch == nil || ch.read == nil {
+			continue
+		}
+		if value := ch.read(); value != last {
+			c.events[key] = value
+			changed = append(changed, hapCharacteristicValue{AID: key[0], IID: key[1], Value: value})
+		}
+	}
+	c.mu.Unlock()
+	if len(changed) > 0 {
+		if err := c.send(hapResponse("EVENT/1.0", http.StatusOK, "application/hap+json", hapJSON(map[string]interface{}{"characteristics": changed}))); err != nil {
+			c.Conn.Close() //the controller will reconnect and ask again
+		}
+	}
+}
+
+//hapSendEvents sends events to every verified controller. The connections are written to outside the mutex, so one
+//slow controller doesn't hold up new connections
+func hapSendEvents() {
+	hapConnsMutex.Lock()
+	var conns []*hapConn
+	for c := range hapConns {
+		conns = append(conns, c)
+	}
+	hapConnsMutex.Unlock()
+	for _, c := range conns {
+		if c.Controller() != "" {
+			c.sendEvents()
+		}
+	}
+}
+
+//hapDisconnect closes the connections of a controller which has been unpaired, or every connection if id is ""
+func hapDisconnect(id string) {
+	hapConnsMutex.Lock()
+	defer hapConnsMutex.Unlock()
+	for c := range hapConns {
+		if id == "" || c.Controller() == id {
+			c.Conn.Close()
+		}
+	}
+}
+
+//ListenHAP accepts HomeKit controllers at an address, forever
+func ListenHAP(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveHAP(conn)
+	}
+}
@@ -0,0 +1,718 @@
+package kiwiserver
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+//HomeKitConfig turns on a HomeKit bridge, so the TV and the media PC show up in the Home app and the TV's remote
+//in Control Centre works
+type HomeKitConfig struct {
+	Enabled bool
+	Name    string            //what the bridge is called in the Home app. Empty means "kiwiland"
+	Port    int               //the tcp port HomeKit talks to. 0 means 51826
+	IP      string            //the address to advertise. Empty means the first LAN address found
+	Inputs  map[string]string //the TV inputs to show, by TV command, with their names, eg {"hdmi4": "Toshiba"}. Empty means every input, by command
+}
+
+//name is what the bridge is called
+func (hc HomeKitConfig) name() string {
+	if hc.Name == "" {
+		return "kiwiland"
+	}
+	return hc.Name
+}
+
+//port is the tcp port HomeKit talks to
+func (hc HomeKitConfig) port() int {
+	if hc.Port == 0 {
+		return 51826
+	}
+	return hc.Port
+}
+
+//A HomeKitPairing is a controller, ie an iPhone, iPad, Apple TV or HomePod, which may use the bridge
+type HomeKitPairing struct {
+	ID        string //the controller's pairing ID
+	PublicKey []byte //its ed25519 public key
+	Admin     bool   //whether it may add and remove pairings
+	Paired    time.Time
+}
+
+//A Homekitbridge is the bridge's identity and setup code, and the controllers paired with it
+type Homekitbridge struct {
+	PairingID  string //eg "1A:2B:3C:4D:5E:6F", which the Home app knows the bridge by
+	SetupCode  string //eg "123-45-678", typed into the Home app to pair
+	SetupID    string //four characters that go in the setup URI with the setup code
+	PublicKey  []byte
+	PrivateKey []byte
+
+	ConfigNumber int               //goes up when the accessories change, so controllers fetch them again
+	Layout       string            //a hash of the accessories, to notice when they change
+	Names        map[string]string //names given in the Home app, by "aid.iid" of the name
+	Pairings     []HomeKitPairing
+
+	mu sync.Mutex
+}
+
+var homeKit Homekitbridge
+
+const (
+	homeKitFile = "homekit.json"
+
+	//homeKitCategory is what sort of accessory the bridge says it is, which for a bridge is 2
+	homeKitCategory = 2
+)
+
+var (
+	//errHAPInvalidValue is returned when a controller sets a characteristic to something it can't be
+	errHAPInvalidValue = errors.New("Invalid value")
+
+	//homeKitAnnounce asks for the bridge to be announced again, eg because pairing changed its status
+	homeKitAnnounce = make(chan bool, 1)
+)
+
+//HomeKitEnabled returns true if the bridge is turned on in the config
+func HomeKitEnabled() bool {
+	return currentConfig().HomeKit.Enabled
+}
+
+//makeSetupCode makes a random setup code, avoiding the ones HomeKit won't accept like 111-11-111 and 123-45-678
+func makeSetupCode() (string, error) {
+	for {
+		n, err := rand.Int(rand.Reader, big.NewInt(100000000))
+		if err != nil {
+			return "", err
+		}
+		digits := fmt.Sprintf("%08d", n.Int64())
+		if digits == "12345678" || digits == "87654321" || digits == strings.Repeat(digits[:1], 8) {
+			continue
+		}
+		return digits[:3] + "-" + digits[3:5] + "-" + digits[5:], nil
+	}
+}
+
+//LoadHomeKit will load the bridge from its json file, making a new identity and setup code if there isn't one
+func LoadHomeKit() {
+	homeKit.mu.Lock()
+	defer homeKit.mu.Unlock()
+	homeKitBytes, err := ioutil.ReadFile(homeKitFile)
+	if err == nil {
+		if err := json.Unmarshal(homeKitBytes, &homeKit); err != nil {
+			log.Fatalf("HomeKit file is broken. Fix or delete it (which unpairs everything) and restart program.")
+		}
+	}
+	if homeKit.Names == nil {
+		homeKit.Names = make(map[string]string)
+	}
+	if homeKit.PairingID != "" || !currentConfig().HomeKit.Enabled {
+		return
+	}
+
+	id := make([]byte, 6)
+	setupID := make([]byte, 4)
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err == nil {
+		_, err = rand.Read(id)
+	}
+	if err == nil {
+		_, err = rand.Read(setupID)
+	}
+	if err == nil {
+		homeKit.SetupCode, err = makeSetupCode()
+	}
+	if err != nil {
+		log.Println("Could not make a HomeKit identity:", err.Error())
+		return
+	}
+	homeKit.PairingID = strings.ToUpper(fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", id[0], id[1], id[2], id[3], id[4], id[5]))
+	for i := range setupID {
+		homeKit.SetupID += string("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"[int(setupID[i])%36])
+	}
+	homeKit.PublicKey, homeKit.PrivateKey = public, private
+	homeKit.ConfigNumber = 1
+	saveHomeKit()
+}
+
+//saveHomeKit will write the bridge out to its json file. The mutex must be held
+func saveHomeKit() {
+	homeKitBytes, _ := json.MarshalIndent(&homeKit, "", "\t")
+	if err := ioutil.WriteFile(homeKitFile, homeKitBytes, 0600); err != nil {
+		log.Println("Could not save HomeKit file:", err.Error())
+	}
+}
+
+//announceHomeKit asks for the bridge to be announced again, without waiting
+func announceHomeKit() {
+	select {
+	case homeKitAnnounce <- true:
+	default:
+	}
+}
+
+//Code is the setup code
+func (hk *Homekitbridge) Code() string {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	return hk.SetupCode
+}
+
+//Identity is the bridge's pairing ID and long term keys
+func (hk *Homekitbridge) Identity() (string, ed25519.PublicKey, ed25519.PrivateKey) {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	return hk.PairingID, ed25519.PublicKey(hk.PublicKey), ed25519.PrivateKey(hk.PrivateKey)
+}
+
+//Paired reports whether anything is paired with the bridge
+func (hk *Homekitbridge) Paired() bool {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	return len(hk.Pairings) > 0
+}
+
+//List returns a copy of the paired controllers
+func (hk *Homekitbridge) List() []HomeKitPairing {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	return append([]HomeKitPairing(nil), hk.Pairings...)
+}
+
+//LoadPairing finds a paired controller by its pairing ID
+func (hk *Homekitbridge) LoadPairing(id string) (HomeKitPairing, bool) {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	for _, p := range hk.Pairings {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return HomeKitPairing{}, false
+}
+
+//AddPairing pairs a controller, or changes its permissions if it is already paired
+func (hk *Homekitbridge) AddPairing(id string, publicKey []byte, admin bool) error {
+	if id == "" || len(publicKey) != ed25519.PublicKeySize {
+		return errors.New("Bad pairing")
+	}
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	for i, p := range hk.Pairings {
+		if p.ID == id {
+			hk.Pairings[i].Admin = admin
+			saveHomeKit()
+			return nil
+		}
+	}
+	hk.Pairings = append(hk.Pairings, HomeKitPairing{ID: id, PublicKey: publicKey, Admin: admin, Paired: time.Now()})
+	saveHomeKit()
+	announceHomeKit()
+	return nil
+}
+
+//RemovePairing unpairs a controller. If that leaves no admins, everything is unpaired and true is returned
+func (hk *Homekitbridge) RemovePairing(id string) bool {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	admins := 0
+	for i := 0; i < len(hk.Pairings); i++ {
+		if hk.Pairings[i].ID == id {
+			hk.Pairings = append(hk.Pairings[:i], hk.Pairings[i+1:]...)
+			i--
+		} else if hk.Pairings[i].Admin {
+			admins++
+		}
+	}
+	all := admins == 0
+	if all {
+		hk.Pairings = nil
+	}
+	saveHomeKit()
+	announceHomeKit()
+	return all
+}
+
+//Unpair removes every pairing, so the bridge can be added to a home again
+func (hk *Homekitbridge) Unpair() {
+	hk.mu.Lock()
+	hk.Pairings = nil
+	saveHomeKit()
+	hk.mu.Unlock()
+	hapDisconnect("")
+	announceHomeKit()
+}
+
+//name is a name given in the Home app, or def if it hasn't been renamed
+func (hk *Homekitbridge) name(key string, def string) string {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	if name, ok := hk.Names[key]; ok {
+		return name
+	}
+	return def
+}
+
+//setName remembers a name given in the Home app
+func (hk *Homekitbridge) setName(key string, name string) {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	hk.Names[key] = name
+	saveHomeKit()
+}
+
+//HomeKitSetupCode is the code to type into the Home app
+func HomeKitSetupCode() string {
+	return homeKit.Code()
+}
+
+//HomeKitSetupURI is what the setup QR code holds, eg "X-HM://0023ISYWYABCD". Putting it in any QR code maker gives a
+//code the Home app can scan instead of typing the setup code
+func HomeKitSetupURI() string {
+	homeKit.mu.Lock()
+	defer homeKit.mu.Unlock()
+	code, _ := strconv.ParseUint(strings.Replace(homeKit.SetupCode, "-", "", -1), 10, 64)
+	payload := code | 1<<28 | uint64(homeKitCategory)<<31 //bit 28 says it pairs over IP
+	encoded := strings.ToUpper(strconv.FormatUint(payload, 36))
+	return "X-HM://" + strings.Repeat("0", 9-len(encoded)) + encoded + homeKit.SetupID
+}
+
+//HomeKitPairings lists the paired controllers, for the HomeKit page
+func HomeKitPairings() []HomeKitPairing {
+	return homeKit.List()
+}
+
+//homeKitTXT is the bridge's mdns TXT records, which the Home app reads to find out about it before connecting
+func homeKitTXT() []string {
+	homeKit.mu.Lock()
+	defer homeKit.mu.Unlock()
+	status := "1" //not paired
+	if len(homeKit.Pairings) > 0 {
+		status = "0"
+	}
+	setupHash := sha512.Sum512([]byte(homeKit.SetupID + homeKit.PairingID))
+	return []string{
+		"c#=" + strconv.Itoa(homeKit.ConfigNumber),
+		"ff=0",
+		"id=" + homeKit.PairingID,
+		"md=" + currentConfig().HomeKit.name(),
+		"pv=1.1",
+		"s#=1",
+		"sf=" + status,
+		"ci=" + strconv.Itoa(homeKitCategory),
+		"sh=" + base64.StdEncoding.EncodeToString(setupHash[:4]),
+	}
+}
+
+//A hapCharacteristic is one value of a service, eg whether the TV is on
+type hapCharacteristic struct {
+	iid    int
+	Type   string //Apple's short UUID, eg "B0" for Active
+	Format string
+	events bool                                     //whether controllers can ask to be told when it changes
+	read   func() interface{}                       //nil for write only characteristics
+	write  func(value interface{}, ip string) error //nil for read only characteristics
+	extra  map[string]interface{}                   //eg "maxValue"
+}
+
+//A hapService is a group of characteristics, eg the TV's Television service
+type hapService struct {
+	iid             int
+	Type            string
+	Primary         bool
+	Linked          []int
+	Characteristics []*hapCharacteristic
+}
+
+//A hapAccessory is something shown in the Home app, eg the TV
+type hapAccessory struct {
+	aid      int
+	Services []*hapService
+}
+
+//An accessoryBuilder hands out instance IDs in order as services and characteristics are added. As long as they are
+//added in the same order, each keeps its ID from one start to the next
+type accessoryBuilder struct {
+	accessory *hapAccessory
+	next      int
+}
+
+var (
+	homeKitAccessoriesMutex sync.Mutex
+	homeKitAccessories      []*hapAccessory
+)
+
+//service adds a service to the accessory
+func (b *accessoryBuilder) service(serviceType string) *hapService {
+	s := &hapService{iid: b.next, Type: serviceType}
+	b.next++
+	b.accessory.Services = append(b.accessory.Services, s)
+	return s
+}
+
+//add adds a characteristic to a service
+func (b *accessoryBuilder) add(s *hapService, ch *hapCharacteristic) *hapCharacteristic {
+	ch.iid = b.next
+	b.next++
+	s.Characteristics = append(s.Characteristics, ch)
+	return ch
+}
+
+//constant is a read only characteristic that never changes, eg a manufacturer
+func constant(characteristicType string, format string, value interface{}) *hapCharacteristic {
+	return &hapCharacteristic{Type: characteristicType, Format: format, read: func() interface{} { return value }}
+}
+
+//nameable is a ConfiguredName characteristic, which can be changed in the Home app
+func (b *accessoryBuilder) nameable(s *hapService, def string) {
+	key := strconv.Itoa(b.accessory.aid) + "." + strconv.Itoa(b.next)
+	b.add(s, &hapCharacteristic{Type: "E3", Format: "string", events: true,
+		read: func() interface{} { return homeKit.name(key, def) },
+		write: func(value interface{}, ip string) error {
+			name, ok := value.(string)
+			if !ok {
+				return errHAPInvalidValue
+			}
+			homeKit.setName(key, name)
+			return nil
+		}})
+}
+
+//newAccessory starts an accessory with its AccessoryInformation service
+func newAccessory(aid int, name string, model string) *accessoryBuilder {
+	b := &accessoryBuilder{accessory: &hapAccessory{aid: aid}, next: 1}
+	info := b.service("3E")
+	b.add(info, &hapCharacteristic{Type: "14", Format: "bool", write: func(value interface{}, ip string) error {
+		homeKitIdentify(aid)
+		return nil
+	}})
+	b.add(info, constant("20", "string", "kiwiland"))
+	b.add(info, constant("21", "string", model))
+	b.add(info, constant("23", "string", name))
+	b.add(info, constant("30", "string", homeKit.PairingID+"-"+strconv.Itoa(aid)))
+	b.add(info, constant("52", "string", "1.0.0"))
+	return b
+}
+
+//hapInt reads a number a controller sent, which may come as a bool for bool characteristics
+func hapInt(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case float64:
+		return int(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, errHAPInvalidValue
+}
+
+//homeKitAction runs an action for a controller, recording it as done by homekit
+func homeKitAction(action string, ip string) error {
+	_, err := PerformAction(action, "homekit", ip)
+	return err
+}
+
+//homeKitInputs lists the TV inputs to show, sorted so they keep their identifiers
+func homeKitInputs() []string {
+	cfg := currentConfig()
+	if len(cfg.HomeKit.Inputs) == 0 {
+		return tvInputs()
+	}
+	var inputs []string
+	for input := range cfg.HomeKit.Inputs {
+		inputs = append(inputs, input)
+	}
+	sort.Strings(inputs)
+	return inputs
+}
+
+//homeKitRemoteKeys are the TV remote keys for the RemoteKey characteristic's values
+var homeKitRemoteKeys = map[int]string{
+	0:  "rewind",
+	1:  "fastforward",
+	2:  "next",
+	3:  "previous",
+	4:  "up",
+	5:  "down",
+	6:  "left",
+	7:  "right",
+	8:  "select",
+	9:  "back",
+	10: "back", //exit
+	11: "playpause",
+	15: "info",
+}
+
+//tvAccessory is the TV: a Television service with an input source for each input, and a speaker for the volume
+//buttons in the Control Centre remote
+func tvAccessory() *hapAccessory {
+	b := newAccessory(2, "TV", "TV")
+	inputs := homeKitInputs()
+
+	tv := b.service("D8")
+	tv.Primary = true
+	b.add(tv, &hapCharacteristic{Type: "B0", Format: "uint8", events: true,
+		extra: map[string]interface{}{"minValue": 0, "maxValue": 1},
+		read: func() interface{} {
+			if GetState("tv", EventPower) == "on" {
+				return 1
+			}
+			return 0
+		},
+		write: func(value interface{}, ip string) error {
+			on, err := hapInt(value)
+			if err != nil {
+				return err
+			}
+			if on == 1 {
+				return homeKitAction("tv/poweron", ip)
+			}
+			return homeKitAction("tv/poweroff", ip)
+		}})
+	b.add(tv, &hapCharacteristic{Type: "E7", Format: "uint32", events: true,
+		read: func() interface{} {
+			current := GetState("tv", EventInput)
+			for i, input := range inputs {
+				if input == current {
+					return i + 1
+				}
+			}
+			return 0
+		},
+		write: func(value interface{}, ip string) error {
+			id, err := hapInt(value)
+			if err != nil || id < 1 || id > len(inputs) {
+				return errHAPInvalidValue
+			}
+			return homeKitAction("tv/"+inputs[id-1], ip)
+		}})
+	b.nameable(tv, "TV")
+	b.add(tv, constant("E8", "uint8", 1)) //sleep discovery mode: always discoverable
+	b.add(tv, &hapCharacteristic{Type: "E1", Format: "uint8",
+		write: func(value interface{}, ip string) error {
+			n, err := hapInt(value)
+			key, ok := homeKitRemoteKeys[n]
+			if err != nil || !ok {
+				return errHAPInvalidValue
+			}
+			return homeKitAction("tv/key/"+key, ip)
+		}})
+
+	speaker := b.service("113")
+	b.add(speaker, &hapCharacteristic{Type: "11A", Format: "bool", events: true,
+		read: func() interface{} { return false }, //the TV doesn't say, and mute is a toggle
+		write: func(value interface{}, ip string) error {
+			return homeKitAction("tv/key/mute", ip)
+		}})
+	b.add(speaker, constant("E9", "uint8", 1)) //volume control type: relative, ie buttons
+	b.add(speaker, &hapCharacteristic{Type: "EA", Format: "uint8",
+		write: func(value interface{}, ip string) error {
+			n, err := hapInt(value)
+			switch {
+			case err != nil:
+				return err
+			case n == 0:
+				return homeKitAction("tv/volumeup", ip)
+			}
+			return homeKitAction("tv/volumedown", ip)
+		}})
+	tv.Linked = append(tv.Linked, speaker.iid)
+
+	for i, input := range inputs {
+		name := currentConfig().HomeKit.Inputs[input]
+		if name == "" {
+			name = input
+		}
+		source := b.service("D9")
+		b.nameable(source, name)
+		b.add(source, constant("DB", "uint8", 3)) //input source type: HDMI
+		b.add(source, &hapCharacteristic{Type: "D6", Format: "uint8", events: true,
+			read:  func() interface{} { return 1 },
+			write: func(value interface{}, ip string) error { return nil }}) //is configured, which the Home app sets but kiwiland ignores
+		b.add(source, constant("135", "uint8", 0)) //current visibility state: shown
+		b.add(source, constant("E6", "uint32", i+1))
+		b.add(source, constant("23", "string", name))
+		tv.Linked = append(tv.Linked, source.iid)
+	}
+	return b.accessory
+}
+
+//mediaPCAccessory is the toshiba, as a switch which wakes it and sends it to sleep
+func mediaPCAccessory() *hapAccessory {
+	b := newAccessory(3, "Media PC", "toshiba")
+	sw := b.service("49")
+	sw.Primary = true
+	b.add(sw, &hapCharacteristic{Type: "25", Format: "bool", events: true,
+		read: func() interface{} { return GetState("toshiba", EventOnline) == "online" },
+		write: func(value interface{}, ip string) error {
+			on, err := hapInt(value)
+			if err != nil {
+				return err
+			}
+			if on == 1 {
+				return homeKitAction(wakeAction("toshiba"), ip)
+			}
+			action, err := fixAction(Want{Device: "toshiba", Key: EventOnline, Value: "offline"})
+			if err != nil {
+				return err
+			}
+			return homeKitAction(action, ip)
+		}})
+	b.add(sw, constant("23", "string", "Media PC"))
+	return b.accessory
+}
+
+//buildHomeKitAccessories builds what the bridge shows: itself, the TV and the media PC. If that has changed since last
+//time, the config number goes up so controllers know to fetch it again
+func buildHomeKitAccessories() {
+	b := newAccessory(1, currentConfig().HomeKit.name(), "kiwiland bridge")
+	protocol := b.service("A2")
+	b.add(protocol, constant("37", "string", "1.1.0"))
+	accessories := []*hapAccessory{b.accessory, tvAccessory(), mediaPCAccessory()}
+
+	homeKitAccessoriesMutex.Lock()
+	homeKitAccessories = accessories
+	homeKitAccessoriesMutex.Unlock()
+
+	layout := sha512.New()
+	for _, a := range accessories {
+		for _, s := range a.Services {
+			fmt.Fprintf(layout, "%d.%d %s %v;", a.aid, s.iid, s.Type, s.Linked)
+			for _, ch := range s.Characteristics {
+				fmt.Fprintf(layout, "%d.%d %s;", a.aid, ch.iid, ch.Type)
+			}
+		}
+	}
+	homeKit.mu.Lock()
+	defer homeKit.mu.Unlock()
+	if hash := base64.StdEncoding.EncodeToString(layout.Sum(nil)); hash != homeKit.Layout {
+		if homeKit.Layout != "" {
+			homeKit.ConfigNumber++
+		}
+		homeKit.Layout = hash
+		saveHomeKit()
+	}
+}
+
+//homeKitCharacteristic finds a characteristic by its accessory and instance IDs
+func homeKitCharacteristic(aid int, iid int) *hapCharacteristic {
+	homeKitAccessoriesMutex.Lock()
+	defer homeKitAccessoriesMutex.Unlock()
+	for _, a := range homeKitAccessories {
+		if a.aid != aid {
+			continue
+		}
+		for _, s := range a.Services {
+			for _, ch := range s.Characteristics {
+				if ch.iid == iid {
+					return ch
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//homeKitAccessoriesJSON is the accessory database, as a controller reads it from /accessories
+func homeKitAccessoriesJSON(c *hapConn) []interface{} {
+	homeKitAccessoriesMutex.Lock()
+	accessories := homeKitAccessories
+	homeKitAccessoriesMutex.Unlock()
+
+	var list []interface{}
+	for _, a := range accessories {
+		var services []interface{}
+		for _, s := range a.Services {
+			var characteristics []interface{}
+			for _, ch := range s.Characteristics {
+				m := map[string]interface{}{"iid": ch.iid, "type": ch.Type, "format": ch.Format}
+				perms := []string{}
+				if ch.read != nil {
+					perms = append(perms, "pr")
+					m["value"] = ch.read()
+				}
+				if ch.write != nil {
+					perms = append(perms, "pw")
+				}
+				if ch.events {
+					perms = append(perms, "ev")
+					c.mu.Lock()
+					_, subscribed := c.events[[2]int{a.aid, ch.iid}]
+					c.mu.Unlock()
+					m["ev"] = subscribed
+				}
+				m["perms"] = perms
+				for k, v := range ch.extra {
+					m[k] = v
+				}
+				characteristics = append(characteristics, m)
+			}
+			service := map[string]interface{}{"iid": s.iid, "type": s.Type, "characteristics": characteristics}
+			if s.Primary {
+				service["primary"] = true
+			}
+			if len(s.Linked) > 0 {
+				service["linked"] = s.Linked
+			}
+			services = append(services, service)
+		}
+		list = append(list, map[string]interface{}{"aid": a.aid, "services": services})
+	}
+	return list
+}
+
+//homeKitIdentify is what an accessory does when the Home app asks it to identify itself. The TV puts up a message
+func homeKitIdentify(aid int) {
+	log.Printf("HomeKit: identify accessory %d", aid)
+	if aid == 2 {
+		TVShowMessage("kiwiland")
+	}
+}
+
+//RunHomeKit runs the HomeKit bridge, if it is turned on: advertising it, accepting controllers and telling them when
+//the TV or media PC changes, forever
+func RunHomeKit() {
+	cfg := currentConfig()
+	if !cfg.HomeKit.Enabled {
+		return
+	}
+	buildHomeKitAccessories()
+
+	ip := cfg.HomeKit.IP
+	if ip == "" {
+		ip = LANIP()
+	}
+	service := mdnsService{Instance: cfg.HomeKit.name(), Service: "_hap._tcp", Host: "kiwiland", Port: cfg.HomeKit.port(), TXT: homeKitTXT}
+	go AdvertiseMDNS(service, ip, homeKitAnnounce)
+
+	go func() {
+		events := Subscribe()
+		for e := range events {
+			switch e.Type {
+			case EventPower, EventInput, EventOnline:
+				hapSendEvents()
+			}
+		}
+	}()
+
+	address := ":" + strconv.Itoa(cfg.HomeKit.port())
+	log.Println("HomeKit bridge running at " + address + ", pair it from the HomeKit page")
+	if err := ListenHAP(address); err != nil {
+		log.Println("HomeKit bridge:", err.Error())
+	}
+}
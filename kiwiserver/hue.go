@@ -0,0 +1,631 @@
+package kiwiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//HueConfig turns on a pretend Philips Hue bridge, so smart speakers on the LAN can switch the TV, devices and scenes
+//as if they were lights, eg "turn on movie", without a cloud skill
+type HueConfig struct {
+	Enabled bool
+	Address string //host:port to serve the bridge on. Empty means ":80", the only port Echo devices look at
+	IP      string //the address to tell speakers to use. Empty means the first LAN address found
+	AnyUser bool   //accept any username, for speakers (like Echos) which talk to the bridge without pairing first
+}
+
+//address is where the bridge is served
+func (hc HueConfig) address() string {
+	if hc.Address == "" {
+		return ":80"
+	}
+	return hc.Address
+}
+
+//A HueUser is a speaker or app paired with the bridge by pressing the link button
+type HueUser struct {
+	ID         string //the start of the username, which is safe to show
+	Username   string
+	DeviceType string //what the speaker called itself when pairing, eg "Echo#kitchen"
+	Created    time.Time
+}
+
+//A HueLight is something kiwiland shows the speakers as a light
+type HueLight struct {
+	ID   string //the bridge's number for it, which stays the same so speakers don't lose it
+	Key  string //what it switches: "tv", a device name or "scenes/<name>"
+	Name string
+	On   string //the action that turns it on
+	Off  string //the action that turns it off, or "" if it can't be. Scenes can always be "turned off", which does nothing
+}
+
+//A Huebridge is the paired users and the light numbers given out so far
+type Huebridge struct {
+	Users  []HueUser
+	Lights map[string]string //light ID to Key
+
+	mu        sync.Mutex
+	linkUntil time.Time         //the "link button" is pressed until then
+	asked     map[string]hueAsk //what each light was last asked to be, by Key
+	ids       map[string]string //Key to light ID
+}
+
+//A hueAsk is what a speaker last asked a light to be
+type hueAsk struct {
+	On   bool
+	Time time.Time
+}
+
+var hue Huebridge
+
+const (
+	hueFile = "hue.json"
+
+	//hueLinkWindow is how long the link button stays pressed
+	hueLinkWindow = time.Minute
+	//hueSettle is how long a light shows what it was asked to be, rather than what kiwiland last saw, while the
+	//action runs. Speakers check straight after asking, and the TV or a wake takes a while to notice
+	hueSettle = 30 * time.Second
+
+	hueSSDPAddress     = "239.255.255.250:1900"
+	hueSSDPMaxAge      = 100
+	hueDescriptionPath = "/description.xml"
+
+	//what the bridge says it is. Speakers check these look like a real second generation bridge
+	hueSoftwareVersion = "1941132080"
+	hueAPIVersion      = "1.41.0"
+	hueModelID         = "BSB002"
+	hueLightModelID    = "LOM001"
+	hueLightType       = "On/Off plug-in unit"
+)
+
+//Hue API error types
+const (
+	hueErrUnauthorized  = 1
+	hueErrBadJSON       = 2
+	hueErrNotFound      = 3
+	hueErrLinkButton    = 101
+	hueErrNotModifiable = 201
+)
+
+//hueSearchTargets are the SSDP search targets the bridge answers to
+var hueSearchTargets = []string{"upnp:rootdevice", "urn:schemas-upnp-org:device:basic:1"}
+
+//HueEnabled returns true if the bridge is turned on in the config
+func HueEnabled() bool {
+	return currentConfig().Hue.Enabled
+}
+
+//LoadHue will load the paired users and light numbers from their json file
+func LoadHue() {
+	hue.mu.Lock()
+	defer hue.mu.Unlock()
+	hue.Lights = make(map[string]string)
+	hue.asked = make(map[string]hueAsk)
+	hueBytes, err := ioutil.ReadFile(hueFile)
+	if err == nil {
+		if err := json.Unmarshal(hueBytes, &hue); err != nil {
+			log.Println("Hue file is broken, starting again:", err.Error())
+		}
+	}
+	if hue.Lights == nil {
+		hue.Lights = make(map[string]string)
+	}
+	hue.ids = make(map[string]string)
+	for id, key := range hue.Lights {
+		hue.ids[key] = id
+	}
+}
+
+//saveHue will write the paired users and light numbers out to their json file. The mutex must be held
+func saveHue() {
+	hueBytes, _ := json.MarshalIndent(&hue, "", "\t")
+	if err := ioutil.WriteFile(hueFile, hueBytes, 0600); err != nil {
+		log.Println("Could not save hue file:", err.Error())
+	}
+}
+
+//lightID gives a light its number, handing out the next one if it hasn't got one yet. The mutex must be held
+func (hb *Huebridge) lightID(key string) string {
+	if id, ok := hb.ids[key]; ok {
+		return id
+	}
+	next := 1
+	for id := range hb.Lights {
+		if n, err := strconv.Atoi(id); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	id := strconv.Itoa(next)
+	hb.Lights[id] = key
+	hb.ids[key] = id
+	saveHue()
+	return id
+}
+
+//HueLights lists what the bridge shows as lights: the TV, every device and every scene
+func HueLights() []HueLight {
+	lights := []HueLight{{Key: "tv", Name: "TV", On: "tv/poweron", Off: "tv/poweroff"}}
+	for _, d := range devices.List() {
+		if d.Name == "tv" {
+			continue
+		}
+		off, _ := fixAction(Want{Device: d.Name, Key: EventOnline, Value: "offline"})
+		lights = append(lights, HueLight{Key: d.Name, Name: d.Name, On: "devices/" + d.Name + "/wake", Off: off})
+	}
+	for _, s := range currentConfig().Scenes {
+		lights = append(lights, HueLight{Key: "scenes/" + s.Name, Name: s.Name, On: "scenes/" + s.Name + "/run"})
+	}
+
+	hue.mu.Lock()
+	defer hue.mu.Unlock()
+	for i := range lights {
+		lights[i].ID = hue.lightID(lights[i].Key)
+	}
+	return lights
+}
+
+//LoadHueLight finds a light by its number
+func LoadHueLight(id string) (HueLight, error) {
+	for _, l := range HueLights() {
+		if l.ID == id {
+			return l, nil
+		}
+	}
+	return HueLight{}, errors.New("Light not found")
+}
+
+//IsOn reports whether a light is on: what it was just asked to be, or otherwise the TV's power or a device being
+//online. Scenes are on from being run until they are turned off
+func (l HueLight) IsOn() bool {
+	hue.mu.Lock()
+	ask, asked := hue.asked[l.Key]
+	hue.mu.Unlock()
+	switch {
+	case strings.HasPrefix(l.Key, "scenes/"):
+		return ask.On
+	case asked && time.Since(ask.Time) < hueSettle:
+		return ask.On
+	case l.Key == "tv":
+		return GetState("tv", EventPower) == "on"
+	}
+	return GetState(l.Key, EventOnline) == "online"
+}
+
+//SwitchHueLight runs the action to turn a light on or off, in the background as speakers don't wait long for
+//an answer
+func SwitchHueLight(l HueLight, on bool, ip string) error {
+	action := l.On
+	if !on {
+		action = l.Off
+	}
+	if action == "" && !strings.HasPrefix(l.Key, "scenes/") {
+		return errors.New("kiwiland can't turn " + l.Name + " off")
+	}
+	hue.mu.Lock()
+	hue.asked[l.Key] = hueAsk{On: on, Time: time.Now()}
+	hue.mu.Unlock()
+	if action != "" {
+		go func() {
+			if _, err := PerformAction(action, "hue", ip); err != nil {
+				log.Printf("Hue: %s failed: %s", action, err.Error())
+			}
+		}()
+	}
+	return nil
+}
+
+//PressHueLinkButton lets speakers pair with the bridge for the next minute
+func PressHueLinkButton() {
+	hue.mu.Lock()
+	hue.linkUntil = time.Now().Add(hueLinkWindow)
+	hue.mu.Unlock()
+}
+
+//HueLinkButtonPressed reports whether speakers can pair at the moment
+func HueLinkButtonPressed() bool {
+	hue.mu.Lock()
+	defer hue.mu.Unlock()
+	return time.Now().Before(hue.linkUntil)
+}
+
+//HueUsers returns a copy of the paired users
+func HueUsers() []HueUser {
+	hue.mu.Lock()
+	defer hue.mu.Unlock()
+	return append([]HueUser(nil), hue.Users...)
+}
+
+//pairHueUser adds a user, if the link button is pressed
+func pairHueUser(deviceType string) (HueUser, error) {
+	hue.mu.Lock()
+	defer hue.mu.Unlock()
+	if !time.Now().Before(hue.linkUntil) && !currentConfig().Hue.AnyUser {
+		return HueUser{}, errors.New("link button not pressed")
+	}
+	username, err := GenerateValidationKey()
+	if err != nil {
+		return HueUser{}, err
+	}
+	u := HueUser{ID: username[:8], Username: username, DeviceType: deviceType, Created: time.Now()}
+	hue.Users = append(hue.Users, u)
+	saveHue()
+	return u, nil
+}
+
+//RemoveHueUser unpairs a user by their ID
+func RemoveHueUser(id string) (HueUser, error) {
+	hue.mu.Lock()
+	defer hue.mu.Unlock()
+	for i, u := range hue.Users {
+		if u.ID == id {
+			hue.Users = append(hue.Users[:i], hue.Users[i+1:]...)
+			saveHue()
+			return u, nil
+		}
+	}
+	return HueUser{}, errors.New("Hue user not found")
+}
+
+//hueUserAllowed reports whether a username may use the bridge
+func hueUserAllowed(username string) bool {
+	if currentConfig().Hue.AnyUser {
+		return true
+	}
+	hue.mu.Lock()
+	defer hue.mu.Unlock()
+	for _, u := range hue.Users {
+		if u.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+//hueIP is the address speakers should use for the bridge
+func hueIP() string {
+	cfg := currentConfig()
+	if cfg.Hue.IP != "" {
+		return cfg.Hue.IP
+	}
+	return LANIP()
+}
+
+//hueMAC is the MAC address of the interface the bridge is advertised on, which its ids are made from
+func hueMAC() net.HardwareAddr {
+	ip := net.ParseIP(hueIP())
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) && len(iface.HardwareAddr) == 6 {
+				return iface.HardwareAddr
+			}
+		}
+	}
+	return net.HardwareAddr{0x02, 0x6b, 0x69, 0x77, 0x69, 0x00} //made up, but the same every time
+}
+
+//HueBridgeID is the bridge's id, made from its MAC address the same way a real bridge's is, eg "B827EBFFFE123456"
+func HueBridgeID() string {
+	mac := strings.ToUpper(strings.Replace(hueMAC().String(), ":", "", -1))
+	return mac[:6] + "FFFE" + mac[6:]
+}
+
+//hueSerial is the bridge's serial number, its MAC address without the colons
+func hueSerial() string {
+	return strings.Replace(hueMAC().String(), ":", "", -1)
+}
+
+//hueUDN is the bridge's UPnP unique device name, which real bridges make from their serial number like this
+func hueUDN() string {
+	return "uuid:2f402f80-da50-11e1-9b23-" + hueSerial()
+}
+
+//HueLocation is where speakers find the bridge's description, eg "http://192.168.2.10:80/description.xml"
+func HueLocation() string {
+	_, port, err := net.SplitHostPort(currentConfig().Hue.address())
+	if err != nil || port == "" {
+		port = "80"
+	}
+	return "http://" + net.JoinHostPort(hueIP(), port) + hueDescriptionPath
+}
+
+//hueDescription is the UPnP description of the bridge, which speakers read after finding it with SSDP
+func hueDescription() string {
+	base := strings.TrimSuffix(HueLocation(), strings.TrimPrefix(hueDescriptionPath, "/"))
+	return `<?xml version="1.0" encoding="UTF-8" ?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<URLBase>` + base + `</URLBase>
+<device>
+<deviceType>urn:schemas-upnp-org:device:Basic:1</deviceType>
+<friendlyName>kiwiland (` + hueIP() + `)</friendlyName>
+<manufacturer>Royal Philips Electronics</manufacturer>
+<manufacturerURL>http://www.philips.com</manufacturerURL>
+<modelDescription>Philips hue Personal Wireless Lighting</modelDescription>
+<modelName>Philips hue bridge 2015</modelName>
+<modelNumber>` + hueModelID + `</modelNumber>
+<modelURL>http://www.meethue.com</modelURL>
+<serialNumber>` + hueSerial() + `</serialNumber>
+<UDN>` + hueUDN() + `</UDN>
+<presentationURL>index.html</presentationURL>
+</device>
+</root>
+`
+}
+
+//ssdpResponse answers an SSDP search for the search target st
+func ssdpResponse(st string) string {
+	usn := hueUDN()
+	if st != usn {
+		usn += "::" + st
+	}
+	return "HTTP/1.1 200 OK\r\n" +
+		"CACHE-CONTROL: max-age=" + strconv.Itoa(hueSSDPMaxAge) + "\r\n" +
+		"EXT:\r\n" +
+		"LOCATION: " + HueLocation() + "\r\n" +
+		"SERVER: Linux/3.14.0 UPnP/1.0 IpBridge/" + hueAPIVersion + "\r\n" +
+		"hue-bridgeid: " + HueBridgeID() + "\r\n" +
+		"ST: " + st + "\r\n" +
+		"USN: " + usn + "\r\n\r\n"
+}
+
+//ssdpSearchTargets works out which search targets an SSDP M-SEARCH wants answers for, if it is looking for us at all
+func ssdpSearchTargets(packet string) []string {
+	lines := strings.Split(packet, "\r\n")
+	if !strings.HasPrefix(lines[0], "M-SEARCH ") {
+		return nil
+	}
+	for _, line := range lines[1:] {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || !strings.EqualFold(strings.TrimSpace(parts[0]), "ST") {
+			continue
+		}
+		st := strings.TrimSpace(parts[1])
+		if st == "ssdp:all" {
+			return hueSearchTargets
+		}
+		for _, target := range append(hueSearchTargets, hueUDN()) {
+			if strings.EqualFold(st, target) {
+				return []string{st}
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+//listenHueSSDP answers SSDP searches for the bridge, forever
+func listenHueSSDP() {
+	group, _ := net.ResolveUDPAddr("udp4", hueSSDPAddress)
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		log.Println("Hue SSDP:", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Println("Hue SSDP:", err.Error())
+			return
+		}
+		for _, st := range ssdpSearchTargets(string(buf[:n])) {
+			conn.WriteToUDP([]byte(ssdpResponse(st)), from)
+		}
+	}
+}
+
+//hueError is the body of a Hue API error
+func hueError(errorType int, address string, description string) []map[string]interface{} {
+	return []map[string]interface{}{{"error": map[string]interface{}{"type": errorType, "address": address, "description": description}}}
+}
+
+//hueLightJSON is how the Hue API shows a light
+func hueLightJSON(l HueLight) map[string]interface{} {
+	id, _ := strconv.Atoi(l.ID)
+	return map[string]interface{}{
+		"state": map[string]interface{}{
+			"on":        l.IsOn(),
+			"alert":     "none",
+			"mode":      "homeautomation",
+			"reachable": true,
+		},
+		"type":             hueLightType,
+		"name":             l.Name,
+		"modelid":          hueLightModelID,
+		"manufacturername": "kiwiland",
+		"productname":      "kiwiland " + l.Key,
+		"uniqueid":         fmt.Sprintf("00:17:88:01:00:%02x:%02x:%02x-0b", id>>16&0xff, id>>8&0xff, id&0xff),
+		"swversion":        "1.0",
+	}
+}
+
+//hueLightsJSON is how the Hue API shows every light, by number
+func hueLightsJSON() map[string]interface{} {
+	lights := make(map[string]interface{})
+	for _, l := range HueLights() {
+		lights[l.ID] = hueLightJSON(l)
+	}
+	return lights
+}
+
+//hueConfigJSON is the bridge's config. Without a username, only the public part is shown
+func hueConfigJSON(full bool) map[string]interface{} {
+	c := map[string]interface{}{
+		"name":             "kiwiland",
+		"datastoreversion": "98",
+		"swversion":        hueSoftwareVersion,
+		"apiversion":       hueAPIVersion,
+		"mac":              hueMAC().String(),
+		"bridgeid":         HueBridgeID(),
+		"factorynew":       false,
+		"replacesbridgeid": nil,
+		"modelid":          hueModelID,
+		"starterkitid":     "",
+	}
+	if full {
+		c["ipaddress"] = hueIP()
+		c["dhcp"] = true
+		c["linkbutton"] = HueLinkButtonPressed()
+		c["portalservices"] = false
+		c["UTC"] = time.Now().UTC().Format("2006-01-02T15:04:05")
+		c["localtime"] = time.Now().Format("2006-01-02T15:04:05")
+		whitelist := make(map[string]interface{})
+		for _, u := range HueUsers() {
+			whitelist[u.Username] = map[string]interface{}{"name": u.DeviceType, "create date": u.Created.UTC().Format("2006-01-02T15:04:05")}
+		}
+		c["whitelist"] = whitelist
+	}
+	return c
+}
+
+//writeHueJSON writes a Hue API response
+func writeHueJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	respBytes, _ := json.Marshal(v)
+	w.Write(respBytes)
+}
+
+//ServeHue serves the part of the Hue bridge API speakers use: pairing, the config, and listing and switching lights
+func ServeHue(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == hueDescriptionPath {
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(hueDescription()))
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "api" {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != http.MethodPost {
+			writeHueJSON(w, hueError(hueErrNotFound, "/", "resource, /, not available"))
+			return
+		}
+		var body struct {
+			DeviceType string `json:"devicetype"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeHueJSON(w, hueError(hueErrBadJSON, "", "body contains invalid json"))
+			return
+		}
+		u, err := pairHueUser(body.DeviceType)
+		if err != nil {
+			writeHueJSON(w, hueError(hueErrLinkButton, "", err.Error()))
+			return
+		}
+		log.Printf("Hue: paired %s from %s", body.DeviceType, clientIP(r.RemoteAddr))
+		writeHueJSON(w, []map[string]interface{}{{"success": map[string]string{"username": u.Username}}})
+		return
+	}
+
+	username, resource := parts[1], parts[2:]
+	if (len(resource) == 0 && username == "config") || (len(resource) == 1 && resource[0] == "config" && !hueUserAllowed(username)) {
+		//anyone may see the public part of the config, which is how apps check it is a bridge
+		writeHueJSON(w, hueConfigJSON(false))
+		return
+	}
+	if !hueUserAllowed(username) {
+		writeHueJSON(w, hueError(hueErrUnauthorized, "/"+strings.Join(resource, "/"), "unauthorized user"))
+		return
+	}
+
+	address := "/" + strings.Join(resource, "/")
+	switch {
+	case len(resource) == 0:
+		writeHueJSON(w, map[string]interface{}{
+			"lights":        hueLightsJSON(),
+			"groups":        map[string]interface{}{},
+			"config":        hueConfigJSON(true),
+			"schedules":     map[string]interface{}{},
+			"scenes":        map[string]interface{}{},
+			"rules":         map[string]interface{}{},
+			"sensors":       map[string]interface{}{},
+			"resourcelinks": map[string]interface{}{},
+		})
+	case address == "/config":
+		writeHueJSON(w, hueConfigJSON(true))
+	case address == "/lights":
+		writeHueJSON(w, hueLightsJSON())
+	case address == "/groups" || address == "/scenes" || address == "/sensors" || address == "/schedules" || address == "/rules":
+		writeHueJSON(w, map[string]interface{}{})
+	case len(resource) == 2 && resource[0] == "lights" && r.Method == http.MethodGet:
+		l, err := LoadHueLight(resource[1])
+		if err != nil {
+			writeHueJSON(w, hueError(hueErrNotFound, address, "resource, "+address+", not available"))
+			return
+		}
+		writeHueJSON(w, hueLightJSON(l))
+	case len(resource) == 3 && resource[0] == "lights" && resource[2] == "state" && r.Method == http.MethodPut:
+		l, err := LoadHueLight(resource[1])
+		if err != nil {
+			writeHueJSON(w, hueError(hueErrNotFound, address, "resource, "+address+", not available"))
+			return
+		}
+		var state map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			writeHueJSON(w, hueError(hueErrBadJSON, address, "body contains invalid json"))
+			return
+		}
+		writeHueJSON(w, switchHueState(l, state, address, clientIP(r.RemoteAddr)))
+	default:
+		writeHueJSON(w, hueError(hueErrNotFound, address, "resource, "+address+", not available"))
+	}
+}
+
+//switchHueState does what a PUT to a light's state asks. Only "on" does anything; brightness and colour are
+//accepted and ignored, so speakers don't complain when asked to dim the TV
+func switchHueState(l HueLight, state map[string]interface{}, address string, ip string) []map[string]interface{} {
+	var keys []string
+	for key := range state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var results []map[string]interface{}
+	for _, key := range keys {
+		value := state[key]
+		if key == "on" {
+			on, ok := value.(bool)
+			if !ok {
+				results = append(results, hueError(hueErrBadJSON, address+"/on", "invalid value, "+fmt.Sprint(value)+", for parameter, on")...)
+				continue
+			}
+			if err := SwitchHueLight(l, on, ip); err != nil {
+				results = append(results, hueError(hueErrNotModifiable, address+"/on", err.Error())...)
+				continue
+			}
+		}
+		results = append(results, map[string]interface{}{"success": map[string]interface{}{address + "/" + key: value}})
+	}
+	return results
+}
+
+//RunHue serves the pretend Hue bridge and answers searches for it, forever, if it is turned on
+func RunHue() {
+	cfg := currentConfig()
+	if !cfg.Hue.Enabled {
+		return
+	}
+	go listenHueSSDP()
+	log.Println("Hue bridge running at " + cfg.Hue.address() + ", advertised as " + HueLocation())
+	if err := http.ListenAndServe(cfg.Hue.address(), http.HandlerFunc(ServeHue)); err != nil {
+		log.Println("Hue bridge:", err.Error())
+	}
+}
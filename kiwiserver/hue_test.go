@@ -0,0 +1,268 @@
+package kiwiserver
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+//inTempDir runs a test in a directory of its own, so the json files kiwiland saves don't end up in the source tree
+func inTempDir(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+}
+
+//changeConfig changes the config for a test, and puts it back afterwards. Actions the test started may still be reading
+//it, so it is changed under the mutex
+func changeConfig(t *testing.T, change func(c *Config)) {
+	configMutex.Lock()
+	old := config
+	change(&config)
+	configMutex.Unlock()
+	t.Cleanup(func() {
+		configMutex.Lock()
+		config = old
+		configMutex.Unlock()
+	})
+}
+
+//setupHue starts a bridge with the TV, a nas and a movie scene, which only waits so it is safe to run
+func setupHue(t *testing.T) {
+	inTempDir(t)
+	changeConfig(t, func(c *Config) {
+		c.Hue = HueConfig{Enabled: true, IP: "192.168.2.10", Address: ":8080"}
+		c.Scenes = []Scene{{Name: "movie", Steps: []SceneStep{{Action: "wait"}}}}
+	})
+	devices.Devices = []Device{{Name: "nas", MAC: "00:11:22:33:44:55"}}
+	t.Cleanup(func() {
+		devices.Devices = nil
+		hue.mu.Lock()
+		hue.Users = nil
+		hue.linkUntil = time.Time{}
+		hue.mu.Unlock()
+	})
+	LoadHue()
+}
+
+//serveHue makes a request to the bridge and decodes its json answer
+func serveHue(t *testing.T, method string, path string, body string) interface{} {
+	rec := httptest.NewRecorder()
+	ServeHue(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	var v interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("%s %s answered %q: %s", method, path, rec.Body.String(), err.Error())
+	}
+	return v
+}
+
+//hueErrorType picks the error type out of a Hue API answer, or 0 if it isn't an error
+func hueErrorType(v interface{}) int {
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		return 0
+	}
+	e, ok := list[0].(map[string]interface{})["error"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	return int(e["type"].(float64))
+}
+
+func TestSSDPSearchTargets(t *testing.T) {
+	setupHue(t)
+	search := func(st string) string {
+		return "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\nST: " + st + "\r\n\r\n"
+	}
+	tests := []struct {
+		packet  string
+		targets []string
+	}{
+		{search("ssdp:all"), hueSearchTargets},
+		{search("upnp:rootdevice"), []string{"upnp:rootdevice"}},
+		{search("urn:schemas-upnp-org:device:basic:1"), []string{"urn:schemas-upnp-org:device:basic:1"}},
+		{search(hueUDN()), []string{hueUDN()}},
+		{search("urn:dial-multiscreen-org:service:dial:1"), nil},
+		{"NOTIFY * HTTP/1.1\r\nNT: upnp:rootdevice\r\n\r\n", nil},
+		{"M-SEARCH * HTTP/1.1\r\nMX: 2\r\n\r\n", nil},
+	}
+	for _, test := range tests {
+		got := ssdpSearchTargets(test.packet)
+		if strings.Join(got, ",") != strings.Join(test.targets, ",") {
+			t.Errorf("%q was answered for %v, want %v", test.packet, got, test.targets)
+		}
+	}
+}
+
+func TestSSDPResponse(t *testing.T) {
+	setupHue(t)
+	resp := ssdpResponse("upnp:rootdevice")
+	if !strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(resp, "\r\n\r\n") {
+		t.Errorf("response isn't an http response: %q", resp)
+	}
+	for _, line := range []string{
+		"LOCATION: http://192.168.2.10:8080/description.xml",
+		"ST: upnp:rootdevice",
+		"USN: " + hueUDN() + "::upnp:rootdevice",
+		"hue-bridgeid: " + HueBridgeID(),
+	} {
+		if !strings.Contains(resp, "\r\n"+line+"\r\n") {
+			t.Errorf("response is missing %q: %q", line, resp)
+		}
+	}
+	if resp := ssdpResponse(hueUDN()); !strings.Contains(resp, "\r\nUSN: "+hueUDN()+"\r\n") {
+		t.Errorf("a search for the UDN should be answered with the bare UDN: %q", resp)
+	}
+	if id := HueBridgeID(); len(id) != 16 || id[6:10] != "FFFE" {
+		t.Errorf("bridge id %s doesn't look like a real bridge's", id)
+	}
+}
+
+func TestHueLinkButton(t *testing.T) {
+	setupHue(t)
+	if got := hueErrorType(serveHue(t, "POST", "/api", `{"devicetype":"Echo#kitchen"}`)); got != hueErrLinkButton {
+		t.Fatalf("pairing without the link button gave error type %d, want %d", got, hueErrLinkButton)
+	}
+
+	PressHueLinkButton()
+	if !HueLinkButtonPressed() {
+		t.Fatal("link button isn't pressed after pressing it")
+	}
+	resp, ok := serveHue(t, "POST", "/api", `{"devicetype":"Echo#kitchen"}`).([]interface{})
+	if !ok || len(resp) != 1 {
+		t.Fatalf("pairing answered %v", resp)
+	}
+	success, _ := resp[0].(map[string]interface{})["success"].(map[string]interface{})
+	username, _ := success["username"].(string)
+	if username == "" || !hueUserAllowed(username) {
+		t.Fatalf("pairing answered %v, and the user can't use the bridge", resp)
+	}
+	if users := HueUsers(); len(users) != 1 || users[0].DeviceType != "Echo#kitchen" {
+		t.Errorf("paired users are %v", users)
+	}
+	if _, ok := serveHue(t, "GET", "/api/"+username+"/lights", "").(map[string]interface{}); !ok {
+		t.Error("a paired user can't list the lights")
+	}
+	if got := hueErrorType(serveHue(t, "GET", "/api/somebodyelse/lights", "")); got != hueErrUnauthorized {
+		t.Errorf("an unpaired user listing the lights gave error type %d, want %d", got, hueErrUnauthorized)
+	}
+
+	//the button lets go after hueLinkWindow
+	hue.mu.Lock()
+	hue.linkUntil = time.Now().Add(-time.Second)
+	hue.mu.Unlock()
+	if HueLinkButtonPressed() {
+		t.Error("link button is still pressed after its window")
+	}
+	if got := hueErrorType(serveHue(t, "POST", "/api", `{"devicetype":"Echo#lounge"}`)); got != hueErrLinkButton {
+		t.Errorf("pairing after the window gave error type %d, want %d", got, hueErrLinkButton)
+	}
+	if len(HueUsers()) != 1 {
+		t.Error("a user was paired after the window")
+	}
+}
+
+func TestHueLights(t *testing.T) {
+	setupHue(t)
+	want := map[string][2]string{
+		"tv":           {"tv/poweron", "tv/poweroff"},
+		"nas":          {"devices/nas/wake", ""},
+		"scenes/movie": {"scenes/movie/run", ""},
+	}
+	lights := HueLights()
+	if len(lights) != len(want) {
+		t.Fatalf("lights are %v", lights)
+	}
+	for _, l := range lights {
+		if actions, ok := want[l.Key]; !ok || l.On != actions[0] || l.Off != actions[1] {
+			t.Errorf("light %s turns on with %q and off with %q", l.Key, l.On, l.Off)
+		}
+	}
+
+	//numbers stay the same when something before them goes
+	ids := make(map[string]string)
+	for _, l := range lights {
+		ids[l.Key] = l.ID
+	}
+	devices.Devices = nil
+	for _, l := range HueLights() {
+		if l.ID != ids[l.Key] {
+			t.Errorf("light %s was %s and is now %s", l.Key, ids[l.Key], l.ID)
+		}
+	}
+}
+
+func TestHueStatePut(t *testing.T) {
+	setupHue(t)
+	changeConfig(t, func(c *Config) { c.Hue.AnyUser = true })
+	ids := make(map[string]string)
+	for _, l := range HueLights() {
+		ids[l.Key] = l.ID
+	}
+	put := func(key string, body string) []interface{} {
+		resp, _ := serveHue(t, "PUT", "/api/anyone/lights/"+ids[key]+"/state", body).([]interface{})
+		return resp
+	}
+
+	//turning a scene on runs it, as the hue user
+	if resp := put("scenes/movie", `{"on":true,"bri":254}`); len(resp) != 2 || hueErrorType(resp) != 0 {
+		t.Fatalf("turning the scene on answered %v", resp)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(AuditLog(AuditFilter{User: "hue", Action: "scenes/movie/run"})) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("turning the scene on didn't run it")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	l, _ := LoadHueLight(ids["scenes/movie"])
+	if !l.IsOn() {
+		t.Error("the scene isn't on after turning it on")
+	}
+
+	//turning a scene off does nothing, but works
+	if resp := put("scenes/movie", `{"on":false}`); hueErrorType(resp) != 0 {
+		t.Errorf("turning the scene off answered %v", resp)
+	}
+	if l.IsOn() {
+		t.Error("the scene is still on after turning it off")
+	}
+
+	//a device that can't be turned off says so
+	if got := hueErrorType(put("nas", `{"on":false}`)); got != hueErrNotModifiable {
+		t.Errorf("turning the nas off gave error type %d, want %d", got, hueErrNotModifiable)
+	}
+	if got := hueErrorType(put("nas", `{"on":"yes"}`)); got != hueErrBadJSON {
+		t.Errorf("a bad on gave error type %d, want %d", got, hueErrBadJSON)
+	}
+	if got := hueErrorType(serveHue(t, "PUT", "/api/anyone/lights/99/state", `{"on":true}`)); got != hueErrNotFound {
+		t.Errorf("switching a missing light gave error type %d, want %d", got, hueErrNotFound)
+	}
+	if got := hueErrorType(put("nas", `{"on":`)); got != hueErrBadJSON {
+		t.Errorf("broken json gave error type %d, want %d", got, hueErrBadJSON)
+	}
+
+	//the TV shows what it was asked to be until it settles, then what kiwiland saw
+	tv, _ := LoadHueLight(ids["tv"])
+	hue.mu.Lock()
+	hue.asked["tv"] = hueAsk{On: true, Time: time.Now()}
+	hue.mu.Unlock()
+	if !tv.IsOn() {
+		t.Error("the TV isn't on straight after asking")
+	}
+	hue.mu.Lock()
+	hue.asked["tv"] = hueAsk{On: true, Time: time.Now().Add(-hueSettle)}
+	hue.mu.Unlock()
+	SetState("tv", EventPower, "standby", SourceObserved)
+	if tv.IsOn() {
+		t.Error("the TV is still on after settling in standby")
+	}
+}
@@ -0,0 +1,180 @@
+package kiwiserver
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//IdleConfig controls turning the TV off when nobody seems to be using it
+type IdleConfig struct {
+	Hours float64 //turn the TV off after this many hours without activity. 0 disables idle standby
+
+	//quiet hours, eg overnight, can have a shorter threshold
+	QuietAfter  string  //"HH:MM"
+	QuietBefore string  //"HH:MM". If QuietBefore is earlier than QuietAfter the window wraps midnight
+	QuietHours  float64 //the threshold during quiet hours. 0 means use Hours
+
+	WarningMinutes int //how long the warning is on the TV before it turns off. 0 means 2 minutes
+}
+
+//threshold is how long the TV may be idle at a time of day, or 0 if idle standby is off then
+func (ic IdleConfig) threshold(t time.Time) time.Duration {
+	hours := ic.Hours
+	if ic.QuietHours > 0 && (ic.QuietAfter != "" || ic.QuietBefore != "") && inTimeWindow(t, ic.QuietAfter, ic.QuietBefore) {
+		hours = ic.QuietHours
+	}
+	return time.Duration(hours * float64(time.Hour))
+}
+
+//warning is how long the warning is on the TV before it turns off
+func (ic IdleConfig) warning() time.Duration {
+	if ic.WarningMinutes <= 0 {
+		return 2 * time.Minute
+	}
+	return time.Duration(ic.WarningMinutes) * time.Minute
+}
+
+//IdleStatus is what the home page shows about idle standby
+type IdleStatus struct {
+	Enabled      bool
+	Threshold    time.Duration //the current threshold, which depends on quiet hours
+	LastActivity time.Time
+	Activity     string //what the last activity was, eg "tv/poweron"
+	KeepOnUntil  time.Time
+	Warned       bool //the warning is on the TV now
+}
+
+//KeptOn reports whether "keep on tonight" is in force
+func (is IdleStatus) KeptOn() bool {
+	return time.Now().Before(is.KeepOnUntil)
+}
+
+//Idle is how long it has been since the last activity, to the minute
+func (is IdleStatus) Idle() time.Duration {
+	return time.Since(is.LastActivity).Truncate(time.Minute)
+}
+
+var (
+	idleMutex        sync.Mutex
+	idleLastActivity = time.Now() //so a restart doesn't turn the TV straight off
+	idleActivity     = "kiwiland started"
+	idleKeepOnUntil  time.Time
+	idleWarned       time.Time //zero unless the warning is on the TV
+)
+
+//keepOnMorning is when "keep on tonight" runs out
+const keepOnMorning = 6
+
+//noteActivity records that someone is using the TV
+func noteActivity(what string) {
+	idleMutex.Lock()
+	idleLastActivity = time.Now()
+	idleActivity = what
+	idleWarned = time.Time{}
+	idleMutex.Unlock()
+}
+
+//CurrentIdleStatus returns the state of idle standby
+func CurrentIdleStatus() IdleStatus {
+	cfg := currentConfig()
+	idleMutex.Lock()
+	defer idleMutex.Unlock()
+	return IdleStatus{
+		Enabled:      cfg.Idle.Hours > 0 || cfg.Idle.QuietHours > 0,
+		Threshold:    cfg.Idle.threshold(time.Now()),
+		LastActivity: idleLastActivity,
+		Activity:     idleActivity,
+		KeepOnUntil:  idleKeepOnUntil,
+		Warned:       !idleWarned.IsZero(),
+	}
+}
+
+//KeepTVOnTonight stops idle standby turning the TV off until the next morning
+func KeepTVOnTonight() time.Time {
+	now := time.Now()
+	until := time.Date(now.Year(), now.Month(), now.Day(), keepOnMorning, 0, 0, 0, now.Location())
+	if !until.After(now) {
+		until = until.AddDate(0, 0, 1)
+	}
+	idleMutex.Lock()
+	idleKeepOnUntil = until
+	idleWarned = time.Time{}
+	idleMutex.Unlock()
+	return until
+}
+
+//ResumeIdleStandby cancels "keep on tonight"
+func ResumeIdleStandby() {
+	idleMutex.Lock()
+	idleKeepOnUntil = time.Time{}
+	idleMutex.Unlock()
+}
+
+//checkIdle warns, then turns the TV off, if it has been idle for too long
+func checkIdle(now time.Time) {
+	cfg := currentConfig()
+	threshold := cfg.Idle.threshold(now)
+	idleMutex.Lock()
+	if threshold <= 0 || GetState("tv", EventPower) != "on" || now.Before(idleKeepOnUntil) || now.Sub(idleLastActivity) < threshold {
+		idleWarned = time.Time{}
+		idleMutex.Unlock()
+		return
+	}
+	if idleWarned.IsZero() {
+		idleWarned = now
+		idleMutex.Unlock()
+		minutes := strconv.Itoa(int(cfg.Idle.warning().Minutes()))
+		if _, err := TVShowMessage("Idle: off " + minutes + "m"); err != nil {
+			log.Println("Idle standby warning failed:", err.Error())
+		}
+		return
+	}
+	if now.Sub(idleWarned) < cfg.Idle.warning() {
+		idleMutex.Unlock()
+		return
+	}
+	idleWarned = time.Time{}
+	idle := now.Sub(idleLastActivity).Truncate(time.Minute)
+	idleMutex.Unlock()
+
+	log.Printf("TV idle for %s, turning it off", idle)
+	if _, err := PerformAction("tv/poweroff", "idle standby", ""); err != nil {
+		log.Println("Idle standby could not turn the TV off:", err.Error())
+	}
+}
+
+//pollAgentIdle asks the kiwiagent whether someone has used the toshiba's keyboard or mouse since the last poll
+func pollAgentIdle() {
+	cfg := currentConfig()
+	if !AgentEnabled() || cfg.Idle.threshold(time.Now()) <= 0 {
+		return
+	}
+	idle, err := agent().Idle()
+	if err != nil {
+		return //the toshiba is probably asleep
+	}
+	if idle < cfg.Monitor.pollInterval() {
+		Publish(Event{Type: EventActivity, Device: "toshiba", Value: "input"})
+	}
+}
+
+//RunIdle watches for activity and checks the TV for idleness every minute, forever
+func RunIdle() {
+	events := Subscribe()
+	for e := range events {
+		switch {
+		case e.Type == EventTime:
+			checkIdle(e.Time)
+		case e.Type == EventAction:
+			noteActivity(e.Value)
+		case e.Type == EventRemoteKey:
+			noteActivity("remote key " + e.Value)
+		case e.Type == EventActivity:
+			noteActivity(e.Device + " " + e.Value)
+		case e.Type == EventPower && e.Device == "tv" && e.Value == "on":
+			noteActivity("TV turned on")
+		}
+	}
+}
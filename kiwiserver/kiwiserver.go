@@ -12,15 +12,17 @@ import (
 )
 
 var (
-	users Userlist
-	store *sessions.CookieStore
+	users   Userlist
+	devices Devicelist
+	store   *sessions.CookieStore
 
-	templates = template.Must(template.New("").Funcs(funcMap).ParseGlob("./media/templates/*")) //this initializes the template engine
-	decoder   = schema.NewDecoder()                                                             //this initializes the schema (HTML form decoding) engine
+	templates *template.Template    //parsed when the server starts, from ./media/templates
+	decoder   = schema.NewDecoder() //this initializes the schema (HTML form decoding) engine
 )
 
-//StartServer will start a kiwiserver listening at the given address and with the provided cookie store salt
-func StartServer(serverAddress string, cookieStoreSalt string) {
+//StartServer will start a kiwiserver listening at the given address and with the provided cookie store salt. If
+//adminSocket isn't empty it also listens there, on a unix socket that signs everything in
+func StartServer(serverAddress string, cookieStoreSalt string, adminSocket string) {
 	// pass, err := bcrypt.GenerateFromPassword([]byte("testing1+"), 10)
 	// if err != nil {
 	// 	panic("something's wrong with bcrypt")
@@ -28,13 +30,38 @@ func StartServer(serverAddress string, cookieStoreSalt string) {
 	//log.Printf("Password: '%s'", pass)
 
 	LoadUsers()
+	LoadConfig()
+	LoadDevices()
+	LoadSchedules()
+	LoadSleepTimer()
+	LoadAudit()
+	LoadScreenTime()
+	LoadQueue()
+	LoadHue()
+	LoadHomeKit()
 
+	templates = template.Must(template.New("").Funcs(funcMap).ParseGlob("./media/templates/*")) //this initializes the template engine
 	decoder.RegisterConverter(false, ConvertBool)
 
 	store = sessions.NewCookieStore([]byte(cookieStoreSalt))
 
 	router := initRouter()
 
+	go RunScheduler()
+	go RunRules()
+	go RunIdle()
+	go RunScreenTime()
+	go RunQueue()
+	go RunMQTT()
+	go RunLive()
+	go RunWebhooks()
+	go RunMonitor()
+	go RunHue()
+	go RunHomeKit()
+	if adminSocket != "" {
+		go RunAdminSocket(adminSocket, router)
+	}
+
 	log.Println("Server running at " + serverAddress)
 	if err := http.ListenAndServe(serverAddress, router); err != nil {
 		log.Println("Error:", err.Error())
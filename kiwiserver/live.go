@@ -0,0 +1,131 @@
+package kiwiserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//A LiveMessage is something to show straight away on open pages, sent over the live updates stream
+type LiveMessage struct {
+	Type   string //one of the LiveXxxx constants
+	Time   time.Time
+	Text   string //a sentence for people, eg "alice: tv/poweroff"
+	Device string `json:",omitempty"`
+	Key    string `json:",omitempty"`
+	Value  string `json:",omitempty"`
+	Action string `json:",omitempty"`
+	User   string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+//LiveXxxx are the types of LiveMessage
+const (
+	LiveState        = "state"        //part of a device's state changed. Device, Key and Value say what it is now
+	LiveAction       = "action"       //an action started, or finished, when User is set too
+	LiveNotification = "notification" //anything else worth telling people, eg a scene's progress
+)
+
+//livePing is how often an idle stream gets a comment, so proxies don't close it
+const livePing = 30 * time.Second
+
+var (
+	liveMutex       sync.Mutex
+	liveSubscribers = make(map[chan LiveMessage]bool)
+)
+
+//SubscribeLive returns a channel which receives every live message from now on. Unsubscribe it when done
+func SubscribeLive() chan LiveMessage {
+	ch := make(chan LiveMessage, 64)
+	liveMutex.Lock()
+	liveSubscribers[ch] = true
+	liveMutex.Unlock()
+	return ch
+}
+
+//UnsubscribeLive stops and closes a channel from SubscribeLive
+func UnsubscribeLive(ch chan LiveMessage) {
+	liveMutex.Lock()
+	if liveSubscribers[ch] {
+		delete(liveSubscribers, ch)
+		close(ch)
+	}
+	liveMutex.Unlock()
+}
+
+//PublishLive sends a message to every open page. Slow pages miss messages rather than hold everyone else up
+func PublishLive(m LiveMessage) {
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	liveMutex.Lock()
+	defer liveMutex.Unlock()
+	for ch := range liveSubscribers {
+		select {
+		case ch <- m:
+		default:
+		}
+	}
+}
+
+//writeLive writes a message as a server-sent event, named after its type
+func writeLive(w io.Writer, m LiveMessage) error {
+	messageBytes, _ := json.Marshal(m)
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", m.Type, messageBytes)
+	return err
+}
+
+//liveActionDone tells open pages an action has finished, and who it was for. The output isn't sent, as for most
+//actions it is cec-client or agent chatter only the person who asked wants
+func liveActionDone(action string, user string, err error) {
+	m := LiveMessage{Type: LiveAction, Action: action, User: user, Text: user + ": " + action + " done"}
+	if err != nil {
+		m.Error = err.Error()
+		m.Text = user + ": " + action + " failed: " + err.Error()
+	}
+	PublishLive(m)
+}
+
+//liveSceneStep tells open pages how a scene is getting on
+func liveSceneStep(scene string, step int, steps int, result StepResult) {
+	text := scene + ": step " + strconv.Itoa(step) + "/" + strconv.Itoa(steps) + " " + result.Step.Action
+	if result.Error != "" {
+		text += " failed: " + result.Error
+	} else {
+		text += " ok"
+	}
+	PublishLive(LiveMessage{Type: LiveNotification, Text: text, Error: result.Error})
+}
+
+//liveStateText describes a state change for people, eg "TV turned off" or "nas is online"
+func liveStateText(e Event) string {
+	switch {
+	case e.Device == "tv" && e.Type == EventPower && e.Value == "on":
+		return "TV turned on"
+	case e.Device == "tv" && e.Type == EventPower && e.Value == "standby":
+		return "TV turned off"
+	case e.Device == "tv" && e.Type == EventInput:
+		return "TV switched to " + e.Value
+	}
+	return e.Device + " is " + e.Value
+}
+
+//RunLive passes state changes and actions starting from the events to open pages, forever
+func RunLive() {
+	events := Subscribe()
+	for e := range events {
+		switch e.Type {
+		case EventPower, EventInput, EventOnline:
+			text := liveStateText(e)
+			if e.Source == SourceObserved {
+				text += " (not by kiwiland)"
+			}
+			PublishLive(LiveMessage{Type: LiveState, Time: e.Time, Device: e.Device, Key: e.Type, Value: e.Value, Text: text})
+		case EventAction:
+			PublishLive(LiveMessage{Type: LiveAction, Time: e.Time, Action: e.Value, Text: "Running " + e.Value})
+		}
+	}
+}
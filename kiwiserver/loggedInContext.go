@@ -1,7 +1,11 @@
 package kiwiserver
 
 import (
+	"encoding/json"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/gocraft/web"
 )
@@ -11,6 +15,11 @@ type LoggedInContext struct {
 	*Context
 }
 
+//audit records something the signed in user did, which isn't an action, in the audit log
+func (c *LoggedInContext) audit(req *web.Request, action string, output string, err error) {
+	Audit(c.actor(), requestIP(req.Request), action, output, err, 0)
+}
+
 //SignOutRequestHandler performs the logout request
 func (c *LoggedInContext) SignOutRequestHandler(rw web.ResponseWriter, req *web.Request) {
 	session, _ := c.Store.Get(req.Request, "session-security")
@@ -31,32 +40,32 @@ func (c *LoggedInContext) GetTVCommandHandler(rw web.ResponseWriter, req *web.Re
 		return
 	}
 
-	var cresp string
-	var err error
-
-	switch command {
-	case "powerstatus":
-		cresp, err = TVGetStatus()
-	case "poweron":
-		cresp, err = TVTurnOn()
-	case "poweroff":
-		cresp, err = TVTurnOff()
-	case "hdmi4":
-		cresp, err = TVSelectHDMI4()
-	case "hdmi2":
-		cresp, err = TVSelectHDMI2()
-	case "hdmi1":
-		cresp, err = TVSelectHDMI1()
-	case "volumeup":
-		cresp, err = TVVolumeUp()
-	case "volumedown":
-		cresp, err = TVVolumeDown()
-	default:
+	if _, ok := TVCommands[command]; !ok {
 		//unknown command
 		http.Error(rw, "400: Bad tv command: "+command, http.StatusBadRequest)
 		return
 	}
 
+	cresp, err := c.perform(req, "tv/"+command)
+
+	c.SetNotificationMessage(rw, req, cresp)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	}
+
+	http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusFound)
+}
+
+//GetTVKeyHandler presses a button on the TV's remote
+func (c *LoggedInContext) GetTVKeyHandler(rw web.ResponseWriter, req *web.Request) {
+	key := req.PathParams["key"]
+	if _, ok := TVRemoteKeys[key]; !ok {
+		http.Error(rw, "400: Bad tv key: "+key, http.StatusBadRequest)
+		return
+	}
+
+	cresp, err := c.perform(req, "tv/key/"+key)
+
 	c.SetNotificationMessage(rw, req, cresp)
 	if err != nil {
 		c.SetErrorMessage(rw, req, err.Error())
@@ -73,18 +82,484 @@ func (c *LoggedInContext) GetToshibaCommandHandler(rw web.ResponseWriter, req *w
 		return
 	}
 
-	var cresp string
-	var err error
-
-	switch command {
-	case "wol":
-		cresp, err = ToshibaWOL()
-	default:
+	if _, ok := ToshibaCommands[command]; !ok {
 		//unknown command
 		http.Error(rw, "400: Bad toshiba command: "+command, http.StatusBadRequest)
 		return
 	}
 
+	cresp, err := c.perform(req, "toshiba/"+command)
+
+	c.SetNotificationMessage(rw, req, cresp)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	}
+
+	http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusFound)
+}
+
+//GetToshibaLaunchHandler asks the kiwiagent on the toshiba laptop to start an application
+func (c *LoggedInContext) GetToshibaLaunchHandler(rw web.ResponseWriter, req *web.Request) {
+	application, ok := req.PathParams["application"]
+	if !ok {
+		http.Error(rw, "400: Application not provided", http.StatusBadRequest)
+		return
+	}
+
+	cresp, err := c.perform(req, "toshiba/launch/"+application)
+
+	c.SetNotificationMessage(rw, req, cresp)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	}
+
+	http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusFound)
+}
+
+//GetDiscoverHandler shows the hosts in the neighbour table so they can be added as devices.
+//If the sweep parameter is set the local subnets are swept first to fill the table
+func (c *LoggedInContext) GetDiscoverHandler(rw web.ResponseWriter, req *web.Request) {
+	hosts, err := DiscoverHosts(req.URL.Query().Get("sweep") != "")
+	if err != nil {
+		c.ErrorMessages = append(c.ErrorMessages, err.Error())
+	}
+	c.Data = hosts
+
+	err = templates.ExecuteTemplate(rw, "discoverPage", c)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//PostDeviceHandler adds a device to the devicelist
+func (c *LoggedInContext) PostDeviceHandler(rw web.ResponseWriter, req *web.Request) {
+	req.ParseForm()
+
+	var d Device
+	if err := decoder.Decode(&d, req.PostForm); err != nil {
+		c.SetErrorMessage(rw, req, "Decoding error: "+err.Error())
+		http.Redirect(rw, req.Request, DiscoverURL.Make(), http.StatusSeeOther)
+		return
+	}
+
+	err := devices.AddDevice(d)
+	c.audit(req, "devices/"+d.Name+"/add", d.MAC, err)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, DiscoverURL.Make(), http.StatusSeeOther)
+		return
+	}
+
+	c.SetNotificationMessage(rw, req, "Added device "+d.Name)
+	http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusFound)
+}
+
+//GetDeviceWakeHandler wakes a device from the devicelist
+func (c *LoggedInContext) GetDeviceWakeHandler(rw web.ResponseWriter, req *web.Request) {
+	cresp, err := c.perform(req, "devices/"+req.PathParams["device"]+"/wake")
+
+	c.SetNotificationMessage(rw, req, cresp)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	}
+
+	http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusFound)
+}
+
+//GetDeviceRemoveHandler removes a device from the devicelist
+func (c *LoggedInContext) GetDeviceRemoveHandler(rw web.ResponseWriter, req *web.Request) {
+	name := req.PathParams["device"]
+	err := devices.RemoveDevice(name)
+	c.audit(req, "devices/"+name+"/remove", "", err)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	} else {
+		c.SetNotificationMessage(rw, req, "Removed device "+name)
+	}
+
+	http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusFound)
+}
+
+//WakeRequestForm is used when users wake a MAC address that might not be in the devicelist
+type WakeRequestForm struct {
+	MAC  string
+	Save bool
+	Name string
+}
+
+//PostWakeMACHandler wakes whatever MAC address was typed in, and adds it to the devicelist if asked
+func (c *LoggedInContext) PostWakeMACHandler(rw web.ResponseWriter, req *web.Request) {
+	req.ParseForm()
+
+	var prop WakeRequestForm
+	if err := decoder.Decode(&prop, req.PostForm); err != nil {
+		c.SetErrorMessage(rw, req, "Decoding error: "+err.Error())
+		http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusSeeOther)
+		return
+	}
+
+	mac, err := ParseMAC(prop.MAC)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusSeeOther)
+		return
+	}
+
+	start := time.Now()
+	cresp, err := WakeOnLAN(mac)
+	Audit(c.actor(), requestIP(req.Request), "wake/"+mac, cresp, err, time.Since(start))
+	c.SetNotificationMessage(rw, req, cresp)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	}
+
+	if prop.Save {
+		if err := devices.AddDevice(Device{Name: prop.Name, MAC: mac}); err != nil {
+			c.SetErrorMessage(rw, req, "Not saved: "+err.Error())
+		} else {
+			c.SetNotificationMessage(rw, req, "Added device "+prop.Name)
+		}
+	}
+
+	http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusFound)
+}
+
+//GetSceneRunHandler starts a scene in the background and shows its progress
+func (c *LoggedInContext) GetSceneRunHandler(rw web.ResponseWriter, req *web.Request) {
+	name := req.PathParams["scene"]
+	err := c.allowed("scenes/" + name + "/run")
+	if err == nil {
+		err = StartScene(name)
+	}
+	c.audit(req, "scenes/"+name+"/run", "started", err)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(rw, req.Request, SceneURL.Make("scene", name), http.StatusFound)
+}
+
+//GetSceneHandler shows the latest run of a scene
+func (c *LoggedInContext) GetSceneHandler(rw web.ResponseWriter, req *web.Request) {
+	name := req.PathParams["scene"]
+	if _, err := LoadScene(name); err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusSeeOther)
+		return
+	}
+
+	run, ok := LastSceneRun(name)
+	if !ok {
+		run.Scene = name
+	}
+	c.Data = run
+
+	err := templates.ExecuteTemplate(rw, "scenePage", c)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//GetStateApplyHandler starts applying a desired state in the background and shows its progress
+func (c *LoggedInContext) GetStateApplyHandler(rw web.ResponseWriter, req *web.Request) {
+	name := req.PathParams["state"]
+	err := c.allowed("states/" + name + "/apply")
+	if err == nil {
+		err = StartDesiredState(name)
+	}
+	c.audit(req, "states/"+name+"/apply", "started", err)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(rw, req.Request, StateURL.Make("state", name), http.StatusFound)
+}
+
+//GetStateHandler shows the latest reconciliation of a desired state
+func (c *LoggedInContext) GetStateHandler(rw web.ResponseWriter, req *web.Request) {
+	name := req.PathParams["state"]
+	if _, err := LoadDesiredState(name); err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusSeeOther)
+		return
+	}
+
+	r, ok := LastReconciliation(name)
+	if !ok {
+		r.State = name
+	}
+	c.Data = r
+
+	err := templates.ExecuteTemplate(rw, "statePage", c)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//GetSchedulesHandler shows the schedules and a form to add one
+func (c *LoggedInContext) GetSchedulesHandler(rw web.ResponseWriter, req *web.Request) {
+	c.Data = schedules.List()
+
+	err := templates.ExecuteTemplate(rw, "schedulesPage", c)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//ScheduleRequestForm is used when users are adding a schedule
+type ScheduleRequestForm struct {
+	Name    string
+	Action  string
+	Cron    string
+	At      string //from a datetime-local input, eg 2006-01-02T15:04
+	CatchUp string
+}
+
+//PostScheduleHandler adds a schedule
+func (c *LoggedInContext) PostScheduleHandler(rw web.ResponseWriter, req *web.Request) {
+	req.ParseForm()
+
+	var prop ScheduleRequestForm
+	if err := decoder.Decode(&prop, req.PostForm); err != nil {
+		c.SetErrorMessage(rw, req, "Decoding error: "+err.Error())
+		http.Redirect(rw, req.Request, SchedulesURL.Make(), http.StatusSeeOther)
+		return
+	}
+
+	s := Schedule{Name: prop.Name, Action: prop.Action, Cron: prop.Cron, CatchUp: prop.CatchUp}
+	if prop.Cron == "" {
+		at, err := time.ParseInLocation("2006-01-02T15:04", prop.At, time.Local)
+		if err != nil {
+			c.SetErrorMessage(rw, req, "Give either a cron expression or a time to run once")
+			http.Redirect(rw, req.Request, SchedulesURL.Make(), http.StatusSeeOther)
+			return
+		}
+		s.At = at
+	}
+
+	err := schedules.AddSchedule(s)
+	c.audit(req, "schedules/add", s.Name+": "+s.Action, err)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	} else {
+		c.SetNotificationMessage(rw, req, "Added schedule "+s.Name)
+	}
+	http.Redirect(rw, req.Request, SchedulesURL.Make(), http.StatusSeeOther)
+}
+
+//GetSchedulePauseHandler pauses or resumes a schedule
+func (c *LoggedInContext) GetSchedulePauseHandler(rw web.ResponseWriter, req *web.Request) {
+	s, err := schedules.TogglePaused(req.PathParams["schedule"])
+	c.audit(req, "schedules/"+req.PathParams["schedule"]+"/pause", s.Name, err)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	} else if s.Paused {
+		c.SetNotificationMessage(rw, req, "Paused schedule "+s.Name)
+	} else {
+		c.SetNotificationMessage(rw, req, "Resumed schedule "+s.Name)
+	}
+	http.Redirect(rw, req.Request, SchedulesURL.Make(), http.StatusFound)
+}
+
+//GetScheduleRemoveHandler deletes a schedule
+func (c *LoggedInContext) GetScheduleRemoveHandler(rw web.ResponseWriter, req *web.Request) {
+	err := schedules.RemoveSchedule(req.PathParams["schedule"])
+	c.audit(req, "schedules/"+req.PathParams["schedule"]+"/remove", "", err)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	} else {
+		c.SetNotificationMessage(rw, req, "Deleted schedule")
+	}
+	http.Redirect(rw, req.Request, SchedulesURL.Make(), http.StatusFound)
+}
+
+//GetQueueHandler shows the queued commands and a form to queue one
+func (c *LoggedInContext) GetQueueHandler(rw web.ResponseWriter, req *web.Request) {
+	c.Data = queue.List()
+
+	err := templates.ExecuteTemplate(rw, "queuePage", c)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//QueueRequestForm is used when users are queueing a command
+type QueueRequestForm struct {
+	Action  string
+	Wake    bool
+	Minutes int
+}
+
+//PostQueueHandler queues a command until its device is ready
+func (c *LoggedInContext) PostQueueHandler(rw web.ResponseWriter, req *web.Request) {
+	req.ParseForm()
+
+	var prop QueueRequestForm
+	if err := decoder.Decode(&prop, req.PostForm); err != nil {
+		c.SetErrorMessage(rw, req, "Decoding error: "+err.Error())
+		http.Redirect(rw, req.Request, QueueURL.Make(), http.StatusSeeOther)
+		return
+	}
+
+	q, err := queue.QueueAction(prop.Action, prop.Wake, prop.Minutes, c.actor(), requestIP(req.Request))
+	c.audit(req, "queue/add", prop.Action, err)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	} else {
+		c.SetNotificationMessage(rw, req, "Queued "+q.Action+" until "+q.Device+" is ready")
+	}
+	http.Redirect(rw, req.Request, QueueURL.Make(), http.StatusSeeOther)
+}
+
+//GetQueueCancelHandler cancels a queued command
+func (c *LoggedInContext) GetQueueCancelHandler(rw web.ResponseWriter, req *web.Request) {
+	err := queue.CancelCommand(req.PathParams["command"])
+	c.audit(req, "queue/"+req.PathParams["command"]+"/cancel", "", err)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	} else {
+		c.SetNotificationMessage(rw, req, "Cancelled queued command")
+	}
+	http.Redirect(rw, req.Request, QueueURL.Make(), http.StatusFound)
+}
+
+//SleepTimerRequestForm is used when users set the sleep timer
+type SleepTimerRequestForm struct {
+	Minutes      int
+	SleepToshiba bool
+	Warn         bool
+}
+
+//PostSleepTimerHandler sets the sleep timer
+func (c *LoggedInContext) PostSleepTimerHandler(rw web.ResponseWriter, req *web.Request) {
+	req.ParseForm()
+
+	var prop SleepTimerRequestForm
+	if err := decoder.Decode(&prop, req.PostForm); err != nil {
+		c.SetErrorMessage(rw, req, "Decoding error: "+err.Error())
+		http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusSeeOther)
+		return
+	}
+
+	err := SetSleepTimer(prop.Minutes, prop.SleepToshiba, prop.Warn)
+	c.audit(req, "sleeptimer/set", strconv.Itoa(prop.Minutes)+" minutes", err)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	} else {
+		c.SetNotificationMessage(rw, req, "TV will turn off in "+strconv.Itoa(prop.Minutes)+" minutes")
+	}
+	http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusFound)
+}
+
+//GetSleepTimerExtendHandler adds some minutes to the sleep timer
+func (c *LoggedInContext) GetSleepTimerExtendHandler(rw web.ResponseWriter, req *web.Request) {
+	minutes, err := strconv.Atoi(req.PathParams["minutes"])
+	if err != nil {
+		http.Error(rw, "400: Bad number of minutes", http.StatusBadRequest)
+		return
+	}
+
+	err = ExtendSleepTimer(minutes)
+	c.audit(req, "sleeptimer/extend", strconv.Itoa(minutes)+" minutes", err)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	} else {
+		c.SetNotificationMessage(rw, req, "Sleep timer extended by "+strconv.Itoa(minutes)+" minutes")
+	}
+	http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusFound)
+}
+
+//GetSleepTimerCancelHandler cancels the sleep timer
+func (c *LoggedInContext) GetSleepTimerCancelHandler(rw web.ResponseWriter, req *web.Request) {
+	err := CancelSleepTimer()
+	c.audit(req, "sleeptimer/cancel", "", err)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	} else {
+		c.SetNotificationMessage(rw, req, "Sleep timer cancelled")
+	}
+	http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusFound)
+}
+
+//GetRulesHandler shows the rules and the log of why they did or didn't fire
+func (c *LoggedInContext) GetRulesHandler(rw web.ResponseWriter, req *web.Request) {
+	c.Data = RuleLog()
+
+	err := templates.ExecuteTemplate(rw, "rulesPage", c)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//AuditPage is what the audit page shows
+type AuditPage struct {
+	Query   url.Values //the filter, as it was given, to fill the form back in
+	Entries []AuditEntry
+	More    int //how many more entries matched than are shown
+}
+
+//auditPageSize is how many entries the audit page shows. Exports have everything
+const auditPageSize = 500
+
+//GetAuditHandler shows the audit log, filtered by the query parameters
+func (c *LoggedInContext) GetAuditHandler(rw web.ResponseWriter, req *web.Request) {
+	query := req.URL.Query()
+	f, err := ParseAuditFilter(query)
+	if err != nil {
+		c.ErrorMessages = append(c.ErrorMessages, err.Error())
+	}
+	page := AuditPage{Query: query, Entries: AuditLog(f)}
+	if len(page.Entries) > auditPageSize {
+		page.More = len(page.Entries) - auditPageSize
+		page.Entries = page.Entries[:auditPageSize]
+	}
+	c.Data = page
+
+	err = templates.ExecuteTemplate(rw, "auditPage", c)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//GetAuditExportHandler downloads the audit log, filtered by the query parameters, as csv or json
+func (c *LoggedInContext) GetAuditExportHandler(rw web.ResponseWriter, req *web.Request) {
+	f, err := ParseAuditFilter(req.URL.Query())
+	if err != nil {
+		http.Error(rw, "400: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries := AuditLog(f)
+
+	filename := "kiwiland-audit-" + time.Now().Format("2006-01-02")
+	switch req.PathParams["format"] {
+	case "csv":
+		rw.Header().Set("Content-Type", "text/csv")
+		rw.Header().Set("Content-Disposition", "attachment; filename="+filename+".csv")
+		WriteAuditCSV(rw, entries)
+	case "json":
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Content-Disposition", "attachment; filename="+filename+".json")
+		json.NewEncoder(rw).Encode(entries)
+	default:
+		http.Error(rw, "400: Bad export format: "+req.PathParams["format"], http.StatusBadRequest)
+	}
+}
+
+//GetRestoreHandler puts a device back how it was before the last thing kiwiland did to it
+func (c *LoggedInContext) GetRestoreHandler(rw web.ResponseWriter, req *web.Request) {
+	cresp, err := c.perform(req, "restore/"+req.PathParams["device"])
+
 	c.SetNotificationMessage(rw, req, cresp)
 	if err != nil {
 		c.SetErrorMessage(rw, req, err.Error())
@@ -93,6 +568,250 @@ func (c *LoggedInContext) GetToshibaCommandHandler(rw web.ResponseWriter, req *w
 	http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusFound)
 }
 
+//ScreenTimePage is what the screen time page shows
+type ScreenTimePage struct {
+	Period string //"day" or "week"
+	Report ScreenTimeReport
+	Prev   time.Time
+	Next   time.Time
+}
+
+//GetScreenTimeHandler shows how much the TV was on for a day or a week
+func (c *LoggedInContext) GetScreenTimeHandler(rw web.ResponseWriter, req *web.Request) {
+	page := ScreenTimePage{Period: req.URL.Query().Get("period")}
+	date := time.Now()
+	if d := req.URL.Query().Get("date"); d != "" {
+		var err error
+		if date, err = time.ParseInLocation("2006-01-02", d, time.Local); err != nil {
+			http.Error(rw, "400: Bad date: "+d, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if page.Period == "week" {
+		date = date.AddDate(0, 0, -((int(date.Weekday()) + 6) % 7)) //back to monday
+		page.Report = ScreenTime(date, 7)
+		page.Prev, page.Next = date.AddDate(0, 0, -7), date.AddDate(0, 0, 7)
+	} else {
+		page.Period = "day"
+		page.Report = ScreenTime(date, 1)
+		page.Prev, page.Next = date.AddDate(0, 0, -1), date.AddDate(0, 0, 1)
+	}
+	c.Data = page
+
+	err := templates.ExecuteTemplate(rw, "screenTimePage", c)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//GetIdleKeepOnHandler stops idle standby turning the TV off tonight
+func (c *LoggedInContext) GetIdleKeepOnHandler(rw web.ResponseWriter, req *web.Request) {
+	until := KeepTVOnTonight()
+	c.audit(req, "idle/keepon", "until "+until.Format("15:04 Monday"), nil)
+	c.SetNotificationMessage(rw, req, "TV will stay on until "+until.Format("15:04 Monday"))
+	http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusFound)
+}
+
+//GetIdleResumeHandler lets idle standby turn the TV off again
+func (c *LoggedInContext) GetIdleResumeHandler(rw web.ResponseWriter, req *web.Request) {
+	ResumeIdleStandby()
+	c.audit(req, "idle/resume", "", nil)
+	c.SetNotificationMessage(rw, req, "Idle standby resumed")
+	http.Redirect(rw, req.Request, HomeURL.Make(), http.StatusFound)
+}
+
+//GetWebhooksHandler shows the webhooks and their delivery log
+func (c *LoggedInContext) GetWebhooksHandler(rw web.ResponseWriter, req *web.Request) {
+	c.Data = WebhookLog()
+
+	err := templates.ExecuteTemplate(rw, "webhooksPage", c)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//GetWebhookTestHandler sends a webhook a test event
+func (c *LoggedInContext) GetWebhookTestHandler(rw web.ResponseWriter, req *web.Request) {
+	name := req.PathParams["webhook"]
+	err := SendTestWebhook(name)
+	c.audit(req, "webhooks/"+name+"/test", "", err)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	} else {
+		c.SetNotificationMessage(rw, req, "Sending a test event to "+name)
+	}
+	http.Redirect(rw, req.Request, WebhooksURL.Make(), http.StatusFound)
+}
+
+//GetHueHandler shows the pretend hue bridge: its lights, the speakers paired with it and its link button
+func (c *LoggedInContext) GetHueHandler(rw web.ResponseWriter, req *web.Request) {
+	err := templates.ExecuteTemplate(rw, "huePage", c)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//GetHueLinkHandler presses the hue bridge's link button, so a speaker or app can pair
+func (c *LoggedInContext) GetHueLinkHandler(rw web.ResponseWriter, req *web.Request) {
+	PressHueLinkButton()
+	c.audit(req, "hue/link", "", nil)
+	c.SetNotificationMessage(rw, req, "Link button pressed. Pair speakers in the next minute")
+	http.Redirect(rw, req.Request, HueURL.Make(), http.StatusFound)
+}
+
+//GetHueUserRemoveHandler unpairs a speaker from the hue bridge
+func (c *LoggedInContext) GetHueUserRemoveHandler(rw web.ResponseWriter, req *web.Request) {
+	u, err := RemoveHueUser(req.PathParams["user"])
+	c.audit(req, "hue/users/"+req.PathParams["user"]+"/remove", u.DeviceType, err)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	} else {
+		c.SetNotificationMessage(rw, req, "Unpaired "+u.DeviceType)
+	}
+	http.Redirect(rw, req.Request, HueURL.Make(), http.StatusFound)
+}
+
+//GetHomeKitHandler shows the HomeKit bridge's setup code and what is paired with it
+func (c *LoggedInContext) GetHomeKitHandler(rw web.ResponseWriter, req *web.Request) {
+	err := templates.ExecuteTemplate(rw, "homeKitPage", c)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//GetHomeKitUnpairHandler unpairs everything from the HomeKit bridge, so it can be added to a home again
+func (c *LoggedInContext) GetHomeKitUnpairHandler(rw web.ResponseWriter, req *web.Request) {
+	homeKit.Unpair()
+	c.audit(req, "homekit/unpair", "", nil)
+	c.SetNotificationMessage(rw, req, "Unpaired everything from the HomeKit bridge")
+	http.Redirect(rw, req.Request, HomeKitURL.Make(), http.StatusFound)
+}
+
+//GetLiveHandler streams live messages to an open page as server-sent events, starting with everything kiwiland knows.
+//It returns when the page is closed
+func (c *LoggedInContext) GetLiveHandler(rw web.ResponseWriter, req *web.Request) {
+	messages := SubscribeLive()
+	defer UnsubscribeLive(messages)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Accel-Buffering", "no") //so nginx passes events on straight away
+	for device, keys := range StateSnapshot() {
+		for key, value := range keys {
+			writeLive(rw, LiveMessage{Type: LiveState, Time: time.Now(), Device: device, Key: key, Value: value})
+		}
+	}
+	rw.Flush()
+
+	ping := time.NewTicker(livePing)
+	defer ping.Stop()
+	for {
+		select {
+		case m := <-messages:
+			if err := writeLive(rw, m); err != nil {
+				return
+			}
+		case <-ping.C:
+			if _, err := rw.Write([]byte(": ping\n\n")); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		rw.Flush()
+	}
+}
+
+//GetSettingsHandler shows the signed in user's API tokens and a form to make one
+func (c *LoggedInContext) GetSettingsHandler(rw web.ResponseWriter, req *web.Request) {
+	if fromAdminSocket(req) {
+		http.Error(rw, "403: The admin socket isn't a user, so it has no settings or API tokens", http.StatusForbidden)
+		return
+	}
+	u, err := c.Storage.LoadUser(c.Username)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.Data = u.Tokens
+
+	err = templates.ExecuteTemplate(rw, "settingsPage", c)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//TokenRequestForm is used when users are making an API token
+type TokenRequestForm struct {
+	Name   string
+	Scopes string //eg "tv, scenes/movie"
+	Days   int    //0 for never expires
+}
+
+//PostTokenHandler makes an API token. The token is only shown this once
+func (c *LoggedInContext) PostTokenHandler(rw web.ResponseWriter, req *web.Request) {
+	if fromAdminSocket(req) {
+		http.Error(rw, "403: The admin socket isn't a user, so it has no settings or API tokens", http.StatusForbidden)
+		return
+	}
+	if c.Token != nil {
+		http.Error(rw, "403: API tokens can only be made after signing in with a password", http.StatusForbidden)
+		return
+	}
+	req.ParseForm()
+
+	var prop TokenRequestForm
+	if err := decoder.Decode(&prop, req.PostForm); err != nil {
+		c.SetErrorMessage(rw, req, "Decoding error: "+err.Error())
+		http.Redirect(rw, req.Request, SettingsURL.Make(), http.StatusSeeOther)
+		return
+	}
+
+	if prop.Days < 0 {
+		c.SetErrorMessage(rw, req, "API tokens can't expire in the past, use 0 days for a token that never expires")
+		http.Redirect(rw, req.Request, SettingsURL.Make(), http.StatusSeeOther)
+		return
+	}
+	var expires time.Time
+	if prop.Days > 0 {
+		expires = time.Now().AddDate(0, 0, prop.Days)
+	}
+	token, err := c.Storage.AddToken(c.Username, prop.Name, parseScopes(prop.Scopes), expires)
+	c.audit(req, "tokens/add", prop.Name, err)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	} else {
+		c.SetNotificationMessage(rw, req, "Made API token "+prop.Name+": "+token+" - copy it now, it won't be shown again")
+	}
+	http.Redirect(rw, req.Request, SettingsURL.Make(), http.StatusSeeOther)
+}
+
+//GetTokenRevokeHandler deletes an API token
+func (c *LoggedInContext) GetTokenRevokeHandler(rw web.ResponseWriter, req *web.Request) {
+	if fromAdminSocket(req) {
+		http.Error(rw, "403: The admin socket isn't a user, so it has no settings or API tokens", http.StatusForbidden)
+		return
+	}
+	if c.Token != nil {
+		http.Error(rw, "403: API tokens can only be revoked after signing in with a password", http.StatusForbidden)
+		return
+	}
+	t, err := c.Storage.RevokeToken(c.Username, req.PathParams["token"])
+	c.audit(req, "tokens/"+req.PathParams["token"]+"/revoke", t.Name, err)
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	} else {
+		c.SetNotificationMessage(rw, req, "Revoked API token "+t.Name)
+	}
+	http.Redirect(rw, req.Request, SettingsURL.Make(), http.StatusFound)
+}
+
 // func (c *Context) DoCreateFactHandler(rw web.ResponseWriter, req *web.Request) {
 
 // 	req.ParseForm()
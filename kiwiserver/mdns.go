@@ -0,0 +1,259 @@
+package kiwiserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//DNS constants used by our tiny mdns client and advertiser
+const (
+	dnsTypeA     = 1
+	dnsTypePTR   = 12
+	dnsTypeTXT   = 16
+	dnsTypeSRV   = 33
+	dnsClassIN   = 1
+	mdnsPort     = 5353
+	dnsHeaderLen = 12
+
+	//mdnsCacheFlush is set in the class of records only we answer for
+	mdnsCacheFlush = 0x8000
+	//mdnsTTL is how long our records may be cached, in seconds
+	mdnsTTL = 120
+)
+
+//mdnsGroup is the multicast address mdns is sent to
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+//reverseName turns 192.168.2.10 into 10.2.168.192.in-addr.arpa
+func reverseName(ip net.IP) string {
+	ip4 := ip.To4()
+	parts := make([]string, 4)
+	for i := 0; i < 4; i++ {
+		parts[3-i] = strconv.Itoa(int(ip4[i]))
+	}
+	return strings.Join(parts, ".") + ".in-addr.arpa"
+}
+
+//encodeDNSName encodes a dotted name as dns labels
+func encodeDNSName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+//decodeDNSName reads a (possibly compressed) dns name starting at offset, returning the name and the offset after it
+func decodeDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; jumps < 16; {
+		if offset >= len(msg) {
+			return "", 0, errors.New("Truncated name")
+		}
+		l := int(msg[offset])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case l&0xC0 == 0xC0:
+			if offset+1 >= len(msg) {
+				return "", 0, errors.New("Truncated pointer")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+			jumps++
+		default:
+			if offset+1+l > len(msg) {
+				return "", 0, errors.New("Truncated label")
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+l]))
+			offset += 1 + l
+		}
+	}
+	return "", 0, errors.New("Too many name pointers")
+}
+
+//LookupMDNSAddr asks a host directly, over mdns, what its name is
+func LookupMDNSAddr(ip string, timeout time.Duration) (string, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || addr.To4() == nil {
+		return "", errors.New("Bad IP address: " + ip)
+	}
+
+	query := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(query[4:], 1) //one question
+	query = append(query, encodeDNSName(reverseName(addr))...)
+	query = append(query, 0, dnsTypePTR, 0x80, dnsClassIN) //top bit of class asks for a unicast response
+
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: addr, Port: mdnsPort})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(query); err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 1500)
+	n, err := conn.Read(msg)
+	if err != nil {
+		return "", err
+	}
+	msg = msg[:n]
+	if len(msg) < dnsHeaderLen {
+		return "", errors.New("Short mdns response")
+	}
+
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	offset := dnsHeaderLen
+	for i := 0; i < questions; i++ {
+		if _, offset, err = decodeDNSName(msg, offset); err != nil {
+			return "", err
+		}
+		offset += 4 //type and class
+	}
+	for i := 0; i < answers; i++ {
+		if _, offset, err = decodeDNSName(msg, offset); err != nil {
+			return "", err
+		}
+		if offset+10 > len(msg) {
+			return "", errors.New("Truncated answer")
+		}
+		rtype := binary.BigEndian.Uint16(msg[offset:])
+		rdlength := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if rtype == dnsTypePTR {
+			name, _, err := decodeDNSName(msg, offset)
+			if err != nil {
+				return "", err
+			}
+			return name, nil
+		}
+		offset += rdlength
+	}
+	return "", errors.New("No PTR record in mdns response")
+}
+
+//An mdnsService is a service kiwiland advertises over mdns, so that eg the Home app can find it
+type mdnsService struct {
+	Instance string //eg "kiwiland"
+	Service  string //eg "_hap._tcp"
+	Host     string //eg "kiwiland", which is given our LAN address
+	Port     int
+	TXT      func() []string //eg "sf=1", looked up each time the service is announced as they can change
+}
+
+//appendDNSRecord adds a resource record to a message
+func appendDNSRecord(msg []byte, name string, rtype uint16, class uint16, ttl uint32, rdata []byte) []byte {
+	msg = append(msg, encodeDNSName(name)...)
+	fixed := make([]byte, 10)
+	binary.BigEndian.PutUint16(fixed, rtype)
+	binary.BigEndian.PutUint16(fixed[2:], class)
+	binary.BigEndian.PutUint32(fixed[4:], ttl)
+	binary.BigEndian.PutUint16(fixed[8:], uint16(len(rdata)))
+	msg = append(msg, fixed...)
+	return append(msg, rdata...)
+}
+
+//response is an mdns response describing the service: its PTR, SRV, TXT and A records
+func (s mdnsService) response(ip net.IP) []byte {
+	service := s.Service + ".local"
+	instance := s.Instance + "." + service
+	host := s.Host + ".local"
+
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400) //an authoritative response
+	binary.BigEndian.PutUint16(msg[6:], 4)      //four answers
+
+	msg = appendDNSRecord(msg, service, dnsTypePTR, dnsClassIN, 4500, encodeDNSName(instance))
+
+	srv := make([]byte, 6)
+	binary.BigEndian.PutUint16(srv[4:], uint16(s.Port))
+	msg = appendDNSRecord(msg, instance, dnsTypeSRV, dnsClassIN|mdnsCacheFlush, mdnsTTL, append(srv, encodeDNSName(host)...))
+
+	var txt []byte
+	for _, t := range s.TXT() {
+		txt = append(txt, byte(len(t)))
+		txt = append(txt, t...)
+	}
+	msg = appendDNSRecord(msg, instance, dnsTypeTXT, dnsClassIN|mdnsCacheFlush, 4500, txt)
+
+	return appendDNSRecord(msg, host, dnsTypeA, dnsClassIN|mdnsCacheFlush, mdnsTTL, ip.To4())
+}
+
+//wanted reports whether an mdns message is a query asking about the service
+func (s mdnsService) wanted(msg []byte) bool {
+	if len(msg) < dnsHeaderLen || binary.BigEndian.Uint16(msg[2:])&0x8000 != 0 {
+		return false //too short, or a response
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	offset := dnsHeaderLen
+	for i := 0; i < questions; i++ {
+		name, next, err := decodeDNSName(msg, offset)
+		if err != nil {
+			return false
+		}
+		offset = next + 4 //type and class
+		switch strings.ToLower(name) {
+		case strings.ToLower(s.Service + ".local"),
+			strings.ToLower(s.Instance + "." + s.Service + ".local"),
+			strings.ToLower(s.Host + ".local"),
+			"_services._dns-sd._udp.local":
+			return true
+		}
+	}
+	return false
+}
+
+//AdvertiseMDNS answers mdns queries for a service, forever, at the given address. It announces the service when it
+//starts and whenever something is sent on announce, eg because its TXT records have changed
+func AdvertiseMDNS(s mdnsService, ip string, announce <-chan bool) {
+	addr := net.ParseIP(ip)
+	if addr == nil || addr.To4() == nil {
+		log.Println("mdns: bad IP address: " + ip)
+		return
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		log.Println("mdns:", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	go func() {
+		for {
+			//announcements are sent twice, a second apart, in case one is lost
+			conn.WriteToUDP(s.response(addr), mdnsGroup)
+			time.Sleep(time.Second)
+			conn.WriteToUDP(s.response(addr), mdnsGroup)
+			if _, ok := <-announce; !ok {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Println("mdns:", err.Error())
+			return
+		}
+		if s.wanted(buf[:n]) {
+			conn.WriteToUDP(s.response(addr), mdnsGroup)
+		}
+	}
+}
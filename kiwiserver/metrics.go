@@ -0,0 +1,247 @@
+package kiwiserver
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocraft/web"
+)
+
+//MetricsConfig says who may read /metrics. With neither set, nobody may
+type MetricsConfig struct {
+	AllowIPs []string //IP addresses or CIDR ranges, eg "192.168.2.5" or "192.168.2.0/24". Behind a proxy, see TrustedProxies
+	Token    string   //a bearer token Prometheus can send instead, with bearer_token in its scrape config
+}
+
+//allowed reports whether a request may read the metrics
+func (mc MetricsConfig) allowed(req *web.Request) bool {
+	if mc.Token != "" {
+		if token := bearerToken(req.Header.Get("Authorization")); token != "" {
+			return subtle.ConstantTimeCompare([]byte(token), []byte(mc.Token)) == 1
+		}
+	}
+	ip := net.ParseIP(requestIP(req.Request))
+	return ip != nil && matchIP(ip, mc.AllowIPs)
+}
+
+//metricBuckets are the histogram buckets, in seconds. CEC commands take a second or two, waking can take much longer
+var metricBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+//A histogram counts observations into metricBuckets
+type histogram struct {
+	Counts []uint64 //one per bucket, not cumulative
+	Count  uint64
+	Sum    float64
+}
+
+//observe adds a duration to the histogram
+func (h *histogram) observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]uint64, len(metricBuckets))
+	}
+	seconds := d.Seconds()
+	for i, le := range metricBuckets {
+		if seconds <= le {
+			h.Counts[i]++
+			break
+		}
+	}
+	h.Count++
+	h.Sum += seconds
+}
+
+var (
+	metricsMutex    sync.Mutex
+	actionCounts    = make(map[[3]string]uint64)     //device, command, result
+	actionDurations = make(map[[2]string]*histogram) //device, command
+	loginCounts     = make(map[string]uint64)        //result
+	httpCounts      = make(map[[3]string]uint64)     //method, route, code
+	httpDurations   = make(map[[2]string]*histogram) //method, route
+)
+
+//actionLabels splits an action into a device and a command, eg "devices/nas/wake" is device "nas" and command "wake"
+func actionLabels(action string) (string, string) {
+	parts := strings.SplitN(action, "/", 2)
+	if len(parts) == 1 {
+		return action, ""
+	}
+	if parts[0] == "devices" && strings.HasSuffix(parts[1], "/wake") {
+		return strings.TrimSuffix(parts[1], "/wake"), "wake"
+	}
+	return parts[0], parts[1]
+}
+
+//countAction records an action's result and how long it took
+func countAction(action string, err error, d time.Duration) {
+	device, command := actionLabels(action)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	actionCounts[[3]string{device, command, result}]++
+	h := actionDurations[[2]string{device, command}]
+	if h == nil {
+		h = &histogram{}
+		actionDurations[[2]string{device, command}] = h
+	}
+	h.observe(d)
+}
+
+//countLogin records a sign in attempt
+func countLogin(ok bool) {
+	result := "success"
+	if !ok {
+		result = "failure"
+	}
+	metricsMutex.Lock()
+	loginCounts[result]++
+	metricsMutex.Unlock()
+}
+
+//MetricsMiddleware counts requests by route, so /devices/nas/wake and /devices/tv/wake are both /devices/:device/wake
+func (c *Context) MetricsMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	start := time.Now()
+	next(rw, req)
+	route := req.RoutePath()
+	if route == "" {
+		route = "unmatched"
+	}
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	httpCounts[[3]string{req.Method, route, strconv.Itoa(rw.StatusCode())}]++
+	h := httpDurations[[2]string{req.Method, route}]
+	if h == nil {
+		h = &histogram{}
+		httpDurations[[2]string{req.Method, route}] = h
+	}
+	h.observe(time.Since(start))
+}
+
+//labels formats label names and values, eg {device="tv",command="poweron"}
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], value)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+//writeHeader writes a metric's HELP and TYPE lines
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+//writeHistogram writes a histogram's buckets, sum and count
+func writeHistogram(w io.Writer, name string, h *histogram, pairs ...string) {
+	var cumulative uint64
+	for i, le := range metricBuckets {
+		cumulative += h.Counts[i]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels(append(pairs, "le", strconv.FormatFloat(le, 'g', -1, 64))...), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels(append(pairs, "le", "+Inf")...), h.Count)
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels(pairs...), h.Sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels(pairs...), h.Count)
+}
+
+//sortedKeys3 sorts counter keys, so the output is in a stable order, which makes it easier to read
+func sortedKeys3(m map[[3]string]uint64) [][3]string {
+	keys := make([][3]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return strings.Join(keys[i][:], "\x00") < strings.Join(keys[j][:], "\x00") })
+	return keys
+}
+
+//sortedKeys2 sorts histogram keys the same way
+func sortedKeys2(m map[[2]string]*histogram) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i][0]+"\x00"+keys[i][1] < keys[j][0]+"\x00"+keys[j][1] })
+	return keys
+}
+
+//WriteMetrics writes every metric in the Prometheus text exposition format
+func WriteMetrics(w io.Writer) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	writeHeader(w, "kiwiland_actions_total", "counter", "Actions run, by device, command and result.")
+	for _, k := range sortedKeys3(actionCounts) {
+		fmt.Fprintf(w, "kiwiland_actions_total%s %d\n", labels("device", k[0], "command", k[1], "result", k[2]), actionCounts[k])
+	}
+	writeHeader(w, "kiwiland_action_duration_seconds", "histogram", "How long actions took, by device and command.")
+	for _, k := range sortedKeys2(actionDurations) {
+		writeHistogram(w, "kiwiland_action_duration_seconds", actionDurations[k], "device", k[0], "command", k[1])
+	}
+
+	writeHeader(w, "kiwiland_cec_watch_restarts_total", "counter", "Times the long-running cec-client watching the TV's remote was restarted.")
+	fmt.Fprintf(w, "kiwiland_cec_watch_restarts_total %d\n", CECWatchRestarts())
+
+	writeHeader(w, "kiwiland_logins_total", "counter", "Sign in attempts, by result.")
+	for _, result := range []string{"success", "failure"} {
+		fmt.Fprintf(w, "kiwiland_logins_total%s %d\n", labels("result", result), loginCounts[result])
+	}
+
+	state := StateSnapshot()
+	writeHeader(w, "kiwiland_device_online", "gauge", "Whether a device answered its last ping, 1 for online.")
+	var names []string
+	for device, keys := range state {
+		if _, ok := keys[EventOnline]; ok {
+			names = append(names, device)
+		}
+	}
+	sort.Strings(names)
+	for _, device := range names {
+		online := 0
+		if state[device][EventOnline] == "online" {
+			online = 1
+		}
+		fmt.Fprintf(w, "kiwiland_device_online%s %d\n", labels("device", device), online)
+	}
+	if power, ok := state["tv"][EventPower]; ok {
+		writeHeader(w, "kiwiland_tv_power_on", "gauge", "Whether the TV is on, 1 for on and 0 for standby.")
+		on := 0
+		if power == "on" {
+			on = 1
+		}
+		fmt.Fprintf(w, "kiwiland_tv_power_on %d\n", on)
+	}
+
+	writeHeader(w, "kiwiland_http_requests_total", "counter", "HTTP requests, by method, route and status code.")
+	for _, k := range sortedKeys3(httpCounts) {
+		fmt.Fprintf(w, "kiwiland_http_requests_total%s %d\n", labels("method", k[0], "route", k[1], "code", k[2]), httpCounts[k])
+	}
+	writeHeader(w, "kiwiland_http_request_duration_seconds", "histogram", "How long HTTP requests took, by method and route.")
+	for _, k := range sortedKeys2(httpDurations) {
+		writeHistogram(w, "kiwiland_http_request_duration_seconds", httpDurations[k], "method", k[0], "route", k[1])
+	}
+}
+
+//GetMetricsHandler serves the metrics to Prometheus
+func (c *Context) GetMetricsHandler(rw web.ResponseWriter, req *web.Request) {
+	if !currentConfig().Metrics.allowed(req) {
+		http.Error(rw, "403: Not allowed to read metrics", http.StatusForbidden)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	WriteMetrics(rw)
+}
@@ -0,0 +1,38 @@
+package kiwiserver
+
+import (
+	"bytes"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gocraft/web"
+)
+
+func TestMetricsToken(t *testing.T) {
+	setupUsers(t)
+	mc := MetricsConfig{Token: "scrapeme"}
+	req := testRequest("GET", "/metrics", false)
+	req.Header.Set("Authorization", "Bearer scrapeme")
+	if !mc.allowed(req) {
+		t.Error("the metrics token wasn't let in")
+	}
+
+	//the metrics token isn't an API token, so signing in doesn't try it, or complain about it every scrape
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	c := testContext()
+	c.LoadUserMiddleware(webRecorder{httptest.NewRecorder()}, req, func(web.ResponseWriter, *web.Request) {})
+	if c.Username != "" || strings.Contains(logged.String(), "Refused API token") {
+		t.Errorf("a scrape was signed in as %q and logged %q", c.Username, logged.String())
+	}
+
+	wrong := testRequest("GET", "/metrics", false)
+	wrong.Header.Set("Authorization", "Bearer kiwi_guess")
+	if mc.allowed(wrong) {
+		t.Error("the wrong token was let in")
+	}
+}
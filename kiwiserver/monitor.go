@@ -0,0 +1,76 @@
+package kiwiserver
+
+import (
+	"log"
+	"time"
+)
+
+//MonitorConfig controls how kiwiland watches the TV and devices for changes it didn't make
+type MonitorConfig struct {
+	Disabled bool
+	Seconds  int  //how often to poll. 0 means every 60 seconds
+	TVInput  bool //also poll which input the TV is on, which not every TV and device supports
+
+	RemoteKeys bool //keep a second cec-client running in monitor mode to see keys pressed on the TV's remote
+}
+
+//pollInterval is how often the monitor polls
+func (mc MonitorConfig) pollInterval() time.Duration {
+	if mc.Seconds <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(mc.Seconds) * time.Second
+}
+
+//tvPollFailing stops a missing or broken cec-client filling the log
+var tvPollFailing bool
+
+//pollOnce checks the TV and every device with an IP address, recording what it finds in the state
+func pollOnce() {
+	if _, err := TVGetStatus(); err != nil {
+		if !tvPollFailing {
+			log.Println("Monitor could not get TV status:", err.Error())
+		}
+		tvPollFailing = true
+	} else {
+		tvPollFailing = false
+	}
+	if currentConfig().Monitor.TVInput && GetState("tv", EventPower) == "on" {
+		TVGetInput() //errors here are normal, eg when the TV's own apps are showing
+	}
+	for _, d := range devices.List() {
+		if d.IP == "" {
+			continue
+		}
+		online := "offline"
+		if HostOnline(d.IP) {
+			online = "online"
+		}
+		SetState(d.Name, EventOnline, online, SourceObserved)
+	}
+	pollAgentIdle()
+}
+
+//RunMonitor polls the TV and devices forever, and publishes a time event at the start of each minute
+func RunMonitor() {
+	cfg := currentConfig()
+	go func() {
+		for {
+			now := time.Now()
+			next := now.Truncate(time.Minute).Add(time.Minute)
+			time.Sleep(next.Sub(now))
+			Publish(Event{Type: EventTime, Device: "clock", Value: next.Format("15:04")})
+		}
+	}()
+
+	if cfg.Monitor.Disabled {
+		return
+	}
+	if cfg.Monitor.RemoteKeys {
+		go WatchCECRemote()
+	}
+	for {
+		pollOnce()
+		time.Sleep(currentConfig().Monitor.pollInterval()) //read each time, so a reload changes it
+	}
+}
@@ -0,0 +1,326 @@
+package kiwiserver
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//MQTTConfig is how kiwiland reaches an MQTT broker, for Home Assistant and other home automation
+type MQTTConfig struct {
+	Broker   string //host:port of the broker, eg "192.168.2.5:1883". Leave empty to not use MQTT
+	TLS      bool
+	Username string
+	Password string
+
+	Prefix          string //the start of kiwiland's topics. Empty means "kiwiland"
+	DiscoveryPrefix string //where Home Assistant looks for discovery payloads. Empty means "homeassistant"
+	NoDiscovery     bool   //don't publish Home Assistant discovery payloads
+}
+
+//prefix is the start of kiwiland's topics
+func (mc MQTTConfig) prefix() string {
+	if mc.Prefix == "" {
+		return "kiwiland"
+	}
+	return strings.Trim(mc.Prefix, "/")
+}
+
+//discoveryPrefix is where Home Assistant looks for discovery payloads
+func (mc MQTTConfig) discoveryPrefix() string {
+	if mc.DiscoveryPrefix == "" {
+		return "homeassistant"
+	}
+	return strings.Trim(mc.DiscoveryPrefix, "/")
+}
+
+const (
+	//mqttKeepAlive is how often the broker should expect to hear from us
+	mqttKeepAlive = 60 * time.Second
+	//mqttRetryMax is the longest to wait between attempts to reconnect
+	mqttRetryMax = 5 * time.Minute
+)
+
+//An MQTTResult is published to <prefix>/action/result after each action run from MQTT
+type MQTTResult struct {
+	Action string
+	Output string
+	Error  string
+}
+
+//stateTopic is where a part of a device's state is published, eg "kiwiland/tv/power"
+func stateTopic(device string, key string) string {
+	return currentConfig().MQTT.prefix() + "/" + device + "/" + key
+}
+
+//availabilityTopic says whether kiwiland is connected. The broker publishes "offline" there for us if we disappear
+func availabilityTopic() string {
+	return currentConfig().MQTT.prefix() + "/status"
+}
+
+//mqttAction works out what action a message to one of our command topics asks for, or "" if it isn't one.
+//<prefix>/action/tv/poweron runs tv/poweron whatever the payload; <prefix>/action with the payload tv/poweron does too;
+//and <prefix>/tv/power/set with the payload standby works out the action to put the TV in standby
+func mqttAction(m mqttMessage) string {
+	prefix := currentConfig().MQTT.prefix() + "/"
+	if !strings.HasPrefix(m.Topic, prefix) {
+		return ""
+	}
+	topic := strings.TrimPrefix(m.Topic, prefix)
+	switch {
+	case topic == "action":
+		return strings.TrimSpace(string(m.Payload))
+	case strings.HasPrefix(topic, "action/") && topic != "action/result":
+		return strings.TrimPrefix(topic, "action/")
+	case strings.HasSuffix(topic, "/set"):
+		parts := strings.Split(strings.TrimSuffix(topic, "/set"), "/")
+		if len(parts) != 2 {
+			return ""
+		}
+		action, err := fixAction(Want{Device: parts[0], Key: parts[1], Value: strings.TrimSpace(string(m.Payload))})
+		if err != nil {
+			log.Println("MQTT:", err.Error())
+			return ""
+		}
+		return action
+	}
+	return ""
+}
+
+//tvInputs lists the inputs kiwiland can switch the TV to, eg "hdmi1"
+func tvInputs() []string {
+	var inputs []string
+	for name := range TVCommands {
+		if strings.HasPrefix(name, "hdmi") {
+			inputs = append(inputs, name)
+		}
+	}
+	sort.Strings(inputs)
+	return inputs
+}
+
+//haDevice is the "device" part of a discovery payload, which groups entities in Home Assistant
+func haDevice(id string, name string) map[string]interface{} {
+	return map[string]interface{}{
+		"identifiers":  []string{"kiwiland_" + id},
+		"name":         name,
+		"manufacturer": "kiwiland",
+	}
+}
+
+//objectID makes a name safe to use in a discovery topic, eg "toshiba/launch/kodi" becomes "toshiba_launch_kodi"
+func objectID(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+//discoveryPayloads builds the Home Assistant discovery payloads for everything kiwiland can see and do, by topic:
+//the TV's power as a switch and its input as a select, the toshiba and other devices as connectivity sensors
+//(or a switch, for the toshiba, if it can be slept), and every action as a button
+func discoveryPayloads() map[string]map[string]interface{} {
+	cfg := currentConfig()
+	base := cfg.MQTT.discoveryPrefix()
+	prefix := cfg.MQTT.prefix()
+	payloads := make(map[string]map[string]interface{})
+	entity := func(component string, id string, p map[string]interface{}) {
+		p["unique_id"] = "kiwiland_" + id
+		p["availability_topic"] = availabilityTopic()
+		payloads[base+"/"+component+"/kiwiland/"+id+"/config"] = p
+	}
+
+	tv := haDevice("tv", "TV")
+	entity("switch", "tv_power", map[string]interface{}{
+		"name":          "TV",
+		"device":        tv,
+		"state_topic":   stateTopic("tv", EventPower),
+		"command_topic": stateTopic("tv", EventPower) + "/set",
+		"payload_on":    "on",
+		"payload_off":   "standby",
+		"icon":          "mdi:television",
+	})
+	entity("select", "tv_input", map[string]interface{}{
+		"name":          "TV input",
+		"device":        tv,
+		"state_topic":   stateTopic("tv", EventInput),
+		"command_topic": stateTopic("tv", EventInput) + "/set",
+		"options":       tvInputs(),
+	})
+
+	for _, d := range devices.List() {
+		device := haDevice(objectID(d.Name), d.Name)
+		if d.Name == "toshiba" && (AgentEnabled() || SleepOnLANEnabled()) {
+			entity("switch", "toshiba_online", map[string]interface{}{
+				"name":          "Toshiba",
+				"device":        device,
+				"state_topic":   stateTopic("toshiba", EventOnline),
+				"command_topic": stateTopic("toshiba", EventOnline) + "/set",
+				"payload_on":    "online",
+				"payload_off":   "offline",
+				"icon":          "mdi:laptop",
+			})
+			continue
+		}
+		entity("binary_sensor", objectID(d.Name)+"_online", map[string]interface{}{
+			"name":         d.Name + " online",
+			"device":       device,
+			"device_class": "connectivity",
+			"state_topic":  stateTopic(d.Name, EventOnline),
+			"payload_on":   "online",
+			"payload_off":  "offline",
+		})
+	}
+
+	hub := haDevice("hub", "kiwiland")
+	for _, action := range AllActions() {
+		device := hub
+		if strings.HasPrefix(action, "tv/") {
+			device = tv
+		}
+		entity("button", "action_"+objectID(action), map[string]interface{}{
+			"name":          action,
+			"device":        device,
+			"command_topic": prefix + "/action/" + action,
+		})
+	}
+	return payloads
+}
+
+//publishDiscovery publishes the discovery payloads, retained so Home Assistant finds them whenever it starts
+func publishDiscovery(mc *mqttConn) error {
+	if currentConfig().MQTT.NoDiscovery {
+		return nil
+	}
+	for topic, payload := range discoveryPayloads() {
+		payloadBytes, _ := json.Marshal(payload)
+		if err := mc.Publish(topic, payloadBytes, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//publishState publishes everything kiwiland knows, retained so new subscribers see it straight away
+func publishState(mc *mqttConn) error {
+	for device, keys := range StateSnapshot() {
+		for key, value := range keys {
+			if err := mc.Publish(stateTopic(device, key), []byte(value), true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//runMQTTAction runs an action asked for over MQTT and publishes the result
+func runMQTTAction(mc *mqttConn, action string) {
+	output, err := PerformAction(action, "mqtt", "")
+	r := MQTTResult{Action: action, Output: output}
+	if err != nil {
+		r.Error = err.Error()
+		log.Printf("MQTT action %s failed: %s", action, err.Error())
+	}
+	resultBytes, _ := json.Marshal(r)
+	mc.Publish(currentConfig().MQTT.prefix()+"/action/result", resultBytes, false)
+}
+
+//mqttSession connects to the broker and works until the connection fails
+func mqttSession() error {
+	cfg := currentConfig()
+	hostname, _ := os.Hostname()
+	will := &mqttWill{Topic: availabilityTopic(), Payload: "offline", Retain: true}
+	mc, err := mqttDial(cfg.MQTT.Broker, cfg.MQTT.TLS, "kiwiland-"+hostname, cfg.MQTT.Username, cfg.MQTT.Password, will, mqttKeepAlive)
+	if err != nil {
+		return err
+	}
+	defer mc.Disconnect()
+	log.Println("MQTT connected to", cfg.MQTT.Broker)
+
+	prefix := cfg.MQTT.prefix()
+	if err := mc.Subscribe(prefix+"/action", prefix+"/action/#", prefix+"/+/+/set", cfg.MQTT.discoveryPrefix()+"/status"); err != nil {
+		return err
+	}
+	if err := publishDiscovery(mc); err != nil {
+		return err
+	}
+	if err := publishState(mc); err != nil {
+		return err
+	}
+	if err := mc.Publish(availabilityTopic(), []byte("online"), true); err != nil {
+		return err
+	}
+
+	events := Subscribe()
+	defer Unsubscribe(events)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ping := time.NewTicker(mqttKeepAlive / 2)
+		defer ping.Stop()
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				switch e.Type {
+				case EventPower, EventInput, EventOnline:
+					mc.Publish(stateTopic(e.Device, e.Type), []byte(e.Value), true)
+				}
+			case <-ping.C:
+				mc.Ping()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		m, err := mc.Receive(mqttKeepAlive + mqttKeepAlive/2)
+		if err != nil {
+			return err
+		}
+		if m.Topic == cfg.MQTT.discoveryPrefix()+"/status" {
+			if string(m.Payload) == "online" {
+				//Home Assistant restarted, and may have lost its discovered entities
+				publishDiscovery(mc)
+				publishState(mc)
+			}
+			continue
+		}
+		if action := mqttAction(m); action != "" {
+			if m.Retain {
+				//a retained command would run again every time kiwiland connects, however long ago it was sent
+				log.Println("MQTT: ignoring retained command on", m.Topic)
+				continue
+			}
+			go runMQTTAction(mc, action)
+		}
+	}
+}
+
+//RunMQTT keeps kiwiland connected to the MQTT broker, if there is one, forever
+func RunMQTT() {
+	if currentConfig().MQTT.Broker == "" {
+		return
+	}
+	retry := 5 * time.Second
+	for {
+		start := time.Now()
+		err := mqttSession()
+		log.Println("MQTT disconnected:", err.Error())
+		if time.Since(start) > mqttRetryMax {
+			retry = 5 * time.Second //it was working for a while, so try again soon
+		}
+		time.Sleep(retry)
+		if retry *= 2; retry > mqttRetryMax {
+			retry = mqttRetryMax
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package kiwiserver
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+//pipeMQTT makes a connected pair of mqttConns, one for kiwiland and one for a pretend broker
+func pipeMQTT() (*mqttConn, *mqttConn) {
+	a, b := net.Pipe()
+	return &mqttConn{conn: a, r: bufio.NewReader(a)}, &mqttConn{conn: b, r: bufio.NewReader(b)}
+}
+
+func TestMQTTLength(t *testing.T) {
+	tests := []struct {
+		n       int
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{321, []byte{0xc1, 0x02}},
+	}
+	for _, test := range tests {
+		if got := appendMQTTLength(nil, test.n); !bytes.Equal(got, test.encoded) {
+			t.Errorf("length %d encoded as %x, want %x", test.n, got, test.encoded)
+		}
+		if test.n > 1000 {
+			continue //not worth sending a body that big
+		}
+		packet := append(append([]byte{mqttPublish << 4}, test.encoded...), make([]byte, test.n)...)
+		mc := &mqttConn{r: bufio.NewReader(bytes.NewReader(packet))}
+		header, body, err := mc.readPacket()
+		if err != nil {
+			t.Errorf("length %d: %s", test.n, err.Error())
+			continue
+		}
+		if header != mqttPublish<<4 || len(body) != test.n {
+			t.Errorf("length %d read back as header %x with %d bytes", test.n, header, len(body))
+		}
+	}
+}
+
+func TestMQTTBadLength(t *testing.T) {
+	for _, packet := range [][]byte{
+		{mqttPublish << 4, 0xff, 0xff, 0xff, 0xff, 0x01}, //five length bytes
+		{mqttPublish << 4, 0x80, 0x80, 0x80, 0x01},       //bigger than mqttMaxPacket
+		{mqttPublish << 4, 0x05, 0x00},                   //cut short
+	} {
+		mc := &mqttConn{r: bufio.NewReader(bytes.NewReader(packet))}
+		if _, _, err := mc.readPacket(); err == nil {
+			t.Errorf("packet %x was read without an error", packet)
+		}
+	}
+}
+
+func TestMQTTPublishReceive(t *testing.T) {
+	kiwiland, broker := pipeMQTT()
+	defer kiwiland.conn.Close()
+	defer broker.conn.Close()
+
+	for _, retain := range []bool{false, true} {
+		go broker.Publish("kiwiland/action/tv/poweron", []byte("please"), retain)
+		m, err := kiwiland.Receive(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Topic != "kiwiland/action/tv/poweron" || string(m.Payload) != "please" || m.Retain != retain {
+			t.Errorf("received %q %q retain %v, want retain %v", m.Topic, m.Payload, m.Retain, retain)
+		}
+	}
+}
+
+func TestMQTTReceiveQoS1(t *testing.T) {
+	kiwiland, broker := pipeMQTT()
+	defer kiwiland.conn.Close()
+	defer broker.conn.Close()
+
+	acked := make(chan []byte, 1)
+	go func() {
+		body := append(appendMQTTString(nil, "kiwiland/action"), 0x12, 0x34)
+		broker.writePacket(mqttPublish<<4|0x02, append(body, "tv/hdmi2"...))
+		header, body, err := broker.readPacket()
+		if err != nil || header != mqttPubAck<<4 {
+			acked <- nil
+			return
+		}
+		acked <- body
+	}()
+
+	m, err := kiwiland.Receive(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Topic != "kiwiland/action" || string(m.Payload) != "tv/hdmi2" {
+		t.Errorf("received %q %q", m.Topic, m.Payload)
+	}
+	if id := <-acked; !bytes.Equal(id, []byte{0x12, 0x34}) {
+		t.Errorf("puback was %x, want the packet id 1234", id)
+	}
+}
+
+func TestMQTTRefusedSubscription(t *testing.T) {
+	kiwiland, broker := pipeMQTT()
+	defer kiwiland.conn.Close()
+	defer broker.conn.Close()
+
+	go broker.writePacket(mqttSubAck<<4, []byte{0x00, 0x01, 0x00, 0x80})
+	if _, err := kiwiland.Receive(time.Second); err == nil {
+		t.Error("a refused subscription wasn't an error")
+	}
+}
+
+func TestMQTTAction(t *testing.T) {
+	tests := []struct {
+		topic   string
+		payload string
+		action  string
+	}{
+		{"kiwiland/action/tv/poweron", "anything", "tv/poweron"},
+		{"kiwiland/action/toshiba/launch/kodi", "", "toshiba/launch/kodi"},
+		{"kiwiland/action", " tv/hdmi2\n", "tv/hdmi2"},
+		{"kiwiland/action/result", "tv/poweron", ""},
+		{"kiwiland/tv/power/set", "standby", "tv/poweroff"},
+		{"kiwiland/tv/power/set", "on", "tv/poweron"},
+		{"kiwiland/tv/input/set", "hdmi4", "tv/hdmi4"},
+		{"kiwiland/nas/online/set", "online", "devices/nas/wake"},
+		{"kiwiland/tv/power/set", "sideways", ""},
+		{"kiwiland/tv/power", "on", ""},
+		{"kiwiland/a/b/c/set", "on", ""},
+		{"somethingelse/action/tv/poweron", "", ""},
+		{"homeassistant/status", "online", ""},
+	}
+	for _, test := range tests {
+		if got := mqttAction(mqttMessage{Topic: test.topic, Payload: []byte(test.payload)}); got != test.action {
+			t.Errorf("%s %q gave action %q, want %q", test.topic, test.payload, got, test.action)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package kiwiserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//MQTT packet types used by our tiny mqtt client. It speaks MQTT 3.1.1 at QoS 0, which is all kiwiland needs
+const (
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttPubAck     = 4
+	mqttSubscribe  = 8
+	mqttSubAck     = 9
+	mqttPingReq    = 12
+	mqttPingResp   = 13
+	mqttDisconnect = 14
+
+	mqttMaxPacket = 1 << 20 //nothing kiwiland subscribes to should be anywhere near this big
+)
+
+//An mqttMessage is a PUBLISH received from the broker
+type mqttMessage struct {
+	Topic   string
+	Payload []byte
+	Retain  bool //the broker kept it from before we subscribed, rather than it being sent just now
+}
+
+//An mqttConn is a connection to an MQTT broker
+type mqttConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	mu       sync.Mutex //writes come from several goroutines
+	packetID uint16
+}
+
+//An mqttWill is the message the broker publishes for us if we disappear without disconnecting
+type mqttWill struct {
+	Topic   string
+	Payload string
+	Retain  bool
+}
+
+//appendMQTTString appends a length prefixed string
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+//appendMQTTLength appends a remaining length in mqtt's variable length encoding
+func appendMQTTLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+//writePacket sends one packet with the given first byte and body
+func (mc *mqttConn) writePacket(header byte, body []byte) error {
+	packet := appendMQTTLength([]byte{header}, len(body))
+	packet = append(packet, body...)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := mc.conn.Write(packet)
+	return err
+}
+
+//readPacket reads one packet, returning its first byte and body
+func (mc *mqttConn) readPacket() (byte, []byte, error) {
+	header, err := mc.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("Bad mqtt packet length")
+		}
+		digit, err := mc.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	if length > mqttMaxPacket {
+		return 0, nil, errors.New("Mqtt packet too big: " + strconv.Itoa(length) + " bytes")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(mc.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+//nextPacketID returns a packet identifier for a subscribe, which mqtt says can't be 0
+func (mc *mqttConn) nextPacketID() uint16 {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.packetID++
+	if mc.packetID == 0 {
+		mc.packetID = 1
+	}
+	return mc.packetID
+}
+
+//mqttDial connects and signs in to a broker. keepAlive is how often the broker should expect to hear from us
+func mqttDial(address string, useTLS bool, clientID string, username string, password string, will *mqttWill, keepAlive time.Duration) (*mqttConn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	mc := &mqttConn{conn: conn, r: bufio.NewReader(conn)}
+
+	flags := byte(0x02) //clean session
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4) //protocol level 3.1.1
+	if will != nil {
+		flags |= 0x04
+		if will.Retain {
+			flags |= 0x20
+		}
+	}
+	if username != "" {
+		flags |= 0x80
+		if password != "" {
+			flags |= 0x40
+		}
+	}
+	seconds := int(keepAlive / time.Second)
+	body = append(body, flags, byte(seconds>>8), byte(seconds))
+	body = appendMQTTString(body, clientID)
+	if will != nil {
+		body = appendMQTTString(body, will.Topic)
+		body = appendMQTTString(body, will.Payload)
+	}
+	if username != "" {
+		body = appendMQTTString(body, username)
+		if password != "" {
+			body = appendMQTTString(body, password)
+		}
+	}
+
+	if err := mc.writePacket(mqttConnect<<4, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	header, ack, err := mc.readPacket()
+	if err == nil && (header>>4 != mqttConnAck || len(ack) != 2) {
+		err = errors.New("Broker didn't acknowledge the connection")
+	}
+	if err == nil && ack[1] != 0 {
+		err = mqttConnectError(ack[1])
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return mc, nil
+}
+
+//mqttConnectError explains a CONNACK return code
+func mqttConnectError(code byte) error {
+	switch code {
+	case 1:
+		return errors.New("Broker doesn't speak MQTT 3.1.1")
+	case 2:
+		return errors.New("Broker rejected the client id")
+	case 3:
+		return errors.New("Broker is unavailable")
+	case 4:
+		return errors.New("Broker rejected the username or password")
+	case 5:
+		return errors.New("Broker says we aren't authorised")
+	}
+	return errors.New("Broker refused the connection with code " + strconv.Itoa(int(code)))
+}
+
+//Publish sends a message at QoS 0
+func (mc *mqttConn) Publish(topic string, payload []byte, retain bool) error {
+	header := byte(mqttPublish << 4)
+	if retain {
+		header |= 0x01
+	}
+	body := appendMQTTString(nil, topic)
+	return mc.writePacket(header, append(body, payload...))
+}
+
+//Subscribe asks for messages on some topic filters at QoS 0. The SUBACK is read by Receive along with everything else
+func (mc *mqttConn) Subscribe(filters ...string) error {
+	id := mc.nextPacketID()
+	body := []byte{byte(id >> 8), byte(id)}
+	for _, filter := range filters {
+		body = appendMQTTString(body, filter)
+		body = append(body, 0)
+	}
+	return mc.writePacket(mqttSubscribe<<4|0x02, body)
+}
+
+//Ping lets the broker know we are still here
+func (mc *mqttConn) Ping() error {
+	return mc.writePacket(mqttPingReq<<4, nil)
+}
+
+//Disconnect says goodbye to the broker, so it doesn't publish our will, and closes the connection
+func (mc *mqttConn) Disconnect() {
+	mc.writePacket(mqttDisconnect<<4, nil)
+	mc.conn.Close()
+}
+
+//Receive reads packets until a message arrives, answering anything that needs answering on the way. It returns an
+//error if nothing at all, not even a ping response, arrives within timeout
+func (mc *mqttConn) Receive(timeout time.Duration) (mqttMessage, error) {
+	for {
+		mc.conn.SetReadDeadline(time.Now().Add(timeout))
+		header, body, err := mc.readPacket()
+		if err != nil {
+			return mqttMessage{}, err
+		}
+		switch header >> 4 {
+		case mqttPublish:
+			if len(body) < 2 {
+				return mqttMessage{}, errors.New("Short mqtt publish")
+			}
+			n := int(binary.BigEndian.Uint16(body))
+			if len(body) < 2+n {
+				return mqttMessage{}, errors.New("Short mqtt publish")
+			}
+			m := mqttMessage{Topic: string(body[2 : 2+n]), Retain: header&0x01 != 0}
+			rest := body[2+n:]
+			if qos := (header >> 1) & 0x03; qos > 0 {
+				//a broker should only send QoS 0 for our QoS 0 subscriptions, but acknowledge anything else to be safe
+				if len(rest) < 2 {
+					return mqttMessage{}, errors.New("Short mqtt publish")
+				}
+				mc.writePacket(mqttPubAck<<4, rest[:2])
+				rest = rest[2:]
+			}
+			m.Payload = rest
+			return m, nil
+		case mqttSubAck:
+			for i := 2; i < len(body); i++ {
+				if body[i] == 0x80 {
+					return mqttMessage{}, errors.New("Broker refused a subscription")
+				}
+			}
+		case mqttPingResp:
+		default:
+			return mqttMessage{}, errors.New("Unexpected mqtt packet type " + strconv.Itoa(int(header>>4)))
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package kiwiserver
+
+import (
+	_ "embed" //for the oui table
+	"net"
+	"strings"
+)
+
+//ouiTable is in the IEEE oui.txt format, ie lines like "B8-27-EB   (hex)		Raspberry Pi Foundation"
+//
+//go:embed oui.txt
+var ouiTable string
+
+var ouiVendors = parseOUITable(ouiTable)
+
+//parseOUITable makes a map from the first three bytes of a MAC address ("B8:27:EB") to the vendor name
+func parseOUITable(table string) map[string]string {
+	vendors := make(map[string]string)
+	for _, line := range strings.Split(table, "\n") {
+		i := strings.Index(line, "(hex)")
+		if i < 0 {
+			continue
+		}
+		prefix := strings.Replace(strings.TrimSpace(line[:i]), "-", ":", -1)
+		vendors[strings.ToUpper(prefix)] = strings.TrimSpace(line[i+len("(hex)"):])
+	}
+	return vendors
+}
+
+//LookupVendor returns the name of the vendor of a MAC address, if we know it
+func LookupVendor(mac string) string {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) < 3 {
+		return ""
+	}
+	if vendor, ok := ouiVendors[strings.ToUpper(hw[:3].String())]; ok {
+		return vendor
+	}
+	if hw[0]&0x02 != 0 {
+		return "(locally administered, eg a randomised or virtual MAC)"
+	}
+	return ""
+}
@@ -0,0 +1,337 @@
+package kiwiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+//QueuedXxxx are the states of a queued command
+const (
+	QueuedWaiting   = "waiting"
+	QueuedRunning   = "running"
+	QueuedDone      = "done"
+	QueuedFailed    = "failed"
+	QueuedExpired   = "expired"
+	QueuedCancelled = "cancelled"
+)
+
+//A QueuedCommand is an action waiting for the device it needs to be ready, eg a toshiba launch waiting for it to wake up
+type QueuedCommand struct {
+	ID      string
+	Action  string //anything RunAction accepts
+	Device  string //the device that has to be ready, "tv" or "toshiba"
+	Wake    bool   //wake the device rather than just wait for it
+	User    string
+	IP      string
+	Queued  time.Time
+	Expires time.Time
+
+	Status   string //one of the QueuedXxxx constants
+	Woken    time.Time
+	Attempts int
+	Finished time.Time
+	Result   string
+	Error    string
+
+	readySince time.Time
+}
+
+//A Commandqueue is the queued commands, waiting ones and the most recent finished ones
+type Commandqueue struct {
+	Commands []QueuedCommand
+
+	mu sync.Mutex
+}
+
+var queue Commandqueue
+
+const (
+	queueFile = "queue.json"
+
+	//queuePoll is how often waiting devices are checked
+	queuePoll = 10 * time.Second
+	//queueSettle is how long a device must have been ready before a command runs, eg so the TV has finished booting
+	queueSettle = 10 * time.Second
+	//queueRewake is how often a device that hasn't woken is woken again
+	queueRewake = 2 * time.Minute
+	//queueAttempts is how many times a command that fails is tried before giving up
+	queueAttempts = 3
+	//queueKeep is how many finished commands are kept to show
+	queueKeep = 20
+	//queueMaxMinutes is the longest a command may wait
+	queueMaxMinutes = 24 * 60
+)
+
+//ActionDevice works out which device must be ready for an action to work, or "" if it works whatever state things are in
+func ActionDevice(action string) string {
+	parts := strings.Split(action, "/")
+	switch {
+	case parts[0] == "tv" && action != "tv/poweron" && action != "tv/powerstatus":
+		return "tv"
+	case parts[0] == "toshiba" && action != "toshiba/wol" && action != "toshiba/sleeponlan":
+		return "toshiba"
+	}
+	return ""
+}
+
+//QueueableActions lists the actions that can be queued, for the queue page
+func QueueableActions() []string {
+	var actions []string
+	for _, action := range AllActions() {
+		if device := ActionDevice(action); device == "tv" || (device == "toshiba" && AgentEnabled()) {
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
+
+//wakeAction is the action which wakes a device
+func wakeAction(device string) string {
+	if device == "tv" {
+		return "tv/poweron"
+	}
+	return "toshiba/wol"
+}
+
+//deviceReady checks whether a device is ready for a command. The toshiba is ready when its agent answers, which it
+//can't do until it has woken up and logged in, even if it answers pings
+func deviceReady(device string) bool {
+	if device == "tv" {
+		TVGetStatus()
+		return GetState("tv", EventPower) == "on"
+	}
+	_, err := ToshibaRunning()
+	return err == nil
+}
+
+//QueueAction adds an action to the queue, to run as soon as the device it needs is ready
+func (cq *Commandqueue) QueueAction(action string, wake bool, minutes int, user string, ip string) (QueuedCommand, error) {
+	if err := CheckAction(action); err != nil {
+		return QueuedCommand{}, errors.New("Bad action " + action + ": " + err.Error())
+	}
+	device := ActionDevice(action)
+	if device == "" {
+		return QueuedCommand{}, errors.New(action + " doesn't need to wait for anything, just run it")
+	}
+	if device == "toshiba" && !AgentEnabled() {
+		return QueuedCommand{}, errors.New("Commands can only wait for the toshiba when its agent is set up")
+	}
+	if minutes < 1 || minutes > queueMaxMinutes {
+		return QueuedCommand{}, errors.New("Queued commands must expire between 1 minute and 24 hours from now")
+	}
+	id, err := GenerateValidationKey()
+	if err != nil {
+		return QueuedCommand{}, err
+	}
+
+	now := time.Now()
+	c := QueuedCommand{ID: id[:8], Action: action, Device: device, Wake: wake, User: user, IP: ip, Queued: now, Expires: now.Add(time.Duration(minutes) * time.Minute), Status: QueuedWaiting}
+	cq.mu.Lock()
+	cq.Commands = append(cq.Commands, c)
+	cq.mu.Unlock()
+	SaveQueue()
+	return c, nil
+}
+
+//CancelCommand stops a waiting command from running. One that has already started can't be cancelled
+func (cq *Commandqueue) CancelCommand(id string) error {
+	cq.mu.Lock()
+	for i := range cq.Commands {
+		if cq.Commands[i].ID == id && cq.Commands[i].Status == QueuedWaiting {
+			cq.Commands[i].Status = QueuedCancelled
+			cq.Commands[i].Finished = time.Now()
+			cq.mu.Unlock()
+			SaveQueue()
+			return nil
+		}
+	}
+	cq.mu.Unlock()
+	return errors.New("There is no waiting command to cancel, it may have already started")
+}
+
+//List returns a copy of the queue, waiting commands first, then the newest finished
+func (cq *Commandqueue) List() []QueuedCommand {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	var waiting, finished []QueuedCommand
+	for _, c := range cq.Commands {
+		if c.Status == QueuedWaiting || c.Status == QueuedRunning {
+			waiting = append(waiting, c)
+		} else {
+			finished = append([]QueuedCommand{c}, finished...)
+		}
+	}
+	return append(waiting, finished...)
+}
+
+//Waiting counts the commands still waiting
+func (cq *Commandqueue) Waiting() int {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	n := 0
+	for _, c := range cq.Commands {
+		if c.Status == QueuedWaiting {
+			n++
+		}
+	}
+	return n
+}
+
+//finish records the end of a command. The mutex must be held
+func (cq *Commandqueue) finish(i int, status string, result string, err error) {
+	c := &cq.Commands[i]
+	c.Status = status
+	c.Finished = time.Now()
+	c.Result = result
+	if err != nil {
+		c.Error = err.Error()
+	}
+}
+
+//prune drops the oldest finished commands. The mutex must be held
+func (cq *Commandqueue) prune() {
+	finished := 0
+	for i := len(cq.Commands) - 1; i >= 0; i-- {
+		if status := cq.Commands[i].Status; status == QueuedWaiting || status == QueuedRunning {
+			continue
+		}
+		finished++
+		if finished > queueKeep {
+			cq.Commands = append(cq.Commands[:i], cq.Commands[i+1:]...)
+		}
+	}
+}
+
+//start marks a command as running, if it is still waiting, so it can no longer be cancelled
+func (cq *Commandqueue) start(id string) bool {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	for i := range cq.Commands {
+		if cq.Commands[i].ID == id && cq.Commands[i].Status == QueuedWaiting {
+			cq.Commands[i].Status = QueuedRunning
+			return true
+		}
+	}
+	return false
+}
+
+//process goes through the waiting commands once: expiring them, waking their devices, and running those whose devices are ready
+func (cq *Commandqueue) process(now time.Time) {
+	cq.mu.Lock()
+	waiting := make(map[string]bool)
+	for i := range cq.Commands {
+		c := &cq.Commands[i]
+		if c.Status != QueuedWaiting {
+			continue
+		}
+		if now.After(c.Expires) {
+			cq.finish(i, QueuedExpired, "", errors.New(c.Device+" wasn't ready in time"))
+			continue
+		}
+		waiting[c.Device] = true
+	}
+	cq.mu.Unlock()
+
+	ready := make(map[string]bool)
+	for device := range waiting {
+		ready[device] = deviceReady(device)
+	}
+
+	cq.mu.Lock()
+	var run []QueuedCommand
+	for i := range cq.Commands {
+		c := &cq.Commands[i]
+		if c.Status != QueuedWaiting {
+			continue
+		}
+		if !ready[c.Device] {
+			c.readySince = time.Time{}
+			if c.Wake && now.Sub(c.Woken) >= queueRewake {
+				c.Woken = now
+				go func(c QueuedCommand) {
+					if _, err := PerformAction(wakeAction(c.Device), c.User, c.IP); err != nil {
+						log.Printf("Queue could not wake %s: %s", c.Device, err.Error())
+					}
+				}(*c)
+			}
+			continue
+		}
+		if c.readySince.IsZero() {
+			c.readySince = now
+		}
+		if now.Sub(c.readySince) >= queueSettle {
+			c.Attempts++
+			run = append(run, *c)
+		}
+	}
+	cq.mu.Unlock()
+
+	//commands run in the order they were queued, eg "hdmi4" then "volumeup"
+	for _, c := range run {
+		if !cq.start(c.ID) {
+			continue //cancelled while the ones before it ran
+		}
+		result, err := PerformAction(c.Action, c.User, c.IP)
+		cq.mu.Lock()
+		for i := range cq.Commands {
+			if cq.Commands[i].ID != c.ID || cq.Commands[i].Status != QueuedRunning {
+				continue
+			}
+			switch {
+			case err == nil:
+				cq.finish(i, QueuedDone, result, nil)
+			case c.Attempts >= queueAttempts:
+				cq.finish(i, QueuedFailed, result, err)
+			default:
+				cq.Commands[i].Status = QueuedWaiting
+				cq.Commands[i].Error = err.Error() //try again next time
+			}
+		}
+		cq.mu.Unlock()
+	}
+
+	cq.mu.Lock()
+	cq.prune()
+	cq.mu.Unlock()
+	SaveQueue()
+}
+
+//RunQueue works through the queue, forever
+func RunQueue() {
+	for {
+		if queue.Waiting() > 0 {
+			queue.process(time.Now())
+		}
+		time.Sleep(queuePoll)
+	}
+}
+
+//LoadQueue will load the queue from a json file, if there is one
+func LoadQueue() {
+	queueBytes, err := ioutil.ReadFile(queueFile)
+	if err != nil {
+		return //nothing has been queued yet
+	}
+	if err := json.Unmarshal(queueBytes, &queue); err != nil {
+		log.Println("Queue file is broken, ignoring it")
+	}
+	for i := range queue.Commands {
+		if queue.Commands[i].Status == QueuedRunning {
+			//it may or may not have worked, so it isn't run again
+			queue.finish(i, QueuedFailed, "", errors.New("kiwiland stopped while it was running"))
+		}
+	}
+}
+
+//SaveQueue will save the queue file. The queue is locked while writing so saves don't interleave
+func SaveQueue() {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queueBytes, _ := json.MarshalIndent(&queue, "", "\t")
+	ioutil.WriteFile(queueFile, queueBytes, 0644)
+}
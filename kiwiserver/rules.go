@@ -0,0 +1,198 @@
+package kiwiserver
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A RuleCondition requires part of a device's state to have (or, with Not, to not have) a value when a rule is triggered
+type RuleCondition struct {
+	Device string
+	Key    string //eg "power", "input" or "online"
+	Value  string
+	Not    bool
+}
+
+//A Rule runs actions when an event happens, eg "when the TV is turned on with its remote after 23:00, turn it off again"
+type Rule struct {
+	Name string
+
+	//the trigger. Only Event is required; the rest narrow it down
+	Event  string //one of the EventXxxx types, eg "power"
+	Device string //eg "tv"
+	Value  string //eg "on", or "23:00" for time events
+	Source string //"kiwiland" or "observed", eg "observed" for changes made with the TV's own remote
+
+	//the conditions, all of which must hold for the rule to fire
+	After      string //"HH:MM", only fire after this time of day
+	Before     string //"HH:MM", only fire before this time of day. If Before is earlier than After the window wraps midnight
+	Conditions []RuleCondition
+
+	Actions []string //anything RunAction accepts, run in order
+}
+
+//A RuleLogEntry records why a rule did or didn't fire for an event, or what happened when it did
+type RuleLogEntry struct {
+	Time   time.Time
+	Rule   string
+	Event  Event
+	Fired  bool
+	Reason string
+}
+
+const (
+	//ruleLogSize is how many entries the rule log keeps
+	ruleLogSize = 200
+	//ruleCooldown stops two rules which undo each other looping forever
+	ruleCooldown = 5 * time.Second
+)
+
+var (
+	ruleLogMutex sync.Mutex
+	ruleLog      []RuleLogEntry
+	ruleLastFire = make(map[string]time.Time)
+)
+
+//Rules returns the rules in the config
+func Rules() []Rule {
+	return currentConfig().Rules
+}
+
+//RuleLog returns the rule log, newest first
+func RuleLog() []RuleLogEntry {
+	ruleLogMutex.Lock()
+	defer ruleLogMutex.Unlock()
+	entries := make([]RuleLogEntry, len(ruleLog))
+	for i, e := range ruleLog {
+		entries[len(ruleLog)-1-i] = e
+	}
+	return entries
+}
+
+//logRule adds an entry to the rule log
+func logRule(entry RuleLogEntry) {
+	entry.Time = time.Now()
+	ruleLogMutex.Lock()
+	ruleLog = append(ruleLog, entry)
+	if len(ruleLog) > ruleLogSize {
+		ruleLog = ruleLog[len(ruleLog)-ruleLogSize:]
+	}
+	ruleLogMutex.Unlock()
+}
+
+//parseClock turns "HH:MM" into minutes past midnight
+func parseClock(clock string) (int, bool) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+//inTimeWindow reports whether a time is within the After/Before window, which may wrap midnight
+func inTimeWindow(t time.Time, after string, before string) bool {
+	now := t.Hour()*60 + t.Minute()
+	start, hasStart := parseClock(after)
+	end, hasEnd := parseClock(before)
+	switch {
+	case hasStart && hasEnd && end < start:
+		return now >= start || now < end
+	case hasStart && hasEnd:
+		return now >= start && now < end
+	case hasStart:
+		return now >= start
+	case hasEnd:
+		return now < end
+	}
+	return true
+}
+
+//matchRule decides whether a rule fires for an event. If the event isn't the kind the rule listens for at all, relevant is false
+//and nothing needs logging. Otherwise the reason explains the decision
+func matchRule(r Rule, e Event) (relevant bool, fire bool, reason string) {
+	if r.Event != e.Type {
+		return false, false, ""
+	}
+	if r.Device != "" && r.Device != e.Device {
+		return false, false, "" //eg another device going offline
+	}
+	if r.Value != "" && r.Value != e.Value {
+		if e.Type == EventTime {
+			return false, false, "" //otherwise every minute would be logged
+		}
+		return true, false, e.Device + " " + e.Type + " is " + e.Value + ", the rule wants " + r.Value
+	}
+	if r.Source != "" && r.Source != e.Source {
+		return true, false, "the change was " + e.Source + ", the rule wants " + r.Source
+	}
+	if !inTimeWindow(e.Time, r.After, r.Before) {
+		return true, false, "it is " + e.Time.Format("15:04") + ", outside " + r.After + "-" + r.Before
+	}
+	for _, c := range r.Conditions {
+		current := GetState(c.Device, c.Key)
+		if (current == c.Value) == c.Not {
+			want := c.Value
+			if c.Not {
+				want = "anything but " + c.Value
+			}
+			if current == "" {
+				current = "unknown"
+			}
+			return true, false, c.Device + " " + c.Key + " is " + current + ", the rule wants " + want
+		}
+	}
+	return true, true, "all conditions were met"
+}
+
+//runRule runs a fired rule's actions in order, stopping at the first failure, and logs the outcome
+func runRule(r Rule, e Event) {
+	var results []string
+	for _, action := range r.Actions {
+		_, err := PerformAction(action, "rule "+r.Name, "")
+		if err != nil {
+			results = append(results, action+" failed: "+err.Error())
+			logRule(RuleLogEntry{Rule: r.Name, Event: e, Fired: true, Reason: strings.Join(results, "; ")})
+			return
+		}
+		results = append(results, action+" ok")
+	}
+	logRule(RuleLogEntry{Rule: r.Name, Event: e, Fired: true, Reason: strings.Join(results, "; ")})
+}
+
+//evaluateRules checks one event against every rule
+func evaluateRules(e Event) {
+	for _, r := range currentConfig().Rules {
+		relevant, fire, reason := matchRule(r, e)
+		if !relevant {
+			continue
+		}
+		if fire {
+			ruleLogMutex.Lock()
+			last := ruleLastFire[r.Name]
+			cooling := time.Since(last) < ruleCooldown
+			if !cooling {
+				ruleLastFire[r.Name] = time.Now()
+			}
+			ruleLogMutex.Unlock()
+			if cooling {
+				fire = false
+				reason = "it already fired " + time.Since(last).Truncate(time.Second).String() + " ago"
+			}
+		}
+		logRule(RuleLogEntry{Rule: r.Name, Event: e, Fired: fire, Reason: reason})
+		if fire {
+			log.Printf("Rule %s fired on %s %s %s", r.Name, e.Device, e.Type, e.Value)
+			go runRule(r, e)
+		}
+	}
+}
+
+//RunRules evaluates the rules against every event, forever
+func RunRules() {
+	events := Subscribe()
+	for e := range events {
+		evaluateRules(e)
+	}
+}
@@ -0,0 +1,207 @@
+package kiwiserver
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A SceneStep is one thing for a scene to do
+type SceneStep struct {
+	//Action is anything RunAction accepts, eg "toshiba/wol" or "tv/hdmi4". There are also two special actions:
+	//"wait" pauses for Seconds, and "waitonline" waits up to Seconds for Device to answer pings
+	Action  string
+	Seconds int
+	Device  string
+
+	ContinueOnError bool //normally a failed step stops the scene; set this to carry on regardless
+}
+
+//A Scene is a named list of steps, eg "movie" might be wake the toshiba, wait for it, turn the TV on and select HDMI4
+type Scene struct {
+	Name  string
+	Steps []SceneStep
+}
+
+//A StepResult is what happened when a SceneStep ran
+type StepResult struct {
+	Step     SceneStep
+	Output   string
+	Error    string
+	Duration time.Duration
+	Skipped  bool
+}
+
+//A SceneRun is the progress and outcome of running a scene
+type SceneRun struct {
+	Scene    string
+	Started  time.Time
+	Finished time.Time
+	Running  bool
+	Steps    []StepResult
+	Error    string
+}
+
+//Summary describes a finished run in one line, eg "movie: 4 steps ok" or "movie: failed at step 2 (waitonline): timed out"
+func (r SceneRun) Summary() string {
+	if r.Running {
+		return r.Scene + ": running"
+	}
+	if r.Error != "" {
+		return r.Scene + ": " + r.Error
+	}
+	failed := 0
+	for _, s := range r.Steps {
+		if s.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return r.Scene + ": " + strconv.Itoa(len(r.Steps)) + " steps, " + strconv.Itoa(failed) + " failed but continued"
+	}
+	return r.Scene + ": " + strconv.Itoa(len(r.Steps)) + " steps ok"
+}
+
+var (
+	sceneRunsMutex sync.Mutex
+	sceneRuns      = make(map[string]*SceneRun) //the latest run of each scene
+)
+
+//waitOnlinePoll is how often a waitonline step pings
+const waitOnlinePoll = 2 * time.Second
+
+//LoadScene will load a scene from the config
+func LoadScene(name string) (Scene, error) {
+	for _, s := range currentConfig().Scenes {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+	return Scene{}, errors.New("Scene not found")
+}
+
+//Scenes returns the scenes in the config
+func Scenes() []Scene {
+	return currentConfig().Scenes
+}
+
+//LastSceneRun returns a copy of the latest run of a scene, and false if it has never run
+func LastSceneRun(name string) (SceneRun, bool) {
+	sceneRunsMutex.Lock()
+	defer sceneRunsMutex.Unlock()
+	run, ok := sceneRuns[name]
+	if !ok {
+		return SceneRun{}, false
+	}
+	cp := *run
+	cp.Steps = append([]StepResult(nil), run.Steps...)
+	return cp, true
+}
+
+//runStep runs a single scene step
+func runStep(step SceneStep) (string, error) {
+	switch step.Action {
+	case "wait":
+		time.Sleep(time.Duration(step.Seconds) * time.Second)
+		return "Waited " + strconv.Itoa(step.Seconds) + "s", nil
+	case "waitonline":
+		deadline := time.Now().Add(time.Duration(step.Seconds) * time.Second)
+		for {
+			online, err := DeviceOnline(step.Device)
+			if err != nil {
+				return "", err
+			}
+			if online {
+				return step.Device + " is online", nil
+			}
+			if time.Now().After(deadline) {
+				return "", errors.New("Timed out waiting for " + step.Device)
+			}
+			time.Sleep(waitOnlinePoll)
+		}
+	}
+	if strings.HasPrefix(step.Action, "scenes/") {
+		return "", errors.New("Scenes can't run other scenes")
+	}
+	return RunAction(step.Action)
+}
+
+//beginSceneRun records that a scene has started, refusing if it is already running
+func beginSceneRun(name string) (*SceneRun, error) {
+	sceneRunsMutex.Lock()
+	defer sceneRunsMutex.Unlock()
+	if run, ok := sceneRuns[name]; ok && run.Running {
+		return nil, errors.New("Scene " + name + " is already running")
+	}
+	run := &SceneRun{Scene: name, Started: time.Now(), Running: true}
+	sceneRuns[name] = run
+	return run, nil
+}
+
+//executeScene runs each step of a scene in order, recording results in run as it goes
+func executeScene(s Scene, run *SceneRun) {
+	for i, step := range s.Steps {
+		start := time.Now()
+		output, err := runStep(step)
+		result := StepResult{Step: step, Output: output, Duration: time.Since(start)}
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		sceneRunsMutex.Lock()
+		run.Steps = append(run.Steps, result)
+		if err != nil && !step.ContinueOnError {
+			run.Error = "failed at step " + strconv.Itoa(i+1) + " (" + step.Action + "): " + err.Error()
+			for _, rest := range s.Steps[i+1:] {
+				run.Steps = append(run.Steps, StepResult{Step: rest, Skipped: true})
+			}
+		}
+		sceneRunsMutex.Unlock()
+		liveSceneStep(s.Name, i+1, len(s.Steps), result)
+
+		if err != nil && !step.ContinueOnError {
+			break
+		}
+	}
+
+	sceneRunsMutex.Lock()
+	run.Running = false
+	run.Finished = time.Now()
+	sceneRunsMutex.Unlock()
+	Publish(Event{Type: EventScene, Device: "kiwiland", Value: s.Name})
+}
+
+//RunScene runs a scene from the config and waits for it to finish
+func RunScene(name string) (SceneRun, error) {
+	s, err := LoadScene(name)
+	if err != nil {
+		return SceneRun{}, err
+	}
+	run, err := beginSceneRun(name)
+	if err != nil {
+		return SceneRun{}, err
+	}
+	executeScene(s, run)
+
+	result, _ := LastSceneRun(name)
+	if result.Error != "" {
+		return result, errors.New(result.Summary())
+	}
+	return result, nil
+}
+
+//StartScene runs a scene from the config in the background. Use LastSceneRun to follow its progress
+func StartScene(name string) error {
+	s, err := LoadScene(name)
+	if err != nil {
+		return err
+	}
+	run, err := beginSceneRun(name)
+	if err != nil {
+		return err
+	}
+	go executeScene(s, run)
+	return nil
+}
@@ -0,0 +1,259 @@
+package kiwiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+//CatchUpXxxx are what a schedule does about runs it missed while kiwiland was down
+const (
+	CatchUpSkip = "skip" //forget about them
+	CatchUpOnce = "once" //run once as soon as kiwiland starts, however many were missed
+)
+
+//A Schedule runs an action at times given by a cron expression, or once at a given time
+type Schedule struct {
+	ID      string
+	Name    string
+	Action  string    //anything RunAction accepts
+	Cron    string    //eg "0 1 * * *" for every night at 01:00. Empty for a one-shot schedule
+	At      time.Time //when a one-shot schedule runs
+	CatchUp string    //one of the CatchUpXxxx constants. Empty means CatchUpSkip
+	Paused  bool
+	Done    bool //one-shot schedules are done once they have run
+
+	Next       time.Time
+	LastRun    time.Time
+	LastResult string
+	LastError  string
+}
+
+//A Schedulelist is a slice of schedules, useful for the website to keep around
+type Schedulelist struct {
+	Schedules []Schedule
+
+	mu sync.Mutex
+}
+
+var schedules Schedulelist
+
+//nextRun works out when a schedule should next run after the given time, or the zero time if it shouldn't
+func (s Schedule) nextRun(after time.Time) time.Time {
+	if s.Paused || s.Done {
+		return time.Time{}
+	}
+	if s.Cron == "" {
+		return s.At
+	}
+	spec, err := ParseCron(s.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+	return spec.Next(after)
+}
+
+//checkSchedule returns an error if a new schedule can't work
+func checkSchedule(s Schedule) error {
+	if s.Name == "" {
+		return errors.New("Schedules need a name")
+	}
+	if err := CheckAction(s.Action); err != nil {
+		return errors.New("Bad action " + s.Action + ": " + err.Error())
+	}
+	if s.Cron != "" {
+		if _, err := ParseCron(s.Cron); err != nil {
+			return err
+		}
+	} else if s.At.Before(time.Now()) {
+		return errors.New("One-shot schedules need a time in the future")
+	}
+	switch s.CatchUp {
+	case "", CatchUpSkip, CatchUpOnce:
+	default:
+		return errors.New("Unknown catch up policy: " + s.CatchUp)
+	}
+	return nil
+}
+
+//AddSchedule checks a new schedule and adds it to the schedulelist
+func (sl *Schedulelist) AddSchedule(s Schedule) error {
+	if err := checkSchedule(s); err != nil {
+		return err
+	}
+	id, err := GenerateValidationKey()
+	if err != nil {
+		return err
+	}
+	s.ID = id[:8]
+	s.Next = s.nextRun(time.Now())
+
+	sl.mu.Lock()
+	sl.Schedules = append(sl.Schedules, s)
+	sl.mu.Unlock()
+	SaveSchedules()
+	return nil
+}
+
+//RemoveSchedule removes a schedule from the schedulelist
+func (sl *Schedulelist) RemoveSchedule(id string) error {
+	sl.mu.Lock()
+	for i := 0; i < len(sl.Schedules); i++ {
+		if sl.Schedules[i].ID == id {
+			sl.Schedules = append(sl.Schedules[:i], sl.Schedules[i+1:]...)
+			sl.mu.Unlock()
+			SaveSchedules()
+			return nil
+		}
+	}
+	sl.mu.Unlock()
+	return errors.New("Schedule not found")
+}
+
+//TogglePaused pauses a running schedule or resumes a paused one
+func (sl *Schedulelist) TogglePaused(id string) (Schedule, error) {
+	sl.mu.Lock()
+	for i := 0; i < len(sl.Schedules); i++ {
+		if sl.Schedules[i].ID == id {
+			sl.Schedules[i].Paused = !sl.Schedules[i].Paused
+			sl.Schedules[i].Next = sl.Schedules[i].nextRun(time.Now())
+			s := sl.Schedules[i]
+			sl.mu.Unlock()
+			SaveSchedules()
+			return s, nil
+		}
+	}
+	sl.mu.Unlock()
+	return Schedule{}, errors.New("Schedule not found")
+}
+
+//List returns a copy of the schedules, soonest first
+func (sl *Schedulelist) List() []Schedule {
+	sl.mu.Lock()
+	list := append([]Schedule(nil), sl.Schedules...)
+	sl.mu.Unlock()
+
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Next.IsZero() != list[j].Next.IsZero() {
+			return !list[i].Next.IsZero()
+		}
+		return list[i].Next.Before(list[j].Next)
+	})
+	return list
+}
+
+//runSchedule runs a due schedule's action and records the result
+func (sl *Schedulelist) runSchedule(s Schedule) {
+	start := time.Now()
+	result, err := PerformAction(s.Action, "schedule "+s.Name, "")
+	log.Printf("Schedule %s ran %s: %s", s.ID, s.Action, result)
+
+	sl.mu.Lock()
+	for i := 0; i < len(sl.Schedules); i++ {
+		if sl.Schedules[i].ID == s.ID {
+			sl.Schedules[i].LastRun = start
+			sl.Schedules[i].LastResult = result
+			sl.Schedules[i].LastError = ""
+			if err != nil {
+				sl.Schedules[i].LastError = err.Error()
+			}
+		}
+	}
+	sl.mu.Unlock()
+	SaveSchedules()
+}
+
+//due finds the schedules whose time has come, and moves them on to their next run
+func (sl *Schedulelist) due(now time.Time) []Schedule {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	var due []Schedule
+	for i := range sl.Schedules {
+		s := &sl.Schedules[i]
+		if s.Next.IsZero() || s.Next.After(now) {
+			continue
+		}
+		due = append(due, *s)
+		if s.Cron == "" {
+			s.Done = true
+		}
+		s.Next = s.nextRun(now)
+	}
+	return due
+}
+
+//catchUp deals with schedules that came due while kiwiland wasn't running
+func (sl *Schedulelist) catchUp(now time.Time) {
+	sl.mu.Lock()
+	var missed []Schedule
+	for i := range sl.Schedules {
+		s := &sl.Schedules[i]
+		if s.Next.IsZero() || !s.Next.Before(now) {
+			continue
+		}
+		if s.CatchUp == CatchUpOnce {
+			log.Printf("Schedule %s (%s) missed a run at %s, catching up", s.ID, s.Name, s.Next.Format(time.RFC1123))
+			missed = append(missed, *s)
+		} else {
+			log.Printf("Schedule %s (%s) missed a run at %s, skipping it", s.ID, s.Name, s.Next.Format(time.RFC1123))
+		}
+		if s.Cron == "" {
+			s.Done = true
+		}
+		s.Next = s.nextRun(now)
+	}
+	sl.mu.Unlock()
+
+	for _, s := range missed {
+		go sl.runSchedule(s)
+	}
+	SaveSchedules()
+}
+
+//RunScheduler catches up on missed runs, then runs schedules as they come due. It doesn't return
+func RunScheduler() {
+	schedules.catchUp(time.Now())
+	for {
+		//wake up just after the start of each minute, which is as fine as cron gets
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute + time.Second).Sub(now))
+
+		due := schedules.due(time.Now())
+		for _, s := range due {
+			go schedules.runSchedule(s)
+		}
+		if len(due) > 0 {
+			SaveSchedules()
+		}
+	}
+}
+
+const (
+	scheduleFile = "schedules.json"
+)
+
+//LoadSchedules will load the schedules from a json file, if there is one
+func LoadSchedules() {
+	scheduleBytes, err := ioutil.ReadFile(scheduleFile)
+	if err != nil {
+		log.Printf("No schedule file provided. It will be made when you add a schedule.")
+		return
+	}
+	err = json.Unmarshal(scheduleBytes, &schedules)
+	if err != nil {
+		log.Fatalf("Schedule file is broken. Fix or delete it and restart program.")
+	}
+}
+
+//SaveSchedules will save the schedule file. The schedulelist is locked while writing so saves don't interleave
+func SaveSchedules() {
+	schedules.mu.Lock()
+	defer schedules.mu.Unlock()
+	scheduleBytes, _ := json.MarshalIndent(&schedules, "", "\t")
+	ioutil.WriteFile(scheduleFile, scheduleBytes, 0644)
+}
@@ -0,0 +1,86 @@
+package kiwiserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleCatchUp(t *testing.T) {
+	inTempDir(t)
+	configMutex.Lock()
+	config.Scenes = []Scene{{Name: "movie", Steps: []SceneStep{{Action: "wait"}}}}
+	configMutex.Unlock()
+	t.Cleanup(func() {
+		configMutex.Lock()
+		config.Scenes = nil
+		configMutex.Unlock()
+		schedules.mu.Lock()
+		schedules.Schedules = nil
+		schedules.mu.Unlock()
+	})
+
+	//kiwiland was down for two days, and comes back at 12:00
+	now := time.Date(2021, 6, 3, 12, 0, 0, 0, time.UTC)
+	missed := time.Date(2021, 6, 1, 1, 0, 0, 0, time.UTC)
+	schedules.mu.Lock()
+	schedules.Schedules = []Schedule{
+		{ID: "cronOnce", Name: "cronOnce", Action: "scenes/movie/run", Cron: "0 1 * * *", CatchUp: CatchUpOnce, Next: missed},
+		{ID: "cronSkip", Name: "cronSkip", Action: "scenes/movie/run", Cron: "0 1 * * *", CatchUp: CatchUpSkip, Next: missed},
+		{ID: "cronDefault", Name: "cronDefault", Action: "scenes/movie/run", Cron: "0 1 * * *", Next: missed},
+		{ID: "atOnce", Name: "atOnce", Action: "scenes/movie/run", At: missed, CatchUp: CatchUpOnce, Next: missed},
+		{ID: "atSkip", Name: "atSkip", Action: "scenes/movie/run", At: missed, CatchUp: CatchUpSkip, Next: missed},
+		{ID: "later", Name: "later", Action: "scenes/movie/run", At: now.Add(time.Hour), CatchUp: CatchUpOnce, Next: now.Add(time.Hour)},
+	}
+	schedules.mu.Unlock()
+
+	//the ones that catch up run once each, however many runs they missed
+	runs := func(name string) int {
+		return len(AuditLog(AuditFilter{User: "schedule " + name, Action: "scenes/movie/run"}))
+	}
+	before := make(map[string]int)
+	for _, s := range schedules.List() {
+		before[s.ID] = runs(s.ID)
+	}
+
+	schedules.catchUp(now)
+
+	ran := func() int {
+		n := 0
+		for _, s := range schedules.List() {
+			if !s.LastRun.IsZero() {
+				n++
+			}
+		}
+		return n
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for ran() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the schedules that catch up didn't run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond) //for them to save, and for any that shouldn't have run to show up
+
+	want := map[string]struct {
+		runs int
+		next time.Time
+		done bool
+	}{
+		"cronOnce":    {1, time.Date(2021, 6, 4, 1, 0, 0, 0, time.UTC), false},
+		"cronSkip":    {0, time.Date(2021, 6, 4, 1, 0, 0, 0, time.UTC), false},
+		"cronDefault": {0, time.Date(2021, 6, 4, 1, 0, 0, 0, time.UTC), false},
+		"atOnce":      {1, time.Time{}, true},
+		"atSkip":      {0, time.Time{}, true},
+		"later":       {0, now.Add(time.Hour), false},
+	}
+	for _, s := range schedules.List() {
+		w := want[s.ID]
+		if got := runs(s.ID) - before[s.ID]; got != w.runs {
+			t.Errorf("%s ran %d times, want %d", s.ID, got, w.runs)
+		}
+		if !s.Next.Equal(w.next) || s.Done != w.done {
+			t.Errorf("%s is next due %s and done %v, want %s and %v", s.ID, s.Next, s.Done, w.next, w.done)
+		}
+	}
+}
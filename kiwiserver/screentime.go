@@ -0,0 +1,235 @@
+package kiwiserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+//A Viewing is a stretch of time the TV was on one input
+type Viewing struct {
+	Start time.Time
+	End   time.Time
+	Input string //"" if kiwiland didn't know which input it was on
+}
+
+//A Viewinglist is the TV's history, plus what it is doing now
+type Viewinglist struct {
+	Viewings []Viewing
+
+	Current  *Viewing //the viewing still going on, nil if the TV is off
+	LastSeen time.Time
+
+	mu sync.Mutex
+}
+
+var viewings Viewinglist
+
+const (
+	viewingFile = "screentime.json"
+
+	//viewingDays is how long viewings are kept
+	viewingDays = 400
+
+	//lateAfter and lateBefore are what counts as late night viewing
+	lateAfter  = 23
+	lateBefore = 5
+)
+
+//closeViewing finishes the current viewing, if there is one, at the given time. The mutex must be held
+func (vl *Viewinglist) closeViewing(end time.Time) {
+	if vl.Current == nil {
+		return
+	}
+	if end.After(vl.Current.Start) {
+		v := *vl.Current
+		v.End = end
+		vl.Viewings = append(vl.Viewings, v)
+	}
+	vl.Current = nil
+
+	cutoff := end.AddDate(0, 0, -viewingDays)
+	for len(vl.Viewings) > 0 && vl.Viewings[0].End.Before(cutoff) {
+		vl.Viewings = vl.Viewings[1:]
+	}
+}
+
+//recordTV updates the viewings from a change to the TV's power or input
+func (vl *Viewinglist) recordTV(e Event) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	vl.LastSeen = e.Time
+	switch e.Type {
+	case EventPower:
+		if e.Value == "on" && vl.Current == nil {
+			vl.Current = &Viewing{Start: e.Time, Input: GetState("tv", EventInput)}
+		} else if e.Value != "on" {
+			vl.closeViewing(e.Time)
+		}
+	case EventInput:
+		if vl.Current != nil && vl.Current.Input == "" {
+			vl.Current.Input = e.Value //it has probably been on this input since it was turned on
+		} else if vl.Current != nil && vl.Current.Input != e.Value {
+			vl.closeViewing(e.Time)
+			vl.Current = &Viewing{Start: e.Time, Input: e.Value}
+		}
+	}
+	vl.save()
+}
+
+//Between returns the viewings that overlap a period, including the current one up to now
+func (vl *Viewinglist) Between(from time.Time, to time.Time) []Viewing {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	var list []Viewing
+	for _, v := range vl.Viewings {
+		if v.End.After(from) && v.Start.Before(to) {
+			list = append(list, v)
+		}
+	}
+	if vl.Current != nil && vl.Current.Start.Before(to) {
+		v := *vl.Current
+		v.End = time.Now()
+		list = append(list, v)
+	}
+	return list
+}
+
+//overlap is how much of one period falls in another
+func overlap(start time.Time, end time.Time, from time.Time, to time.Time) time.Duration {
+	if from.After(start) {
+		start = from
+	}
+	if to.Before(end) {
+		end = to
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+//A DayUsage is how much the TV was on in one day
+type DayUsage struct {
+	Date      time.Time
+	Total     time.Duration
+	LateNight time.Duration
+	ByInput   map[string]time.Duration
+	ByHour    [24]time.Duration
+}
+
+//A ScreenTimeReport sums up the TV's use over some days
+type ScreenTimeReport struct {
+	From      time.Time
+	Days      []DayUsage
+	Total     time.Duration
+	LateNight time.Duration
+	ByInput   map[string]time.Duration
+}
+
+//Inputs lists the inputs used in the report, most watched first
+func (r ScreenTimeReport) Inputs() []string {
+	var inputs []string
+	for input := range r.ByInput {
+		inputs = append(inputs, input)
+	}
+	sort.Slice(inputs, func(i, j int) bool {
+		if r.ByInput[inputs[i]] != r.ByInput[inputs[j]] {
+			return r.ByInput[inputs[i]] > r.ByInput[inputs[j]]
+		}
+		return inputs[i] < inputs[j]
+	})
+	return inputs
+}
+
+//AveragePerDay is the mean time the TV was on each day of the report
+func (r ScreenTimeReport) AveragePerDay() time.Duration {
+	if len(r.Days) == 0 {
+		return 0
+	}
+	return r.Total / time.Duration(len(r.Days))
+}
+
+//ScreenTime works out how much the TV was on for some days from midnight on the given date
+func ScreenTime(from time.Time, days int) ScreenTimeReport {
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 0, days)
+	list := viewings.Between(from, to)
+
+	r := ScreenTimeReport{From: from, ByInput: make(map[string]time.Duration)}
+	for d := 0; d < days; d++ {
+		day := DayUsage{Date: from.AddDate(0, 0, d), ByInput: make(map[string]time.Duration)}
+		for _, v := range list {
+			for h := 0; h < 24; h++ {
+				hourStart := day.Date.Add(time.Duration(h) * time.Hour)
+				on := overlap(v.Start, v.End, hourStart, hourStart.Add(time.Hour))
+				if on == 0 {
+					continue
+				}
+				input := v.Input
+				if input == "" {
+					input = "unknown"
+				}
+				day.ByHour[h] += on
+				day.ByInput[input] += on
+				day.Total += on
+				if h >= lateAfter || h < lateBefore {
+					day.LateNight += on
+				}
+			}
+		}
+		for input, on := range day.ByInput {
+			r.ByInput[input] += on
+		}
+		r.Total += day.Total
+		r.LateNight += day.LateNight
+		r.Days = append(r.Days, day)
+	}
+	return r
+}
+
+//RunScreenTime records the TV's viewings from power and input events, forever
+func RunScreenTime() {
+	events := Subscribe()
+	for e := range events {
+		switch {
+		case e.Device == "tv" && (e.Type == EventPower || e.Type == EventInput):
+			viewings.recordTV(e)
+		case e.Type == EventTime && e.Time.Minute()%5 == 0:
+			//so that a viewing cut short by a restart ends about when kiwiland went down
+			viewings.mu.Lock()
+			if viewings.Current != nil {
+				viewings.LastSeen = e.Time
+				viewings.save()
+			}
+			viewings.mu.Unlock()
+		}
+	}
+}
+
+//LoadScreenTime will load the viewings from a json file, if there is one. A viewing that was going on when kiwiland stopped
+//is ended when kiwiland last saw it; if the TV is still on, the monitor will start a new one
+func LoadScreenTime() {
+	viewingBytes, err := ioutil.ReadFile(viewingFile)
+	if err != nil {
+		return //nothing has been watched yet
+	}
+	viewings.mu.Lock()
+	defer viewings.mu.Unlock()
+	if err := json.Unmarshal(viewingBytes, &viewings); err != nil {
+		log.Println("Screen time file is broken, starting again")
+		viewings.Viewings = nil
+		viewings.Current = nil
+		return
+	}
+	viewings.closeViewing(viewings.LastSeen)
+}
+
+//save will save the viewings file. The mutex must be held
+func (vl *Viewinglist) save() {
+	viewingBytes, _ := json.MarshalIndent(vl, "", "\t")
+	ioutil.WriteFile(viewingFile, viewingBytes, 0644)
+}
@@ -0,0 +1,180 @@
+package kiwiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//A SleepTimer turns the TV off (and optionally sleeps the toshiba) at a set time
+type SleepTimer struct {
+	Fires        time.Time
+	SleepToshiba bool
+	Warn         bool //show a message on the TV a minute before
+}
+
+//Remaining is how long is left until the timer fires, to the second
+func (st SleepTimer) Remaining() time.Duration {
+	return time.Until(st.Fires).Truncate(time.Second)
+}
+
+var (
+	sleepTimerMutex sync.Mutex
+	sleepTimer      *SleepTimer //nil when no timer is set
+	sleepTimerFire  *time.Timer
+	sleepTimerWarn  *time.Timer
+)
+
+const (
+	sleepTimerFile = "sleeptimer.json"
+
+	//sleepTimerWarning is how long before firing the TV shows a warning
+	sleepTimerWarning = time.Minute
+	//sleepTimerMaxMinutes stops a typo setting a timer for next week
+	sleepTimerMaxMinutes = 12 * 60
+)
+
+//armSleepTimer (re)starts the go timers for the current sleep timer. The mutex must be held
+func armSleepTimer() {
+	if sleepTimerFire != nil {
+		sleepTimerFire.Stop()
+		sleepTimerFire = nil
+	}
+	if sleepTimerWarn != nil {
+		sleepTimerWarn.Stop()
+		sleepTimerWarn = nil
+	}
+	if sleepTimer == nil {
+		return
+	}
+	sleepTimerFire = time.AfterFunc(time.Until(sleepTimer.Fires), fireSleepTimer)
+	if sleepTimer.Warn && time.Until(sleepTimer.Fires) > sleepTimerWarning {
+		sleepTimerWarn = time.AfterFunc(time.Until(sleepTimer.Fires)-sleepTimerWarning, warnSleepTimer)
+	}
+}
+
+//warnSleepTimer puts a message on the TV a minute before the timer fires
+func warnSleepTimer() {
+	if _, err := TVShowMessage("TV off in 1m"); err != nil {
+		log.Println("Sleep timer warning failed:", err.Error())
+	}
+}
+
+//fireSleepTimer turns the TV off, and sleeps the toshiba if asked, then clears the timer
+func fireSleepTimer() {
+	sleepTimerMutex.Lock()
+	st := sleepTimer
+	if st == nil || time.Now().Before(st.Fires) {
+		//the timer was cancelled or moved after this go timer had already started
+		sleepTimerMutex.Unlock()
+		return
+	}
+	sleepTimer = nil
+	armSleepTimer()
+	saveSleepTimer()
+	sleepTimerMutex.Unlock()
+
+	log.Println("Sleep timer fired")
+	if _, err := PerformAction("tv/poweroff", "sleep timer", ""); err != nil {
+		log.Println("Sleep timer could not turn the TV off:", err.Error())
+	}
+	if st.SleepToshiba {
+		if _, err := SuspendToshiba(); err != nil {
+			log.Println("Sleep timer could not sleep the toshiba:", err.Error())
+		}
+	}
+}
+
+//SetSleepTimer starts (or replaces) the sleep timer
+func SetSleepTimer(minutes int, sleepToshiba bool, warn bool) error {
+	if minutes < 1 || minutes > sleepTimerMaxMinutes {
+		return errors.New("Sleep timers must be between 1 minute and 12 hours")
+	}
+	sleepTimerMutex.Lock()
+	defer sleepTimerMutex.Unlock()
+
+	sleepTimer = &SleepTimer{Fires: time.Now().Add(time.Duration(minutes) * time.Minute), SleepToshiba: sleepToshiba, Warn: warn}
+	armSleepTimer()
+	saveSleepTimer()
+	return nil
+}
+
+//ExtendSleepTimer pushes the sleep timer back by some minutes
+func ExtendSleepTimer(minutes int) error {
+	if minutes < 1 {
+		return errors.New("Sleep timers can only be extended by at least 1 minute")
+	}
+	sleepTimerMutex.Lock()
+	defer sleepTimerMutex.Unlock()
+
+	if sleepTimer == nil {
+		return errors.New("There is no sleep timer to extend")
+	}
+	fires := sleepTimer.Fires.Add(time.Duration(minutes) * time.Minute)
+	if time.Until(fires) > sleepTimerMaxMinutes*time.Minute {
+		return errors.New("Sleep timers can't be more than 12 hours away")
+	}
+	sleepTimer.Fires = fires
+	armSleepTimer()
+	saveSleepTimer()
+	return nil
+}
+
+//CancelSleepTimer stops the sleep timer
+func CancelSleepTimer() error {
+	sleepTimerMutex.Lock()
+	defer sleepTimerMutex.Unlock()
+
+	if sleepTimer == nil {
+		return errors.New("There is no sleep timer to cancel")
+	}
+	sleepTimer = nil
+	armSleepTimer()
+	saveSleepTimer()
+	return nil
+}
+
+//CurrentSleepTimer returns a copy of the sleep timer, or nil if there isn't one
+func CurrentSleepTimer() *SleepTimer {
+	sleepTimerMutex.Lock()
+	defer sleepTimerMutex.Unlock()
+
+	if sleepTimer == nil {
+		return nil
+	}
+	st := *sleepTimer
+	return &st
+}
+
+//LoadSleepTimer restores a sleep timer saved before a restart. If it should have fired while we were down, it fires now
+func LoadSleepTimer() {
+	timerBytes, err := ioutil.ReadFile(sleepTimerFile)
+	if err != nil {
+		return //no timer was set
+	}
+	var st SleepTimer
+	if err := json.Unmarshal(timerBytes, &st); err != nil {
+		log.Println("Sleep timer file is broken, ignoring it")
+		return
+	}
+
+	sleepTimerMutex.Lock()
+	defer sleepTimerMutex.Unlock()
+	sleepTimer = &st
+	armSleepTimer() //AfterFunc with a negative duration fires straight away
+	log.Printf("Restored sleep timer for %s", st.Fires.Format(time.RFC1123))
+}
+
+//saveSleepTimer will save the sleep timer file, or remove it if there is no timer. The mutex must be held
+func saveSleepTimer() {
+	if sleepTimer == nil {
+		os.Remove(sleepTimerFile)
+		return
+	}
+	timerBytes, _ := json.MarshalIndent(sleepTimer, "", "\t")
+	ioutil.WriteFile(sleepTimerFile, timerBytes, 0644)
+}
@@ -0,0 +1,206 @@
+package kiwiserver
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A Snapshot is what a device's state was just before an action changed it
+type Snapshot struct {
+	Time   time.Time
+	Action string
+	State  map[string]string //the parts of the state that were known, eg "power": "on", "input": "hdmi4"
+	Volume int               //for volume actions, how many steps up (or down, if negative) have been taken since
+}
+
+//Describe says what restoring the snapshot would do, eg "on, hdmi4" or "volume down 3"
+func (s Snapshot) Describe() string {
+	var parts []string
+	for _, key := range []string{EventPower, EventInput, EventOnline} {
+		if value, ok := s.State[key]; ok {
+			parts = append(parts, value)
+		}
+	}
+	if s.Volume > 0 {
+		parts = append(parts, "volume down "+strconv.Itoa(s.Volume))
+	} else if s.Volume < 0 {
+		parts = append(parts, "volume up "+strconv.Itoa(-s.Volume))
+	}
+	return strings.Join(parts, ", ")
+}
+
+var (
+	snapshotsMutex sync.Mutex
+	snapshots      = make(map[string][]Snapshot) //each device's stack, newest last
+)
+
+const (
+	//snapshotDepth is how many snapshots each device keeps
+	snapshotDepth = 10
+	//volumeRun is how close together volume presses must be to be undone as one
+	volumeRun = 5 * time.Minute
+)
+
+//snapshotKeys works out which device an action changes, and which parts of its state are worth remembering
+func snapshotKeys(action string) (string, []string) {
+	parts := strings.Split(action, "/")
+	switch {
+	case action == "tv/poweron" || action == "tv/poweroff" || strings.HasPrefix(action, "tv/hdmi"):
+		return "tv", []string{EventPower, EventInput}
+	case action == "tv/volumeup" || action == "tv/volumedown":
+		return "tv", nil
+	case action == "toshiba/wol" || action == "toshiba/sleep" || action == "toshiba/sleeponlan" || action == "toshiba/shutdown":
+		return "toshiba", []string{EventOnline}
+	case len(parts) == 3 && parts[0] == "devices" && parts[2] == "wake":
+		return parts[1], []string{EventOnline}
+	}
+	return "", nil
+}
+
+//takeSnapshot reads the state an action is about to change. The snapshot is only kept when the returned func is called,
+//which should be once the action has worked, so that a failed action can't be restored to
+func takeSnapshot(action string) func() {
+	device, keys := snapshotKeys(action)
+	if device == "" {
+		return func() {}
+	}
+	state := make(map[string]string)
+	for _, key := range keys {
+		if value := GetState(device, key); value != "" {
+			state[key] = value
+		}
+	}
+
+	return func() {
+		now := time.Now()
+		snapshotsMutex.Lock()
+		defer snapshotsMutex.Unlock()
+		stack := snapshots[device]
+
+		if action == "tv/volumeup" || action == "tv/volumedown" {
+			step := 1
+			if action == "tv/volumedown" {
+				step = -1
+			}
+			if n := len(stack); n > 0 && stack[n-1].Action == "tv/volume" && now.Sub(stack[n-1].Time) < volumeRun {
+				stack[n-1].Volume += step
+				stack[n-1].Time = now
+				if stack[n-1].Volume == 0 {
+					snapshots[device] = stack[:n-1] //the presses cancelled out
+				}
+				return
+			}
+			stack = append(stack, Snapshot{Time: now, Action: "tv/volume", Volume: step})
+		} else {
+			if len(state) == 0 {
+				return //nothing known to go back to
+			}
+			stack = append(stack, Snapshot{Time: now, Action: action, State: state})
+		}
+
+		if len(stack) > snapshotDepth {
+			stack = stack[len(stack)-snapshotDepth:]
+		}
+		snapshots[device] = stack
+	}
+}
+
+//Snapshots returns a device's snapshots, newest first
+func Snapshots(device string) []Snapshot {
+	snapshotsMutex.Lock()
+	defer snapshotsMutex.Unlock()
+	stack := snapshots[device]
+	list := make([]Snapshot, len(stack))
+	for i, s := range stack {
+		list[len(stack)-1-i] = s
+	}
+	return list
+}
+
+//lastSnapshot returns the newest snapshot on a device's stack, leaving it there
+func lastSnapshot(device string) (Snapshot, bool) {
+	snapshotsMutex.Lock()
+	defer snapshotsMutex.Unlock()
+	stack := snapshots[device]
+	if len(stack) == 0 {
+		return Snapshot{}, false
+	}
+	return stack[len(stack)-1], true
+}
+
+//dropSnapshot takes a snapshot off a device's stack once it has been restored. Other actions may have added
+//snapshots since, so it is found by its time and action rather than assumed to be the newest
+func dropSnapshot(device string, s Snapshot) {
+	snapshotsMutex.Lock()
+	defer snapshotsMutex.Unlock()
+	stack := snapshots[device]
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i].Time.Equal(s.Time) && stack[i].Action == s.Action {
+			snapshots[device] = append(stack[:i:i], stack[i+1:]...)
+			return
+		}
+	}
+}
+
+//ErrNothingToRestore is returned by RestoreDevice when nothing has changed a device since kiwiland started, or it has
+//already been restored as far back as it goes
+var ErrNothingToRestore = errors.New("There is nothing to restore to")
+
+//RestoreDevice puts a device back how it was before the last action that changed it. The TV is turned on (or off) first,
+//then its input is changed, then volume presses are undone. The snapshot is only used up if all of that works, so a
+//failed restore can be tried again
+func RestoreDevice(device string) (string, error) {
+	s, ok := lastSnapshot(device)
+	if !ok {
+		return "", ErrNothingToRestore
+	}
+
+	var wants []Want
+	if power, ok := s.State[EventPower]; ok {
+		wants = append(wants, Want{Device: device, Key: EventPower, Value: power})
+	}
+	if input, ok := s.State[EventInput]; ok && s.State[EventPower] != "standby" {
+		wants = append(wants, Want{Device: device, Key: EventInput, Value: input})
+	}
+	if online, ok := s.State[EventOnline]; ok {
+		wants = append(wants, Want{Device: device, Key: EventOnline, Value: online})
+	}
+
+	var results []string
+	for _, w := range wants {
+		if GetState(w.Device, w.Key) == w.Value {
+			continue
+		}
+		action, err := fixAction(w)
+		if err == nil {
+			_, err = runAction(action, false)
+		}
+		if err != nil {
+			return strings.Join(append(results, w.String()+" failed"), ", "), err
+		}
+		results = append(results, action)
+	}
+
+	volume := "tv/volumedown"
+	steps := s.Volume
+	if steps < 0 {
+		volume, steps = "tv/volumeup", -steps
+	}
+	for i := 0; i < steps; i++ {
+		if _, err := runAction(volume, false); err != nil {
+			return strings.Join(append(results, volume+" failed"), ", "), err
+		}
+	}
+	if steps > 0 {
+		results = append(results, volume+" x"+strconv.Itoa(steps))
+	}
+
+	dropSnapshot(device, s)
+	if len(results) == 0 {
+		return "Restored " + device + " to " + s.Describe() + ", which it already was", nil
+	}
+	return "Restored " + device + " to " + s.Describe() + ": " + strings.Join(results, ", "), nil
+}
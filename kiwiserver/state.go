@@ -0,0 +1,46 @@
+package kiwiserver
+
+import (
+	"sync"
+)
+
+var (
+	stateMutex sync.Mutex
+	state      = make(map[string]map[string]string) //device -> key -> value, eg state["tv"]["power"] is "on"
+)
+
+//GetState returns what kiwiland last knew of part of a device's state, or "" if it doesn't know
+func GetState(device string, key string) string {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	return state[device][key]
+}
+
+//StateSnapshot returns a copy of everything kiwiland knows about its devices
+func StateSnapshot() map[string]map[string]string {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	snapshot := make(map[string]map[string]string, len(state))
+	for device, keys := range state {
+		snapshot[device] = make(map[string]string, len(keys))
+		for key, value := range keys {
+			snapshot[device][key] = value
+		}
+	}
+	return snapshot
+}
+
+//SetState records part of a device's state. If it has changed, an event of type key is published
+func SetState(device string, key string, value string, source string) {
+	stateMutex.Lock()
+	if state[device] == nil {
+		state[device] = make(map[string]string)
+	}
+	previous := state[device][key]
+	state[device][key] = value
+	stateMutex.Unlock()
+
+	if previous != value {
+		Publish(Event{Type: key, Device: device, Value: value, Previous: previous, Source: source})
+	}
+}
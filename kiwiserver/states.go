@@ -0,0 +1,277 @@
+package kiwiserver
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A Want is one part of a desired state, eg the TV's input should be hdmi4
+type Want struct {
+	Device string
+	Key    string //"power", "input" or "online"
+	Value  string
+
+	Action string //what to run to fix it, for wants kiwiland can't work out an action for itself
+}
+
+//String describes a want, eg "tv input hdmi4"
+func (w Want) String() string {
+	return w.Device + " " + w.Key + " " + w.Value
+}
+
+//A DesiredState is a named set of wants, eg "movie" might be the TV on, on hdmi4, and the toshiba online.
+//Applying it fixes whatever doesn't match, checking again until everything does or it runs out of attempts
+type DesiredState struct {
+	Name     string
+	Wants    []Want
+	Attempts int //how many rounds of fixing to try. 0 means 5
+	Seconds  int //how long to give each round's actions to take effect. 0 means 10
+}
+
+//attempts is how many rounds of fixing to try
+func (ds DesiredState) attempts() int {
+	if ds.Attempts <= 0 {
+		return 5
+	}
+	return ds.Attempts
+}
+
+//interval is how long to give each round's actions to take effect
+func (ds DesiredState) interval() time.Duration {
+	if ds.Seconds <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(ds.Seconds) * time.Second
+}
+
+//A Fix is an action taken while applying a desired state
+type Fix struct {
+	Round    int
+	Want     Want
+	Observed string
+	Action   string
+	Output   string
+	Error    string
+}
+
+//A Reconciliation is the progress and outcome of applying a desired state
+type Reconciliation struct {
+	State     string
+	Started   time.Time
+	Finished  time.Time
+	Running   bool
+	Rounds    int //how many rounds of fixes there have been
+	Converged bool
+	Fixes     []Fix
+	Drift     []string //what didn't match at the last check, eg "tv input is hdmi1, want hdmi4"
+}
+
+//Summary describes a reconciliation in one line, eg "movie: converged after 2 fixes"
+func (r Reconciliation) Summary() string {
+	switch {
+	case r.Running:
+		return r.State + ": running"
+	case r.Converged && len(r.Fixes) == 0:
+		return r.State + ": already as wanted"
+	case r.Converged:
+		return r.State + ": converged after " + strconv.Itoa(len(r.Fixes)) + " fixes"
+	}
+	return r.State + ": gave up after " + strconv.Itoa(r.Rounds) + " rounds of fixes, " + strings.Join(r.Drift, "; ")
+}
+
+var (
+	reconciliationsMutex sync.Mutex
+	reconciliations      = make(map[string]*Reconciliation) //the latest reconciliation of each desired state
+)
+
+//LoadDesiredState will load a desired state from the config
+func LoadDesiredState(name string) (DesiredState, error) {
+	for _, s := range currentConfig().States {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+	return DesiredState{}, errors.New("Desired state not found")
+}
+
+//DesiredStates returns the desired states in the config
+func DesiredStates() []DesiredState {
+	return currentConfig().States
+}
+
+//LastReconciliation returns a copy of the latest reconciliation of a desired state, and false if it has never been applied
+func LastReconciliation(name string) (Reconciliation, bool) {
+	reconciliationsMutex.Lock()
+	defer reconciliationsMutex.Unlock()
+	r, ok := reconciliations[name]
+	if !ok {
+		return Reconciliation{}, false
+	}
+	cp := *r
+	cp.Fixes = append([]Fix(nil), r.Fixes...)
+	cp.Drift = append([]string(nil), r.Drift...)
+	return cp, true
+}
+
+//observe checks a device for the current value of a want, rather than trusting what kiwiland last knew. If the device
+//can't be asked, or the TV is still turning on or off, it returns an error instead of the last known value, so that a
+//value kiwiland only expects can't count as converged
+func observe(w Want) (string, error) {
+	switch {
+	case w.Device == "tv" && w.Key == EventPower:
+		out, err := TVGetStatus()
+		if err != nil {
+			return "", err
+		}
+		power := parseTVPower(out)
+		if power == "" {
+			return "", errors.New("the TV didn't say it is on or in standby, it may still be changing")
+		}
+		return power, nil
+	case w.Device == "tv" && w.Key == EventInput:
+		return TVGetInput()
+	case w.Key == EventOnline:
+		online, err := DeviceOnline(w.Device)
+		if err != nil {
+			return "", err
+		}
+		value := "offline"
+		if online {
+			value = "online"
+		}
+		SetState(w.Device, EventOnline, value, SourceObserved)
+		return value, nil
+	}
+	return GetState(w.Device, w.Key), nil
+}
+
+//fixAction is the action which should make a want come true
+func fixAction(w Want) (string, error) {
+	if w.Action != "" {
+		return w.Action, nil
+	}
+	switch {
+	case w.Device == "tv" && w.Key == EventPower && w.Value == "on":
+		return "tv/poweron", nil
+	case w.Device == "tv" && w.Key == EventPower && w.Value == "standby":
+		return "tv/poweroff", nil
+	case w.Device == "tv" && w.Key == EventInput:
+		return "tv/" + w.Value, nil
+	case w.Key == EventOnline && w.Value == "online":
+		return "devices/" + w.Device + "/wake", nil
+	case w.Device == "toshiba" && w.Key == EventOnline && w.Value == "offline" && AgentEnabled():
+		return "toshiba/sleep", nil
+	case w.Device == "toshiba" && w.Key == EventOnline && w.Value == "offline" && SleepOnLANEnabled():
+		return "toshiba/sleeponlan", nil
+	}
+	return "", errors.New("kiwiland doesn't know how to make " + w.String() + ", give it an Action")
+}
+
+//beginReconciliation records that a desired state is being applied, refusing if it already is
+func beginReconciliation(name string) (*Reconciliation, error) {
+	reconciliationsMutex.Lock()
+	defer reconciliationsMutex.Unlock()
+	if r, ok := reconciliations[name]; ok && r.Running {
+		return nil, errors.New("Desired state " + name + " is already being applied")
+	}
+	r := &Reconciliation{State: name, Started: time.Now(), Running: true}
+	reconciliations[name] = r
+	return r, nil
+}
+
+//reconcile compares a desired state with the devices and fixes what doesn't match, round after round, until it all matches
+//or the attempts run out. Each round fixes the first mismatch on each device, so the TV is on before its input is changed
+func reconcile(ds DesiredState, r *Reconciliation) {
+	for round := 1; ; round++ {
+		var drift []string
+		var fixes []Fix
+		drifting := make(map[string]bool)
+		for _, w := range ds.Wants {
+			current, err := observe(w)
+			if err == nil && current == w.Value {
+				continue
+			}
+			if err != nil {
+				current = "unreadable (" + err.Error() + ")"
+			} else if current == "" {
+				current = "unknown"
+			}
+			drift = append(drift, w.Device+" "+w.Key+" is "+current+", want "+w.Value)
+			if !drifting[w.Device] {
+				drifting[w.Device] = true
+				fixes = append(fixes, Fix{Round: round, Want: w, Observed: current})
+			}
+		}
+
+		reconciliationsMutex.Lock()
+		r.Drift = drift
+		done := len(drift) == 0 || round > ds.attempts()
+		if done {
+			r.Rounds = round - 1
+			r.Converged = len(drift) == 0
+			r.Running = false
+			r.Finished = time.Now()
+		} else {
+			r.Rounds = round
+		}
+		reconciliationsMutex.Unlock()
+		if done {
+			if len(drift) > 0 {
+				log.Printf("Gave up applying %s: %s", ds.Name, strings.Join(drift, "; "))
+			}
+			return
+		}
+
+		for _, fix := range fixes {
+			action, err := fixAction(fix.Want)
+			if err == nil {
+				fix.Action = action
+				fix.Output, err = RunAction(action)
+			}
+			if err != nil {
+				fix.Error = err.Error()
+			}
+			reconciliationsMutex.Lock()
+			r.Fixes = append(r.Fixes, fix)
+			reconciliationsMutex.Unlock()
+		}
+		time.Sleep(ds.interval())
+	}
+}
+
+//ApplyDesiredState applies a desired state from the config and waits until it converges or gives up
+func ApplyDesiredState(name string) (Reconciliation, error) {
+	ds, err := LoadDesiredState(name)
+	if err != nil {
+		return Reconciliation{}, err
+	}
+	r, err := beginReconciliation(name)
+	if err != nil {
+		return Reconciliation{}, err
+	}
+	reconcile(ds, r)
+
+	result, _ := LastReconciliation(name)
+	if !result.Converged {
+		return result, errors.New(result.Summary())
+	}
+	return result, nil
+}
+
+//StartDesiredState applies a desired state from the config in the background. Use LastReconciliation to follow its progress
+func StartDesiredState(name string) error {
+	ds, err := LoadDesiredState(name)
+	if err != nil {
+		return err
+	}
+	r, err := beginReconciliation(name)
+	if err != nil {
+		return err
+	}
+	go reconcile(ds, r)
+	return nil
+}
@@ -0,0 +1,66 @@
+package kiwiserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+//fakeCECClient puts a cec-client on the PATH which answers every command with out
+func fakeCECClient(t *testing.T, out string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake cec-client is a shell script")
+	}
+	dir := t.TempDir()
+	script := "#!/bin/sh\ncat >/dev/null\nprintf '%s' '" + out + "'\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "cec-client"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestParseTVPower(t *testing.T) {
+	tests := []struct {
+		out   string
+		power string
+	}{
+		{"opening a connection to the CEC adapter...\npower status: on\n", "on"},
+		{"opening a connection to the CEC adapter...\npower status: standby\n", "standby"},
+		{"opening a connection to the CEC adapter...\npower status: in transition from standby to on\n", ""},
+		{"opening a connection to the CEC adapter...\npower status: unknown\n", ""},
+		{"opening a connection to the CEC adapter...\n", ""},
+	}
+	for _, test := range tests {
+		if got := parseTVPower(test.out); got != test.power {
+			t.Errorf("%q was read as %q, want %q", test.out, got, test.power)
+		}
+	}
+}
+
+func TestObserveTVTurningOn(t *testing.T) {
+	//kiwiland thinks the TV is on as soon as it has asked it to turn on
+	SetState("tv", EventPower, "on", SourceKiwiland)
+	want := Want{Device: "tv", Key: EventPower, Value: "on"}
+
+	fakeCECClient(t, "opening a connection to the CEC adapter...\npower status: in transition from standby to on\n")
+	if value, err := observe(want); err == nil {
+		t.Errorf("a TV still turning on was observed as %q", value)
+	}
+
+	fakeCECClient(t, "opening a connection to the CEC adapter...\npower status: on\n")
+	if value, err := observe(want); err != nil || value != "on" {
+		t.Errorf("a TV that is on was observed as %q, %v", value, err)
+	}
+}
+
+func TestObserveDeviceWithoutIP(t *testing.T) {
+	inTempDir(t)
+	devices.Devices = []Device{{Name: "nas", MAC: "00:11:22:33:44:55"}}
+	t.Cleanup(func() { devices.Devices = nil })
+	SetState("nas", EventOnline, "online", SourceKiwiland)
+	if value, err := observe(Want{Device: "nas", Key: EventOnline, Value: "online"}); err == nil {
+		t.Errorf("a device with no IP to ping was observed as %q", value)
+	}
+}
@@ -1,7 +1,10 @@
 package kiwiserver
 
 import (
+	"fmt"
 	"html/template"
+	"strconv"
+	"time"
 )
 
 var funcMap = template.FuncMap{
@@ -10,6 +13,73 @@ var funcMap = template.FuncMap{
 	"GetHomeURL":           HomeURL.Make,
 	"GetTVCommandURL":      GetTVCommandURL,
 	"GetToshibaCommandURL": GetToshibaCommandURL,
+	"GetToshibaLaunchURL":  GetToshibaLaunchURL,
+	"AgentEnabled":         AgentEnabled,
+	"AgentApplications":    AgentApplications,
+	"SleepOnLANEnabled":    SleepOnLANEnabled,
+	"GetDiscoverURL":       DiscoverURL.Make,
+	"GetDevicesURL":        DevicesURL.Make,
+	"GetDeviceWakeURL":     GetDeviceWakeURL,
+	"GetDeviceRemoveURL":   GetDeviceRemoveURL,
+	"Devices":              Devices,
+	"GetWakeMACURL":        WakeMACURL.Make,
+	"GetSceneURL":          GetSceneURL,
+	"GetSceneRunURL":       GetSceneRunURL,
+	"Scenes":               Scenes,
+	"GetStateURL":          GetStateURL,
+	"GetStateApplyURL":     GetStateApplyURL,
+	"DesiredStates":        DesiredStates,
+	"GetSchedulesURL":      SchedulesURL.Make,
+	"GetSchedulePauseURL":  GetSchedulePauseURL,
+	"GetScheduleRemoveURL": GetScheduleRemoveURL,
+	"AllActions":           AllActions,
+	"GetSleepTimerURL":     SleepTimerURL.Make,
+	"GetSleepExtendURL":    GetSleepExtendURL,
+	"GetSleepCancelURL":    SleepCancelURL.Make,
+	"SleepTimer":           CurrentSleepTimer,
+	"GetRulesURL":          RulesURL.Make,
+	"Rules":                Rules,
+	"GetAuditURL":          AuditURL.Make,
+	"GetAuditExportURL":    GetAuditExportURL,
+	"AuditUsers":           AuditUsers,
+	"GetRestoreURL":        GetRestoreURL,
+	"Snapshots":            Snapshots,
+	"GetQueueURL":          QueueURL.Make,
+	"GetQueueCancelURL":    GetQueueCancelURL,
+	"QueueableActions":     QueueableActions,
+	"QueueWaiting":         queue.Waiting,
+	"GetScreenTimeURL":     GetScreenTimeURL,
+	"Now":                  time.Now,
+	"FormatDuration":       FormatDuration,
+	"HourlyChart":          HourlyChart,
+	"DailyChart":           DailyChart,
+	"InputColour":          InputColour,
+	"GetIdleKeepOnURL":     IdleKeepOnURL.Make,
+	"GetIdleResumeURL":     IdleResumeURL.Make,
+	"IdleStatus":           CurrentIdleStatus,
+	"GetSettingsURL":       SettingsURL.Make,
+	"GetLiveURL":           LiveURL.Make,
+	"GetWebhooksURL":       WebhooksURL.Make,
+	"GetWebhookTestURL":    GetWebhookTestURL,
+	"Webhooks":             Webhooks,
+	"GetHueURL":            HueURL.Make,
+	"GetHueLinkURL":        HueLinkURL.Make,
+	"GetHueUserRemoveURL":  GetHueUserRemoveURL,
+	"HueEnabled":           HueEnabled,
+	"HueLights":            HueLights,
+	"HueUsers":             HueUsers,
+	"HueLinkButtonPressed": HueLinkButtonPressed,
+	"HueBridgeID":          HueBridgeID,
+	"HueLocation":          HueLocation,
+	"GetHomeKitURL":        HomeKitURL.Make,
+	"GetHomeKitUnpairURL":  HomeKitUnpairURL.Make,
+	"HomeKitEnabled":       HomeKitEnabled,
+	"HomeKitSetupCode":     HomeKitSetupCode,
+	"HomeKitSetupURI":      HomeKitSetupURI,
+	"HomeKitPairings":      HomeKitPairings,
+	"State":                GetState,
+	"GetTokensURL":         TokensURL.Make,
+	"GetTokenRevokeURL":    GetTokenRevokeURL,
 } //this provides templates with the ability to run useful functions
 
 //GetTVCommandURL makes a tv command URL
@@ -21,3 +91,102 @@ func GetTVCommandURL(command string) string {
 func GetToshibaCommandURL(command string) string {
 	return ToshibaCommandURL.Make("command", command)
 }
+
+//GetToshibaLaunchURL makes a toshiba application launch URL
+func GetToshibaLaunchURL(application string) string {
+	return ToshibaLaunchURL.Make("application", application)
+}
+
+//GetDeviceWakeURL makes a device wake URL
+func GetDeviceWakeURL(device string) string {
+	return DeviceWakeURL.Make("device", device)
+}
+
+//GetDeviceRemoveURL makes a device remove URL
+func GetDeviceRemoveURL(device string) string {
+	return DeviceRemoveURL.Make("device", device)
+}
+
+//Devices returns the devices in the devicelist
+func Devices() []Device {
+	return devices.List()
+}
+
+//GetSceneURL makes a scene URL
+func GetSceneURL(scene string) string {
+	return SceneURL.Make("scene", scene)
+}
+
+//GetSceneRunURL makes a scene run URL
+func GetSceneRunURL(scene string) string {
+	return SceneRunURL.Make("scene", scene)
+}
+
+//GetStateURL makes a desired state URL
+func GetStateURL(state string) string {
+	return StateURL.Make("state", state)
+}
+
+//GetStateApplyURL makes a desired state apply URL
+func GetStateApplyURL(state string) string {
+	return StateApplyURL.Make("state", state)
+}
+
+//GetSchedulePauseURL makes a schedule pause URL
+func GetSchedulePauseURL(schedule string) string {
+	return SchedulePauseURL.Make("schedule", schedule)
+}
+
+//GetScheduleRemoveURL makes a schedule remove URL
+func GetScheduleRemoveURL(schedule string) string {
+	return ScheduleRemoveURL.Make("schedule", schedule)
+}
+
+//GetSleepExtendURL makes a sleep timer extend URL
+func GetSleepExtendURL(minutes int) string {
+	return SleepExtendURL.Make("minutes", strconv.Itoa(minutes))
+}
+
+//GetAuditExportURL makes an audit log export URL, keeping the page's filter
+func GetAuditExportURL(format string, query string) string {
+	if query == "" {
+		return AuditExportURL.Make("format", format)
+	}
+	return AuditExportURL.Make("format", format) + "?" + query
+}
+
+//GetRestoreURL makes a URL to restore a device to how it was
+func GetRestoreURL(device string) string {
+	return RestoreURL.Make("device", device)
+}
+
+//GetHueUserRemoveURL makes a URL to unpair a speaker from the hue bridge
+func GetHueUserRemoveURL(user string) string {
+	return HueUserRemoveURL.Make("user", user)
+}
+
+//GetWebhookTestURL makes a URL to send a webhook a test event
+func GetWebhookTestURL(webhook string) string {
+	return WebhookTestURL.Make("webhook", webhook)
+}
+
+//GetTokenRevokeURL makes a URL to revoke an API token
+func GetTokenRevokeURL(token string) string {
+	return TokenRevokeURL.Make("token", token)
+}
+
+//GetQueueCancelURL makes a URL to cancel a queued command
+func GetQueueCancelURL(command string) string {
+	return QueueCancelURL.Make("command", command)
+}
+
+//GetScreenTimeURL makes a screen time report URL for a period ("day" or "week") containing a date
+func GetScreenTimeURL(period string, date time.Time) string {
+	return ScreenTimeURL.Make() + "?period=" + period + "&date=" + date.Format("2006-01-02")
+}
+
+//FormatDuration shows a duration in hours and minutes, eg "2h05m"
+func FormatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	return strconv.Itoa(int(d.Hours())) + "h" + fmt.Sprintf("%02dm", int(d.Minutes())%60)
+}
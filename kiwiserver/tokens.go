@@ -0,0 +1,169 @@
+package kiwiserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+//An APIToken lets a script act as a user without signing in, by sending "Authorization: Bearer <token>". Only a hash of
+//the token is kept, so it can't be read back out of users.json
+type APIToken struct {
+	ID       string
+	Name     string   //eg "phone shortcuts"
+	Hash     string   //hex sha256 of the token
+	Scopes   []string //devices (eg "tv", "nas"), scenes (eg "scenes/movie") or actions (eg "tv/poweron") it may use. Empty means everything
+	Created  time.Time
+	Expires  time.Time //zero for never
+	LastUsed time.Time
+}
+
+//tokenPrefix starts every token, so they are easy to spot in scripts and logs
+const tokenPrefix = "kiwi_"
+
+//tokenLastUsedEvery is how long LastUsed times are kept in memory before users.json is saved, so busy scripts don't
+//write it every request
+const tokenLastUsedEvery = time.Minute
+
+//ErrNotAllowed is returned when an API token's scopes don't cover what it was used for
+var ErrNotAllowed = errors.New("This API token isn't allowed to do that")
+
+//hashToken hashes a token for storing. Tokens are long and random, so a fast hash is enough
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+//Expired reports whether a token has passed its expiry time
+func (t APIToken) Expired() bool {
+	return !t.Expires.IsZero() && time.Now().After(t.Expires)
+}
+
+//Scoped reports whether a token is limited to some devices or actions
+func (t APIToken) Scoped() bool {
+	return len(t.Scopes) > 0
+}
+
+//Allows reports whether a token's scopes cover an action. A device scope covers every action for that device, including
+//waking and restoring it
+func (t APIToken) Allows(action string) bool {
+	if !t.Scoped() {
+		return true
+	}
+	for _, scope := range t.Scopes {
+		switch {
+		case action == scope,
+			strings.HasPrefix(action, scope+"/"),
+			action == "devices/"+scope+"/wake",
+			action == "restore/"+scope:
+			return true
+		}
+	}
+	return false
+}
+
+//parseScopes splits scopes typed into a form, eg "tv, scenes/movie toshiba/wol"
+func parseScopes(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+//AddToken makes a new API token for a user. The token itself is returned, and can't be found again afterwards
+func (ul *Userlist) AddToken(username string, name string, scopes []string, expires time.Time) (string, error) {
+	if name == "" {
+		return "", errors.New("API tokens need a name")
+	}
+	for _, scope := range scopes {
+		if strings.Trim(scope, "/") == "" {
+			return "", errors.New("Bad scope: " + scope)
+		}
+	}
+	if !expires.IsZero() && expires.Before(time.Now()) {
+		return "", errors.New("API tokens need an expiry time in the future")
+	}
+
+	id, err := GenerateValidationKey()
+	if err != nil {
+		return "", err
+	}
+	secret, err := GenerateValidationKey()
+	if err != nil {
+		return "", err
+	}
+	token := tokenPrefix + id[:8] + secret
+
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	for i := 0; i < len(ul.Users); i++ {
+		if ul.Users[i].Username == username {
+			ul.Users[i].Tokens = append(ul.Users[i].Tokens, APIToken{ID: id[:8], Name: name, Hash: hashToken(token), Scopes: scopes, Created: time.Now(), Expires: expires})
+			saveUsers()
+			return token, nil
+		}
+	}
+	return "", errors.New("Username not found")
+}
+
+//RevokeToken deletes one of a user's API tokens
+func (ul *Userlist) RevokeToken(username string, id string) (APIToken, error) {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	for i := 0; i < len(ul.Users); i++ {
+		if ul.Users[i].Username != username {
+			continue
+		}
+		for j, t := range ul.Users[i].Tokens {
+			if t.ID == id {
+				ul.Users[i].Tokens = append(ul.Users[i].Tokens[:j], ul.Users[i].Tokens[j+1:]...)
+				saveUsers()
+				return t, nil
+			}
+		}
+	}
+	return APIToken{}, errors.New("API token not found")
+}
+
+//LoadUsernameFromToken will, given a valid API token, attempt to load a user and the token's details
+func (ul *Userlist) LoadUsernameFromToken(token string) (string, APIToken, error) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return "", APIToken{}, errors.New("Bad API token")
+	}
+	hash := hashToken(token)
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	for i := 0; i < len(ul.Users); i++ {
+		for j := range ul.Users[i].Tokens {
+			t := &ul.Users[i].Tokens[j]
+			if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) != 1 {
+				continue
+			}
+			if t.Expired() {
+				return "", APIToken{}, errors.New("API token has expired")
+			}
+			t.LastUsed = time.Now()
+			if ul.lastUsedSave == nil {
+				ul.lastUsedSave = time.AfterFunc(tokenLastUsedEvery, ul.saveLastUsed)
+			}
+			return ul.Users[i].Username, *t, nil
+		}
+	}
+	return "", APIToken{}, errors.New("Bad API token")
+}
+
+//saveLastUsed saves the API tokens' LastUsed times, at most a minute after they changed
+func (ul *Userlist) saveLastUsed() {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	ul.lastUsedSave = nil
+	saveUsers()
+}
+
+//bearerToken gets the token from an "Authorization: Bearer <token>" header, or "" if there isn't one
+func bearerToken(header string) string {
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
@@ -2,6 +2,7 @@ package kiwiserver
 
 import (
 	"bytes"
+	"errors"
 	"os/exec"
 	"strings"
 )
@@ -16,38 +17,64 @@ func RunCECCommand(command string) (string, error) {
 	return out.String(), err
 }
 
+//tvStateCommand runs a CEC command and, if it worked, records the TV state it will have changed
+func tvStateCommand(command string, key string, value string) (string, error) {
+	out, err := RunCECCommand(command)
+	if err == nil {
+		SetState("tv", key, value, SourceKiwiland)
+	}
+	return out, err
+}
+
+//parseTVPower finds the power state in cec-client's response to "pow 0", returning "" if it is missing or in transition
+func parseTVPower(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "power status: ") {
+			switch power := strings.TrimSpace(strings.TrimPrefix(line, "power status: ")); power {
+			case "on", "standby":
+				return power
+			}
+		}
+	}
+	return ""
+}
+
 //TVGetStatus returns the status of the TV using the built-in cec-client command
 //response looks like this: opening a connection to the CEC adapter...\npower status: on\n
 func TVGetStatus() (string, error) {
-	return RunCECCommand("pow 0")
+	out, err := RunCECCommand("pow 0")
+	if power := parseTVPower(out); err == nil && power != "" {
+		SetState("tv", EventPower, power, SourceObserved)
+	}
+	return out, err
 }
 
 //TVTurnOn turns the TV on using the built-in cec-client command
 func TVTurnOn() (string, error) {
-	return RunCECCommand("on 0")
+	return tvStateCommand("on 0", EventPower, "on")
 }
 
 //TVTurnOff turns the TV off using the built-in cec-client command
 func TVTurnOff() (string, error) {
-	return RunCECCommand("standby 0")
+	return tvStateCommand("standby 0", EventPower, "standby")
 }
 
 //TVSelectHDMI4 will set the TV to use HDMI4 using the raw tx command
 //See http://www.cec-o-matic.com/ to decode
 func TVSelectHDMI4() (string, error) {
-	return RunCECCommand("tx 4F:82:40:00")
+	return tvStateCommand("tx 4F:82:40:00", EventInput, "hdmi4")
 }
 
 //TVSelectHDMI2 will set the TV to use HDMI4 using the raw tx command
 //See http://www.cec-o-matic.com/ to decode
 func TVSelectHDMI2() (string, error) {
-	return RunCECCommand("tx 4F:82:20:00")
+	return tvStateCommand("tx 4F:82:20:00", EventInput, "hdmi2")
 }
 
 //TVSelectHDMI1 will set the TV to use HDMI4 using the raw tx command
 //See http://www.cec-o-matic.com/ to decode
 func TVSelectHDMI1() (string, error) {
-	return RunCECCommand("tx 4F:82:10:00")
+	return tvStateCommand("tx 4F:82:10:00", EventInput, "hdmi1")
 }
 
 //TVVolumeUp will set the TV to use HDMI4 using the raw tx command
@@ -61,3 +88,65 @@ func TVVolumeUp() (string, error) {
 func TVVolumeDown() (string, error) {
 	return RunCECCommand("tx 4F:44:42")
 }
+
+//TVRemoteKeys are the remote control buttons kiwiland can press, by name, with their CEC user control codes
+//See http://www.cec-o-matic.com/ to decode
+var TVRemoteKeys = map[string]string{
+	"select":      "00",
+	"up":          "01",
+	"down":        "02",
+	"left":        "03",
+	"right":       "04",
+	"menu":        "09",
+	"back":        "0D",
+	"info":        "35",
+	"mute":        "43",
+	"rewind":      "48",
+	"fastforward": "49",
+	"next":        "4B",
+	"previous":    "4C",
+	"playpause":   "61",
+}
+
+//TVRemoteKey presses a button on the TV's remote, eg "up" or "playpause", using the raw tx command in the same way as the volume
+func TVRemoteKey(key string) (string, error) {
+	code, ok := TVRemoteKeys[key]
+	if !ok {
+		return "", errors.New("Unknown remote key " + key)
+	}
+	return RunCECCommand("tx 4F:44:" + code)
+}
+
+//TVShowMessage will put a short message (cec allows 13 characters) on the TV's screen using the built-in cec-client command
+func TVShowMessage(message string) (string, error) {
+	if len(message) > 13 {
+		message = message[:13]
+	}
+	return RunCECCommand("osd 0 " + message)
+}
+
+//TVGetInput asks every device which of them is the active source, and works out from its answer which HDMI input the TV is on.
+//This relies on cec-client's traffic logging (-d 8), where the answer looks like ">> 4f:82:40:00" for HDMI4. Not every device answers
+func TVGetInput() (string, error) {
+	cmd := exec.Command("cec-client", "-s", "-d", "8")
+	cmd.Stdin = strings.NewReader("tx 4F:85")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(out.String(), "\n") {
+		i := strings.Index(line, ">> ")
+		if i < 0 {
+			continue
+		}
+		frame := strings.Split(strings.TrimSpace(line[i+3:]), ":")
+		if len(frame) >= 4 && strings.EqualFold(frame[1], "82") && len(frame[2]) == 2 && frame[2][0] >= '1' && frame[2][0] <= '9' {
+			input := "hdmi" + frame[2][:1]
+			SetState("tv", EventInput, input, SourceObserved)
+			return input, nil
+		}
+	}
+	return "", errors.New("No device said it was the active source")
+}
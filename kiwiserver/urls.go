@@ -4,6 +4,8 @@ import (
 	"strings"
 
 	"github.com/gocraft/web"
+	"github.com/kiwih/kiwiland/kiwiagent"
+	"github.com/kiwih/kiwiland/kiwiapi"
 )
 
 //URL is a helper type for URL string types
@@ -15,7 +17,65 @@ const (
 	SignInURL         URL = "/signin"
 	SignOutURL        URL = "/signout"
 	TVCommandURL      URL = "/tv/:command"
+	TVKeyURL          URL = "/tv/key/:key"
 	ToshibaCommandURL URL = "/toshiba/:command"
+	ToshibaLaunchURL  URL = "/toshiba/launch/:application"
+	DiscoverURL       URL = "/discover"
+	DevicesURL        URL = "/devices"
+	DeviceWakeURL     URL = "/devices/:device/wake"
+	DeviceRemoveURL   URL = "/devices/:device/remove"
+	WakeMACURL        URL = "/wake"
+	SceneURL          URL = "/scenes/:scene"
+	SceneRunURL       URL = "/scenes/:scene/run"
+	StateURL          URL = "/states/:state"
+	StateApplyURL     URL = "/states/:state/apply"
+	SchedulesURL      URL = "/schedules"
+	SchedulePauseURL  URL = "/schedules/:schedule/pause"
+	ScheduleRemoveURL URL = "/schedules/:schedule/remove"
+	SleepTimerURL     URL = "/sleeptimer"
+	SleepExtendURL    URL = "/sleeptimer/extend/:minutes"
+	SleepCancelURL    URL = "/sleeptimer/cancel"
+	RulesURL          URL = "/rules"
+	AuditURL          URL = "/audit"
+	AuditExportURL    URL = "/audit/export/:format"
+	ScreenTimeURL     URL = "/screentime"
+	RestoreURL        URL = "/restore/:device"
+	QueueURL          URL = "/queue"
+	QueueCancelURL    URL = "/queue/:command/cancel"
+	IdleKeepOnURL     URL = "/idle/keepon"
+	IdleResumeURL     URL = "/idle/resume"
+	SettingsURL       URL = "/settings"
+	LiveURL           URL = "/live"
+	WebhooksURL       URL = "/webhooks"
+	WebhookTestURL    URL = "/webhooks/:webhook/test"
+	MetricsURL        URL = "/metrics"
+	HueURL            URL = "/hue"
+	HueLinkURL        URL = "/hue/link"
+	HueUserRemoveURL  URL = "/hue/users/:user/remove"
+	HomeKitURL        URL = "/homekit"
+	HomeKitUnpairURL  URL = "/homekit/unpair"
+	TokensURL         URL = "/settings/tokens"
+	TokenRevokeURL    URL = "/settings/tokens/:token/revoke"
+	RelayWakeURL      URL = kiwiagent.WakeRoute //the same as the agent's, so that either can be a relay
+
+	//the API's routes are shared with kiwictl, so that it always matches
+	APIDevicesURL        URL = kiwiapi.DevicesRoute
+	APIDeviceURL         URL = kiwiapi.DeviceRoute
+	APIDeviceWakeURL     URL = kiwiapi.DeviceWakeRoute
+	APIStateURL          URL = kiwiapi.StateRoute
+	APITVCommandURL      URL = kiwiapi.TVCommandRoute
+	APITVKeyURL          URL = kiwiapi.TVKeyRoute
+	APIToshibaCommandURL URL = kiwiapi.ToshibaCommandRoute
+	APIToshibaLaunchURL  URL = kiwiapi.ToshibaLaunchRoute
+	APIRestoreURL        URL = kiwiapi.RestoreRoute
+	APIScenesURL         URL = kiwiapi.ScenesRoute
+	APISceneURL          URL = kiwiapi.SceneRoute
+	APISceneRunURL       URL = kiwiapi.SceneRunRoute
+
+	AdminUsersURL        URL = kiwiapi.AdminUsersRoute
+	AdminUserPasswordURL URL = kiwiapi.AdminUserPasswordRoute
+	AdminUserRemoveURL   URL = kiwiapi.AdminUserRemoveRoute
+	AdminReloadURL       URL = kiwiapi.AdminReloadRoute
 )
 
 //String() converts a URL to a string
@@ -41,6 +101,7 @@ func initRouter() *web.Router {
 
 	rootRouter := web.New(Context{})
 	rootRouter.Middleware(web.LoggerMiddleware)
+	rootRouter.Middleware((*Context).MetricsMiddleware)
 	rootRouter.Middleware(web.ShowErrorsMiddleware)
 	rootRouter.Middleware(web.StaticMiddleware("./media/public", web.StaticOption{Prefix: "/public"})) // "public" is a directory to serve files from.)
 	rootRouter.Middleware((*Context).AssignStorageMiddleware)
@@ -55,6 +116,37 @@ func initRouter() *web.Router {
 	//sign in
 	rootRouter.Post(SignInURL.String(), (*Context).PostSignInRequestHandler)
 
+	//metrics for prometheus, which checks its own access rather than signing in
+	rootRouter.Get(MetricsURL.String(), (*Context).GetMetricsHandler)
+
+	//wake packet relaying for other kiwilands (they sign their requests instead of signing in)
+	rootRouter.Post(RelayWakeURL.String(), (*Context).PostRelayWakeHandler)
+
+	//the JSON api, for scripts
+	apiRouter := rootRouter.Subrouter(APIContext{}, "/")
+	apiRouter.Middleware((*APIContext).RequireAPIAccountMiddleware)
+	apiRouter.Get(APIDevicesURL.String(), (*APIContext).GetAPIDevicesHandler)
+	apiRouter.Get(APIDeviceURL.String(), (*APIContext).GetAPIDeviceHandler)
+	apiRouter.Post(APIDeviceWakeURL.String(), (*APIContext).PostAPIDeviceWakeHandler)
+	apiRouter.Get(APIStateURL.String(), (*APIContext).GetAPIStateHandler)
+	apiRouter.Post(APITVCommandURL.String(), (*APIContext).PostAPITVCommandHandler)
+	apiRouter.Post(APITVKeyURL.String(), (*APIContext).PostAPITVKeyHandler)
+	apiRouter.Post(APIToshibaCommandURL.String(), (*APIContext).PostAPIToshibaCommandHandler)
+	apiRouter.Post(APIToshibaLaunchURL.String(), (*APIContext).PostAPIToshibaLaunchHandler)
+	apiRouter.Post(APIRestoreURL.String(), (*APIContext).PostAPIRestoreHandler)
+	apiRouter.Get(APIScenesURL.String(), (*APIContext).GetAPIScenesHandler)
+	apiRouter.Get(APISceneURL.String(), (*APIContext).GetAPISceneHandler)
+	apiRouter.Post(APISceneRunURL.String(), (*APIContext).PostAPISceneRunHandler)
+
+	//local administration, only through the admin socket
+	adminRouter := rootRouter.Subrouter(AdminContext{}, "/")
+	adminRouter.Middleware((*AdminContext).RequireAdminSocketMiddleware)
+	adminRouter.Get(AdminUsersURL.String(), (*AdminContext).GetAdminUsersHandler)
+	adminRouter.Post(AdminUsersURL.String(), (*AdminContext).PostAdminUsersHandler)
+	adminRouter.Post(AdminUserPasswordURL.String(), (*AdminContext).PostAdminUserPasswordHandler)
+	adminRouter.Post(AdminUserRemoveURL.String(), (*AdminContext).PostAdminUserRemoveHandler)
+	adminRouter.Post(AdminReloadURL.String(), (*AdminContext).PostAdminReloadHandler)
+
 	//must be logged in for some handlers...
 	loggedInRouter := rootRouter.Subrouter(LoggedInContext{}, "/")
 	loggedInRouter.Middleware((*LoggedInContext).RequireAccountMiddleware)
@@ -64,7 +156,78 @@ func initRouter() *web.Router {
 
 	//handlers
 	loggedInRouter.Get(TVCommandURL.String(), (*LoggedInContext).GetTVCommandHandler)
+	loggedInRouter.Get(TVKeyURL.String(), (*LoggedInContext).GetTVKeyHandler)
 	loggedInRouter.Get(ToshibaCommandURL.String(), (*LoggedInContext).GetToshibaCommandHandler)
+	loggedInRouter.Get(ToshibaLaunchURL.String(), (*LoggedInContext).GetToshibaLaunchHandler)
+
+	//device handlers
+	loggedInRouter.Get(DiscoverURL.String(), (*LoggedInContext).GetDiscoverHandler)
+	loggedInRouter.Post(DevicesURL.String(), (*LoggedInContext).PostDeviceHandler)
+	loggedInRouter.Get(DeviceWakeURL.String(), (*LoggedInContext).GetDeviceWakeHandler)
+	loggedInRouter.Get(DeviceRemoveURL.String(), (*LoggedInContext).GetDeviceRemoveHandler)
+	loggedInRouter.Post(WakeMACURL.String(), (*LoggedInContext).PostWakeMACHandler)
+
+	//scene handlers
+	loggedInRouter.Get(SceneURL.String(), (*LoggedInContext).GetSceneHandler)
+	loggedInRouter.Get(SceneRunURL.String(), (*LoggedInContext).GetSceneRunHandler)
+
+	//desired state handlers
+	loggedInRouter.Get(StateURL.String(), (*LoggedInContext).GetStateHandler)
+	loggedInRouter.Get(StateApplyURL.String(), (*LoggedInContext).GetStateApplyHandler)
+
+	//schedule handlers
+	loggedInRouter.Get(SchedulesURL.String(), (*LoggedInContext).GetSchedulesHandler)
+	loggedInRouter.Post(SchedulesURL.String(), (*LoggedInContext).PostScheduleHandler)
+	loggedInRouter.Get(SchedulePauseURL.String(), (*LoggedInContext).GetSchedulePauseHandler)
+	loggedInRouter.Get(ScheduleRemoveURL.String(), (*LoggedInContext).GetScheduleRemoveHandler)
+
+	//sleep timer handlers
+	loggedInRouter.Post(SleepTimerURL.String(), (*LoggedInContext).PostSleepTimerHandler)
+	loggedInRouter.Get(SleepExtendURL.String(), (*LoggedInContext).GetSleepTimerExtendHandler)
+	loggedInRouter.Get(SleepCancelURL.String(), (*LoggedInContext).GetSleepTimerCancelHandler)
+
+	//rules
+	loggedInRouter.Get(RulesURL.String(), (*LoggedInContext).GetRulesHandler)
+
+	//audit log
+	loggedInRouter.Get(AuditURL.String(), (*LoggedInContext).GetAuditHandler)
+	loggedInRouter.Get(AuditExportURL.String(), (*LoggedInContext).GetAuditExportHandler)
+
+	//restoring devices to how they were
+	loggedInRouter.Get(RestoreURL.String(), (*LoggedInContext).GetRestoreHandler)
+
+	//queued commands
+	loggedInRouter.Get(QueueURL.String(), (*LoggedInContext).GetQueueHandler)
+	loggedInRouter.Post(QueueURL.String(), (*LoggedInContext).PostQueueHandler)
+	loggedInRouter.Get(QueueCancelURL.String(), (*LoggedInContext).GetQueueCancelHandler)
+
+	//screen time
+	loggedInRouter.Get(ScreenTimeURL.String(), (*LoggedInContext).GetScreenTimeHandler)
+
+	//idle standby handlers
+	loggedInRouter.Get(IdleKeepOnURL.String(), (*LoggedInContext).GetIdleKeepOnHandler)
+	loggedInRouter.Get(IdleResumeURL.String(), (*LoggedInContext).GetIdleResumeHandler)
+
+	//webhooks
+	loggedInRouter.Get(WebhooksURL.String(), (*LoggedInContext).GetWebhooksHandler)
+	loggedInRouter.Get(WebhookTestURL.String(), (*LoggedInContext).GetWebhookTestHandler)
+
+	//the pretend hue bridge
+	loggedInRouter.Get(HueURL.String(), (*LoggedInContext).GetHueHandler)
+	loggedInRouter.Get(HueLinkURL.String(), (*LoggedInContext).GetHueLinkHandler)
+	loggedInRouter.Get(HueUserRemoveURL.String(), (*LoggedInContext).GetHueUserRemoveHandler)
+
+	//the homekit bridge
+	loggedInRouter.Get(HomeKitURL.String(), (*LoggedInContext).GetHomeKitHandler)
+	loggedInRouter.Get(HomeKitUnpairURL.String(), (*LoggedInContext).GetHomeKitUnpairHandler)
+
+	//live updates for open pages
+	loggedInRouter.Get(LiveURL.String(), (*LoggedInContext).GetLiveHandler)
+
+	//settings, for API tokens
+	loggedInRouter.Get(SettingsURL.String(), (*LoggedInContext).GetSettingsHandler)
+	loggedInRouter.Post(TokensURL.String(), (*LoggedInContext).PostTokenHandler)
+	loggedInRouter.Get(TokenRevokeURL.String(), (*LoggedInContext).GetTokenRevokeHandler)
 
 	//create, delete fact handlers
 
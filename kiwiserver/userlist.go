@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -19,25 +21,56 @@ type User struct {
 	Password       string
 	SessionID      string
 	SessionExpires time.Time
+	Tokens         []APIToken
 }
 
 //A Userlist is a slice of users, useful for the website to keep around
 type Userlist struct {
 	Users []User
+
+	mu           sync.Mutex
+	lastUsedSave *time.Timer //set while a save of API tokens' LastUsed times is waiting
+}
+
+//find gives the index of a user, or -1 if there isn't one called username. The mutex must be held
+func (ul *Userlist) find(username string) int {
+	for i := range ul.Users {
+		if ul.Users[i].Username == username {
+			return i
+		}
+	}
+	return -1
 }
 
 //LoadUser will load a user from the userlist
 func (ul *Userlist) LoadUser(username string) (User, error) {
-	for _, u := range ul.Users {
-		if u.Username == username {
-			return u, nil
-		}
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	i := ul.find(username)
+	if i < 0 {
+		return User{}, errors.New("Username not found")
 	}
-	return User{}, errors.New("Username not found")
+	u := ul.Users[i]
+	u.Tokens = append([]APIToken(nil), u.Tokens...)
+	return u, nil
+}
+
+//List returns a copy of the users
+func (ul *Userlist) List() []User {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	list := make([]User, len(ul.Users))
+	for i, u := range ul.Users {
+		u.Tokens = append([]APIToken(nil), u.Tokens...)
+		list[i] = u
+	}
+	return list
 }
 
 //LoadUsernameFromSessionID will, given a valid sessionID, attempt to load a user
 func (ul *Userlist) LoadUsernameFromSessionID(sessionID string) (string, error) {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
 	for _, u := range ul.Users {
 		if u.SessionID == sessionID {
 			//make sure session is still valid
@@ -51,27 +84,89 @@ func (ul *Userlist) LoadUsernameFromSessionID(sessionID string) (string, error)
 
 //Logout will, given a username, expire that user's session
 func (ul *Userlist) Logout(username string) error {
-	for i := 0; i < len(ul.Users); i++ {
-		if ul.Users[i].Username == username {
-			ul.Users[i].SessionID = ""
-			ul.Users[i].SessionExpires = time.Now()
-			SaveUsers()
-			return nil
-		}
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	i := ul.find(username)
+	if i < 0 {
+		return errors.New("Username not found")
 	}
-	return errors.New("Username not found")
+	ul.Users[i].SessionID = ""
+	ul.Users[i].SessionExpires = time.Now()
+	saveUsers()
+	return nil
 }
 
 //SaveUser updates all fields of a user except username
 func (ul *Userlist) SaveUser(u User) error {
-	for i := 0; i < len(ul.Users); i++ {
-		if ul.Users[i].Username == u.Username {
-			ul.Users[i] = u
-			SaveUsers()
-			return nil
-		}
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	i := ul.find(u.Username)
+	if i < 0 {
+		return errors.New("Username not found")
 	}
-	return errors.New("Username not found")
+	ul.Users[i] = u
+	saveUsers()
+	return nil
+}
+
+//AddUser adds a user who can sign in with the given password
+func (ul *Userlist) AddUser(username string, password string) error {
+	if username == "" || password == "" {
+		return errors.New("Users need a username and a password")
+	}
+	if username == socketUser {
+		return errors.New(socketUser + " is what the admin socket is called, pick another username")
+	}
+	hashedPass, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	if err != nil {
+		return err
+	}
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	if ul.find(username) >= 0 {
+		return errors.New("There is already a user called " + username)
+	}
+	ul.Users = append(ul.Users, User{Username: username, Password: string(hashedPass)})
+	saveUsers()
+	return nil
+}
+
+//SetPassword changes a user's password and signs them out. Their API tokens keep working
+func (ul *Userlist) SetPassword(username string, password string) error {
+	if password == "" {
+		return errors.New("The password can't be empty")
+	}
+	hashedPass, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	if err != nil {
+		return err
+	}
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	i := ul.find(username)
+	if i < 0 {
+		return errors.New("Username not found")
+	}
+	ul.Users[i].Password = string(hashedPass)
+	ul.Users[i].SessionID = ""
+	ul.Users[i].SessionExpires = time.Now()
+	saveUsers()
+	return nil
+}
+
+//RemoveUser deletes a user along with their API tokens. The last user can't be removed, or nobody could sign in
+func (ul *Userlist) RemoveUser(username string) error {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	i := ul.find(username)
+	if i < 0 {
+		return errors.New("Username not found")
+	}
+	if len(ul.Users) == 1 {
+		return errors.New("Can't remove the only user")
+	}
+	ul.Users = append(ul.Users[:i], ul.Users[i+1:]...)
+	saveUsers()
+	return nil
 }
 
 //GenerateValidationKey will generate a random md5 hash
@@ -94,18 +189,28 @@ func (ul *Userlist) AttemptLogin(propUsername string, propPassword string, remem
 		if err = bcrypt.CompareHashAndPassword([]byte(propUser.Password), []byte(propPassword)); err == nil {
 			//successful login.
 			//generate session
-			propUser.SessionID, err = GenerateValidationKey()
+			sessionID, err := GenerateValidationKey()
 			if err != nil {
 				log.Println("Bad validation key")
 				return "", err
 			}
-			if !remember {
-				propUser.SessionExpires = time.Now().Add(3600 * time.Second) //expires in 1 hour if they don't want to be remembered
-			} else {
-				propUser.SessionExpires = time.Now().AddDate(0, 1, 0) //expires in 1 month if they want to be remembered
+			expires := time.Now().Add(3600 * time.Second) //expires in 1 hour if they don't want to be remembered
+			if remember {
+				expires = time.Now().AddDate(0, 1, 0) //expires in 1 month if they want to be remembered
+			}
+
+			//only the session changes, so tokens made or a password set while bcrypt ran aren't lost
+			ul.mu.Lock()
+			defer ul.mu.Unlock()
+			i := ul.find(propUsername)
+			if i < 0 {
+				return "", errors.New("Username not found")
 			}
+			ul.Users[i].SessionID = sessionID
+			ul.Users[i].SessionExpires = expires
+			saveUsers()
 			log.Printf("Login successful for user '%s'", propUsername)
-			return propUser.SessionID, ul.SaveUser(propUser)
+			return sessionID, nil
 		}
 		log.Println("Bad password")
 		return "", errors.New("Invalid Username or Password")
@@ -136,21 +241,31 @@ func LoadUsers() {
 		if err != nil {
 			panic("something's wrong with bcrypt")
 		}
-		users = Userlist{Users: []User{User{Username: username, Password: string(hashedPass)}}}
-		userBytes, _ = json.MarshalIndent(users, "", "\t")
-		ioutil.WriteFile(userFile, userBytes, 0644)
+		users.mu.Lock()
+		defer users.mu.Unlock()
+		users.Users = []User{User{Username: username, Password: string(hashedPass)}}
+		saveUsers()
 		return
 	}
+	users.mu.Lock()
+	defer users.mu.Unlock()
 	err = json.Unmarshal(userBytes, &users)
 	if err != nil {
 		log.Fatalf("User file is broken. Delete it and restart program.")
 	}
 }
 
-//SaveUsers will save the user file
-func SaveUsers() {
-	userBytes, _ := json.MarshalIndent(users, "", "\t")
-	ioutil.WriteFile(userFile, userBytes, 0644)
+//saveUsers will save the user file. It is written to a temporary file and renamed over the old one, so kiwiland
+//stopping part way through can't leave it half written. The mutex must be held
+func saveUsers() {
+	userBytes, _ := json.MarshalIndent(&users, "", "\t")
+	if err := ioutil.WriteFile(userFile+".tmp", userBytes, 0644); err != nil {
+		log.Println("Could not save user file:", err.Error())
+		return
+	}
+	if err := os.Rename(userFile+".tmp", userFile); err != nil {
+		log.Println("Could not save user file:", err.Error())
+		return
+	}
 	log.Println("Saved user file")
-	return
 }
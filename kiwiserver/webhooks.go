@@ -0,0 +1,221 @@
+package kiwiserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kiwih/kiwiland/kiwiagent"
+)
+
+//A Webhook is a URL that kiwiland POSTs events to, so other tools can react to them without polling
+type Webhook struct {
+	Name   string
+	URL    string
+	Secret string   //signs each delivery. See the README for how to check it
+	Events []string //the EventXxxx types to send, eg "power". Empty means power, input, online, loginfailed and scene
+	Device string   //only send events for this device, eg "tv". Empty means every device
+}
+
+//defaultWebhookEvents are what a webhook gets if it doesn't list any events
+var defaultWebhookEvents = []string{EventPower, EventInput, EventOnline, EventLoginFailed, EventScene}
+
+//Wants reports whether a webhook should get an event
+func (w Webhook) Wants(e Event) bool {
+	if w.Device != "" && w.Device != e.Device {
+		return false
+	}
+	events := w.Events
+	if len(events) == 0 {
+		events = defaultWebhookEvents
+	}
+	for _, t := range events {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+//A WebhookPayload is the JSON body of a delivery
+type WebhookPayload struct {
+	ID      string //the same for every attempt at a delivery, so repeats can be ignored
+	Webhook string
+	Event   Event
+	Scene   *SceneRun `json:",omitempty"` //for scene events, how the run went
+	Test    bool      `json:",omitempty"` //sent with the "send test" link rather than by a real event
+}
+
+//A WebhookAttempt is one try at a delivery
+type WebhookAttempt struct {
+	Time     time.Time
+	Status   int //the HTTP status code, or 0 if there wasn't a response
+	Error    string
+	Duration time.Duration
+}
+
+//A WebhookDelivery is an event sent, or being sent, to a webhook
+type WebhookDelivery struct {
+	ID        string
+	Webhook   string
+	Event     Event
+	Test      bool
+	Attempts  []WebhookAttempt
+	Delivered bool
+	Pending   bool //still being tried
+}
+
+//LastError is why the latest attempt at a delivery failed, or "" if it worked
+func (d WebhookDelivery) LastError() string {
+	if len(d.Attempts) == 0 {
+		return ""
+	}
+	return d.Attempts[len(d.Attempts)-1].Error
+}
+
+//Webhook headers, besides Content-Type
+const (
+	WebhookEventHeader     = "X-Kiwiland-Event"     //the event's type, eg "power"
+	WebhookDeliveryHeader  = "X-Kiwiland-Delivery"  //the delivery's ID
+	WebhookTimestampHeader = "X-Kiwiland-Timestamp" //the unix time the attempt was signed at
+	WebhookSignatureHeader = "X-Kiwiland-Signature" //hex HMAC-SHA256 of the timestamp, a newline, and the body, keyed with the Secret
+)
+
+const (
+	//webhookLogSize is how many deliveries the delivery log keeps
+	webhookLogSize = 200
+	//webhookTimeout is how long each attempt may take
+	webhookTimeout = 10 * time.Second
+)
+
+//webhookRetries are how long to wait before each retry of a failed delivery
+var webhookRetries = []time.Duration{10 * time.Second, time.Minute, 5 * time.Minute, 30 * time.Minute}
+
+var (
+	webhookMutex  sync.Mutex
+	webhookLog    []*WebhookDelivery
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+)
+
+//Webhooks returns the webhooks in the config
+func Webhooks() []Webhook {
+	return currentConfig().Webhooks
+}
+
+//LoadWebhook will load a webhook from the config
+func LoadWebhook(name string) (Webhook, error) {
+	for _, w := range currentConfig().Webhooks {
+		if w.Name == name {
+			return w, nil
+		}
+	}
+	return Webhook{}, errors.New("Webhook not found")
+}
+
+//WebhookLog returns a copy of the delivery log, newest first
+func WebhookLog() []WebhookDelivery {
+	webhookMutex.Lock()
+	defer webhookMutex.Unlock()
+	list := make([]WebhookDelivery, len(webhookLog))
+	for i, d := range webhookLog {
+		list[len(webhookLog)-1-i] = *d
+		list[len(webhookLog)-1-i].Attempts = append([]WebhookAttempt(nil), d.Attempts...)
+	}
+	return list
+}
+
+//postWebhook makes one attempt at a delivery
+func postWebhook(w Webhook, d *WebhookDelivery, body []byte) WebhookAttempt {
+	a := WebhookAttempt{Time: time.Now()}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, d.Event.Type)
+	req.Header.Set(WebhookDeliveryHeader, d.ID)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, kiwiagent.Sign(w.Secret, timestamp, string(body)))
+
+	resp, err := webhookClient.Do(req)
+	a.Duration = time.Since(a.Time)
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	resp.Body.Close()
+	a.Status = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		a.Error = "Webhook said " + resp.Status
+	}
+	return a
+}
+
+//deliver sends an event to a webhook, retrying with longer and longer waits until it works or the retries run out
+func deliver(w Webhook, e Event, test bool) {
+	id, err := GenerateValidationKey()
+	if err != nil {
+		log.Println("Webhook delivery id:", err.Error())
+		return
+	}
+	d := &WebhookDelivery{ID: id[:12], Webhook: w.Name, Event: e, Test: test, Pending: true}
+	payload := WebhookPayload{ID: d.ID, Webhook: w.Name, Event: e, Test: test}
+	if e.Type == EventScene {
+		if run, ok := LastSceneRun(e.Value); ok {
+			payload.Scene = &run
+		}
+	}
+	body, _ := json.Marshal(payload)
+
+	webhookMutex.Lock()
+	webhookLog = append(webhookLog, d)
+	if len(webhookLog) > webhookLogSize {
+		webhookLog = webhookLog[len(webhookLog)-webhookLogSize:]
+	}
+	webhookMutex.Unlock()
+
+	for try := 0; ; try++ {
+		a := postWebhook(w, d, body)
+		webhookMutex.Lock()
+		d.Attempts = append(d.Attempts, a)
+		d.Delivered = a.Error == ""
+		d.Pending = !d.Delivered && try < len(webhookRetries)
+		webhookMutex.Unlock()
+		if !d.Pending {
+			if !d.Delivered {
+				log.Printf("Webhook %s gave up on a %s event: %s", w.Name, e.Type, a.Error)
+			}
+			return
+		}
+		time.Sleep(webhookRetries[try])
+	}
+}
+
+//SendTestWebhook sends a made up event to a webhook, so its receiver can be checked
+func SendTestWebhook(name string) error {
+	w, err := LoadWebhook(name)
+	if err != nil {
+		return err
+	}
+	go deliver(w, Event{Time: time.Now(), Type: "test", Device: "kiwiland", Value: "test"}, true)
+	return nil
+}
+
+//RunWebhooks sends events to the webhooks that want them, forever
+func RunWebhooks() {
+	events := Subscribe()
+	for e := range events {
+		for _, w := range currentConfig().Webhooks {
+			if w.Wants(e) {
+				go deliver(w, e, false)
+			}
+		}
+	}
+}
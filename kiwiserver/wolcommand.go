@@ -2,17 +2,160 @@ package kiwiserver
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
 	"os/exec"
 	"strings"
+
+	"github.com/kiwih/kiwiland/kiwiagent"
 )
 
-//ToshibaWOL runs the rpi wakeonlan command
+//ParseMAC checks a MAC address and returns it in the form wakeonlan likes, eg 04:7D:7B:5B:FE:4D.
+//As well as that form it accepts dashes (04-7D-7B-5B-FE-4D), dots (047d.7b5b.fe4d) or no separators at all (047d7b5bfe4d)
+func ParseMAC(mac string) (string, error) {
+	mac = strings.TrimSpace(mac)
+	if len(mac) == 12 {
+		if _, err := hex.DecodeString(mac); err == nil {
+			mac = mac[0:2] + ":" + mac[2:4] + ":" + mac[4:6] + ":" + mac[6:8] + ":" + mac[8:10] + ":" + mac[10:12]
+		}
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return "", errors.New("Bad MAC address: " + mac)
+	}
+	return strings.ToUpper(hw.String()), nil
+}
+
+//toshibaMAC is the MAC address of the toshiba laptop's ethernet adapter
+const toshibaMAC = "04:7D:7B:5B:FE:4D"
+
+//WakeOnLAN runs the rpi wakeonlan command for the given MAC address
 //wakeonlan 04:7D:7B:5B:FE:4D
-func ToshibaWOL() (string, error) {
-	cmd := exec.Command("wakeonlan", "04:7D:7B:5B:FE:4D")
+func WakeOnLAN(mac string) (string, error) {
+	cmd := exec.Command("wakeonlan", mac)
 	cmd.Stdin = strings.NewReader("")
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	err := cmd.Run()
 	return out.String(), err
 }
+
+//WakeOnLANTo runs the rpi wakeonlan command for the given MAC address, sending the packet to a specific address
+//wakeonlan -i 192.168.3.255 04:7D:7B:5B:FE:4D
+func WakeOnLANTo(mac string, address string) (string, error) {
+	cmd := exec.Command("wakeonlan", "-i", address, mac)
+	cmd.Stdin = strings.NewReader("")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	return out.String(), err
+}
+
+//SetStaticNeighbour adds a permanent arp entry, so that unicast packets can reach a sleeping machine which won't answer arp
+//ip neigh replace 192.168.3.20 lladdr 04:7D:7B:5B:FE:4D dev eth0.3 nud permanent
+func SetStaticNeighbour(ip string, mac string, iface string) error {
+	cmd := exec.Command("ip", "neigh", "replace", ip, "lladdr", mac, "dev", iface, "nud", "permanent")
+	var out bytes.Buffer
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return errors.New("Could not set static neighbour: " + strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+//ToshibaWOL wakes the toshiba laptop, using its device settings if it is in the devicelist
+func ToshibaWOL() (string, error) {
+	if _, err := devices.LoadDevice("toshiba"); err == nil {
+		return WakeDevice("toshiba")
+	}
+	return WakeOnLAN(toshibaMAC)
+}
+
+//DeliveryXxxx are the ways a wake packet can get to a device
+const (
+	DeliveryBroadcast = "broadcast" //to 255.255.255.255, which doesn't leave our subnet
+	DeliveryDirected  = "directed"  //to the broadcast address of the device's subnet, which the router must forward
+	DeliveryUnicast   = "unicast"   //straight to the device's IP, with a static neighbour entry so it isn't lost to arp
+	DeliveryRelay     = "relay"     //through a kiwiagent or kiwiland on the device's subnet
+)
+
+//checkDelivery returns an error if a device's delivery settings are incomplete
+func checkDelivery(d Device) error {
+	switch d.Delivery {
+	case "", DeliveryBroadcast:
+	case DeliveryDirected:
+		if net.ParseIP(d.BroadcastAddress) == nil {
+			return errors.New("Directed delivery needs a broadcast address")
+		}
+	case DeliveryUnicast:
+		if net.ParseIP(d.IP) == nil || d.Interface == "" {
+			return errors.New("Unicast delivery needs an IP address and an interface")
+		}
+	case DeliveryRelay:
+		if _, ok := currentConfig().Relays[d.Relay]; !ok {
+			return errors.New("Relay delivery needs the name of a relay from the config")
+		}
+	default:
+		return errors.New("Unknown delivery: " + d.Delivery)
+	}
+	return nil
+}
+
+//WakeDevice wakes a device from the devicelist using its delivery settings
+func WakeDevice(name string) (string, error) {
+	d, err := devices.LoadDevice(name)
+	if err != nil {
+		return "", err
+	}
+	if err := checkDelivery(d); err != nil {
+		return "", err
+	}
+
+	switch d.Delivery {
+	case DeliveryDirected:
+		return WakeOnLANTo(d.MAC, d.BroadcastAddress)
+	case DeliveryUnicast:
+		if err := SetStaticNeighbour(d.IP, d.MAC, d.Interface); err != nil {
+			return "", err
+		}
+		return WakeOnLANTo(d.MAC, d.IP)
+	case DeliveryRelay:
+		relay := currentConfig().Relays[d.Relay]
+		return kiwiagent.Client{Address: relay.Address, Secret: relay.Secret}.Wake(d.MAC)
+	default:
+		return WakeOnLAN(d.MAC)
+	}
+}
+
+//ToshibaSleepOnLAN is the inverse of ToshibaWOL. It sends a signed udp packet to the kiwiagent's sleep-on-lan listener
+func ToshibaSleepOnLAN() (string, error) {
+	cfg := currentConfig()
+	if err := kiwiagent.SendSleepPacket(cfg.Agent.SleepOnLANAddress, cfg.Agent.Secret); err != nil {
+		return "", err
+	}
+	return "Sent sleep packet to " + cfg.Agent.SleepOnLANAddress, nil
+}
+
+//SleepOnLANEnabled reports if a sleep-on-lan address has been set in the config
+func SleepOnLANEnabled() bool {
+	return currentConfig().Agent.SleepOnLANAddress != ""
+}
+
+//HostOnline pings an IP address once and reports whether it answered
+//ping -c 1 -W 1 192.168.2.20
+func HostOnline(ip string) bool {
+	return exec.Command("ping", "-c", "1", "-W", "1", ip).Run() == nil
+}
+
+//DeviceOnline reports whether a device from the devicelist answers pings. The device needs an IP address
+func DeviceOnline(name string) (bool, error) {
+	d, err := devices.LoadDevice(name)
+	if err != nil {
+		return false, err
+	}
+	if d.IP == "" {
+		return false, errors.New("Device " + name + " has no IP address to ping")
+	}
+	return HostOnline(d.IP), nil
+}
@@ -0,0 +1,47 @@
+package kiwiserver
+
+import "testing"
+
+func TestParseMAC(t *testing.T) {
+	tests := []struct {
+		mac  string
+		want string //"" if it is bad
+	}{
+		{"04:7D:7B:5B:FE:4D", "04:7D:7B:5B:FE:4D"},
+		{"04:7d:7b:5b:fe:4d", "04:7D:7B:5B:FE:4D"},
+		{" 04:7d:7b:5b:fe:4d\n", "04:7D:7B:5B:FE:4D"},
+		{"04-7D-7B-5B-FE-4D", "04:7D:7B:5B:FE:4D"},
+		{"047d.7b5b.fe4d", "04:7D:7B:5B:FE:4D"},
+		{"047d7b5bfe4d", "04:7D:7B:5B:FE:4D"},
+		{"047D7B5BFE4D", "04:7D:7B:5B:FE:4D"},
+
+		//bad lengths
+		{"", ""},
+		{"04:7D:7B:5B:FE", ""},
+		{"04:7D:7B:5B:FE:4D:00", ""},
+		{"04:7D:7B:5B:FE:4D:00:01", ""}, //an EUI-64, which wake on lan can't use
+		{"047d7b5bfe4", ""},
+		{"047d7b5bfe4d0", ""},
+		{"4:7D:7B:5B:FE:4D", ""},
+
+		//bad separators and digits
+		{"04_7D_7B_5B_FE_4D", ""},
+		{"04 7D 7B 5B FE 4D", ""},
+		{"04:7D-7B:5B-FE:4D", ""},
+		{"047d:7b5b:fe4d", ""},
+		{"04:7D:7B:5B:FE:4G", ""},
+		{"047d7b5bfe4g", ""},
+	}
+	for _, test := range tests {
+		got, err := ParseMAC(test.mac)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q was accepted as %s", test.mac, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%q was read as %q (%v), want %s", test.mac, got, err, test.want)
+		}
+	}
+}
@@ -34,5 +34,11 @@ func main() {
 		cookieStoreSalt = "SUPER_SECRET_SALT"
 	}
 
-	kiwiserver.StartServer(serverAddress, cookieStoreSalt)
+	//the admin socket signs in everything that connects, so it is only made when asked for, eg /run/kiwiland/admin.sock
+	adminSocket := os.Getenv("ADMIN_SOCKET")
+	if len(adminSocket) == 0 {
+		log.Println("$ADMIN_SOCKET was not set, not listening on an admin socket")
+	}
+
+	kiwiserver.StartServer(serverAddress, cookieStoreSalt, adminSocket)
 }